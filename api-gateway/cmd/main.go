@@ -50,14 +50,36 @@ func main() {
 
 	// init proxy handler
 	proxyHandler := proxy.NewProxyHandler(telem, gatewayConfiguration.RequestTimeout)
+	defer proxyHandler.Close()
 
-	for _, route := range gatewayConfiguration.Routes {
-		if err := proxyHandler.AddRoute(route.Prefix, route.BackendUrl); err != nil {
+	if gatewayConfiguration.RetryBudget != nil {
+		proxyHandler.SetRetryBudget(*gatewayConfiguration.RetryBudget)
+	}
+
+	for _, route := range gatewayConfiguration.AllRoutes() {
+		if err := proxyHandler.AddRoute(route); err != nil {
 			log.Fatalf("error adding routes: %v\n", err)
 		}
-		log.Printf("%v route added successfully\n", route.Prefix)
+		log.Printf("%v route added successfully\n", route.Key())
+	}
+
+	// reload routes when the config file changes or on SIGHUP
+	reload := func() {
+		_ = proxyHandler.Reload(config.GatewayConfigurationPath)
 	}
 
+	if err := config.WatchGatewayConfiguration(config.GatewayConfigurationPath, reload); err != nil {
+		log.Printf("not watching gateway configuration file: %v\n", err)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			reload()
+		}
+	}()
+
 	// wrap proxy handler with telemetry middlewares
 	handler := Chain(proxyHandler,
 		telem.LogRequest,
@@ -66,18 +88,78 @@ func main() {
 	)
 
 	// server setup
-	gateway := &http.Server{
-		Addr:    gatewayConfiguration.ListenAddress,
-		Handler: handler,
+	// gRPC clients talk HTTP/2, without TLS by prior knowledge (h2c)
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	var gateways []*http.Server
+	if gatewayConfiguration.ListenAddress != "" {
+		gateway := &http.Server{
+			Addr:      gatewayConfiguration.ListenAddress,
+			Handler:   handler,
+			Protocols: protocols,
+		}
+		gateways = append(gateways, gateway)
+
+		// start server in goroutine
+		go func() {
+			log.Printf("Gateway listening on %s\n", gatewayConfiguration.ListenAddress)
+			if err := gateway.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("server error: %v\n", err)
+			}
+		}()
 	}
 
-	// start server in goroutine
-	go func() {
-		log.Printf("Gateway listening on %s\n", gatewayConfiguration.ListenAddress)
-		if err := gateway.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("server error: %v\n", err)
+	// TLS listeners pick their certificate by SNI and negotiate HTTP/2 with ALPN
+	tlsProtocols := new(http.Protocols)
+	tlsProtocols.SetHTTP1(true)
+	tlsProtocols.SetHTTP2(true)
+
+	for _, listener := range gatewayConfiguration.TLSListeners {
+		certificates, err := proxy.NewCertificateStore(telem, listener.Certificates)
+		if err != nil {
+			log.Fatalf("error loading certificates of %v: %v\n", listener.Address, err)
+		}
+		defer certificates.Close()
+
+		tlsConfig, err := proxy.NewTLSConfig(listener, certificates)
+		if err != nil {
+			log.Fatalf("error configuring TLS on %v: %v\n", listener.Address, err)
 		}
-	}()
+
+		gateway := &http.Server{
+			Addr:      listener.Address,
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+			Protocols: tlsProtocols,
+		}
+		gateways = append(gateways, gateway)
+
+		go func() {
+			log.Printf("Gateway listening with TLS on %s\n", listener.Address)
+			if err := gateway.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("TLS server error: %v\n", err)
+			}
+		}()
+	}
+
+	// admin API on its own listener, disabled unless configured
+	var admin *http.Server
+	if gatewayConfiguration.AdminListenAddress != "" {
+		admin = &http.Server{
+			Addr:    gatewayConfiguration.AdminListenAddress,
+			Handler: proxy.NewAdminHandler(proxyHandler),
+		}
+
+		go func() {
+			log.Printf("Admin API listening on %s\n", gatewayConfiguration.AdminListenAddress)
+			if err := admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("admin server error: %v\n", err)
+			}
+		}()
+	}
 
 	// graceful shutdown
 	quit := make(chan os.Signal, 1)
@@ -88,8 +170,15 @@ func main() {
 	defer cancel()
 
 	log.Println("Shutting down server...")
-	if err := gateway.Shutdown(ctxShutdown); err != nil {
-		log.Fatalf("server forced to shutdown: %v", err)
+	if admin != nil {
+		if err := admin.Shutdown(ctxShutdown); err != nil {
+			log.Printf("admin server forced to shutdown: %v\n", err)
+		}
+	}
+	for _, gateway := range gateways {
+		if err := gateway.Shutdown(ctxShutdown); err != nil {
+			log.Fatalf("server forced to shutdown: %v", err)
+		}
 	}
 	log.Println("Server exited gracefully")
 }
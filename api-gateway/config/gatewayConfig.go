@@ -1,48 +1,669 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/spf13/viper"
 )
 
+var ErrInvalidConfiguration = errors.New("invalid gateway configuration")
+
+// Backend is a server a route sends requests to.
+type Backend struct {
+	Url    string `mapstructure:"url" json:"url,omitempty"`
+	Weight int    `mapstructure:"weight" json:"weight,omitempty"`
+}
+
+// HealthCheck configures the active health checks of the backends of a route.
+type HealthCheck struct {
+	Path               string        `mapstructure:"path" json:"path,omitempty"`
+	Interval           time.Duration `mapstructure:"interval" json:"interval,omitempty"`
+	Timeout            time.Duration `mapstructure:"timeout" json:"timeout,omitempty"`
+	HealthyThreshold   int           `mapstructure:"healthyThreshold" json:"healthyThreshold,omitempty"`
+	UnhealthyThreshold int           `mapstructure:"unhealthyThreshold" json:"unhealthyThreshold,omitempty"`
+}
+
+// OutlierDetection configures the ejection of backends that keep failing.
+type OutlierDetection struct {
+	ConsecutiveErrors  int           `mapstructure:"consecutiveErrors" json:"consecutiveErrors,omitempty"`
+	BaseEjectionTime   time.Duration `mapstructure:"baseEjectionTime" json:"baseEjectionTime,omitempty"`
+	MaxEjectionTime    time.Duration `mapstructure:"maxEjectionTime" json:"maxEjectionTime,omitempty"`
+	MaxEjectionPercent int           `mapstructure:"maxEjectionPercent" json:"maxEjectionPercent,omitempty"`
+}
+
+// CircuitBreaker configures the circuit breaker of each backend of a route.
+type CircuitBreaker struct {
+	FailureRatio    float64       `mapstructure:"failureRatio" json:"failureRatio,omitempty"`
+	MinimumRequests int           `mapstructure:"minimumRequests" json:"minimumRequests,omitempty"`
+	Interval        time.Duration `mapstructure:"interval" json:"interval,omitempty"`
+	OpenDuration    time.Duration `mapstructure:"openDuration" json:"openDuration,omitempty"`
+	HalfOpenProbes  int           `mapstructure:"halfOpenProbes" json:"halfOpenProbes,omitempty"`
+}
+
+// RetryPolicy configures which failed requests of a route are retried.
+type RetryPolicy struct {
+	MaxAttempts  int           `mapstructure:"maxAttempts" json:"maxAttempts,omitempty"`
+	Methods      []string      `mapstructure:"methods" json:"methods,omitempty"`
+	StatusCodes  []int         `mapstructure:"statusCodes" json:"statusCodes,omitempty"`
+	RetryOn      []string      `mapstructure:"retryOn" json:"retryOn,omitempty"`
+	BaseBackoff  time.Duration `mapstructure:"baseBackoff" json:"baseBackoff,omitempty"`
+	MaxBackoff   time.Duration `mapstructure:"maxBackoff" json:"maxBackoff,omitempty"`
+	MaxBodyBytes int64         `mapstructure:"maxBodyBytes" json:"maxBodyBytes,omitempty"`
+}
+
+// RetryBudget limits retries across the gateway to a share of the requests.
+type RetryBudget struct {
+	Ratio               float64       `mapstructure:"ratio" json:"ratio,omitempty"`
+	MinRetriesPerSecond int           `mapstructure:"minRetriesPerSecond" json:"minRetriesPerSecond,omitempty"`
+	Window              time.Duration `mapstructure:"window" json:"window,omitempty"`
+}
+
+// Hedging configures the copies of slow read-only requests sent to other backends.
+type Hedging struct {
+	Delay       time.Duration `mapstructure:"delay" json:"delay,omitempty"`
+	Percentile  float64       `mapstructure:"percentile" json:"percentile,omitempty"`
+	MaxRequests int           `mapstructure:"maxRequests" json:"maxRequests,omitempty"`
+}
+
+// Streaming configures how a route relays streamed responses, such as server-sent events.
+type Streaming struct {
+	Always        bool          `mapstructure:"always" json:"always,omitempty"`
+	ContentTypes  []string      `mapstructure:"contentTypes" json:"contentTypes,omitempty"`
+	FlushInterval time.Duration `mapstructure:"flushInterval" json:"flushInterval,omitempty"`
+	IdleTimeout   time.Duration `mapstructure:"idleTimeout" json:"idleTimeout,omitempty"`
+}
+
+// WebSocket configures the WebSocket tunnels of a route.
+type WebSocket struct {
+	IdleTimeout time.Duration `mapstructure:"idleTimeout" json:"idleTimeout,omitempty"`
+}
+
+// Mirror copies a percentage (0-100) of the requests of a route to a shadow backend.
+type Mirror struct {
+	Url           string         `mapstructure:"url" json:"url,omitempty"`
+	Percentage    float64        `mapstructure:"percentage" json:"percentage,omitempty"`
+	Timeout       time.Duration  `mapstructure:"timeout" json:"timeout,omitempty"`
+	MaxConcurrent int            `mapstructure:"maxConcurrent" json:"maxConcurrent,omitempty"`
+	MaxBodyBytes  int64          `mapstructure:"maxBodyBytes" json:"maxBodyBytes,omitempty"`
+	Compare       *ShadowCompare `mapstructure:"compare" json:"compare,omitempty"`
+}
+
+// ShadowCompare compares the responses of a mirror with those of the route's backends.
+type ShadowCompare struct {
+	Headers        []string `mapstructure:"headers" json:"headers,omitempty"`
+	IgnorePaths    []string `mapstructure:"ignorePaths" json:"ignorePaths,omitempty"`
+	MaxBodyBytes   int64    `mapstructure:"maxBodyBytes" json:"maxBodyBytes,omitempty"`
+	DiffFile       string   `mapstructure:"diffFile" json:"diffFile,omitempty"`
+	DiffPercentage float64  `mapstructure:"diffPercentage" json:"diffPercentage,omitempty"`
+}
+
+// ErrorMapping replaces the backend responses with a status by an error response of the gateway.
+type ErrorMapping struct {
+	Status        int    `mapstructure:"status" json:"status,omitempty"`
+	ReplaceStatus int    `mapstructure:"replaceStatus" json:"replaceStatus,omitempty"`
+	Message       string `mapstructure:"message" json:"message,omitempty"`
+}
+
+// ErrorTemplate renders the error responses of a route.
+type ErrorTemplate struct {
+	ContentType string `mapstructure:"contentType" json:"contentType,omitempty"`
+	Template    string `mapstructure:"template" json:"template,omitempty"`
+	File        string `mapstructure:"file" json:"file,omitempty"`
+}
+
+// PathRewrite changes the path sent to the backends of a route.
+type PathRewrite struct {
+	// ReplacePrefix replaces the matched part of the path, with {param} placeholders for captured parameters
+	ReplacePrefix string `mapstructure:"replacePrefix" json:"replacePrefix,omitempty"`
+	// Regex must match the whole request path; when it does, the path becomes
+	// Replacement with $1 or ${name} expanded to the capture groups
+	Regex       string `mapstructure:"regex" json:"regex,omitempty"`
+	Replacement string `mapstructure:"replacement" json:"replacement,omitempty"`
+	// BasePath is prepended to the rewritten path
+	BasePath string `mapstructure:"basePath" json:"basePath,omitempty"`
+}
+
+// SplitVariant is a group of backends that receives a share of the traffic of a route.
+type SplitVariant struct {
+	Name     string    `mapstructure:"name" json:"name,omitempty"`
+	Weight   int       `mapstructure:"weight" json:"weight,omitempty"`
+	Backends []Backend `mapstructure:"backends" json:"backends,omitempty"`
+}
+
+// TrafficSplit divides the requests of a route between variants by weight.
+type TrafficSplit struct {
+	Variants     []SplitVariant `mapstructure:"variants" json:"variants,omitempty"`
+	StickyHeader string         `mapstructure:"stickyHeader" json:"stickyHeader,omitempty"`
+	StickyCookie string         `mapstructure:"stickyCookie" json:"stickyCookie,omitempty"`
+}
+
+// Route protocols.
+const (
+	ProtocolHTTP = "http"
+	ProtocolGrpc = "grpc"
+)
+
+// GrpcTranscoding exposes the unary methods of a gRPC route as JSON endpoints.
+type GrpcTranscoding struct {
+	DescriptorSet   string `mapstructure:"descriptorSet" json:"descriptorSet,omitempty"`
+	UseProtoNames   bool   `mapstructure:"useProtoNames" json:"useProtoNames,omitempty"`
+	EmitUnpopulated bool   `mapstructure:"emitUnpopulated" json:"emitUnpopulated,omitempty"`
+}
+
+// Composite error policies.
+const (
+	CompositeFailAll = "failAll"
+	CompositePartial = "partial"
+)
+
+// CompositeCall is one of the backend calls of a composite route.
+type CompositeCall struct {
+	Key     string        `mapstructure:"key" json:"key,omitempty"`
+	Url     string        `mapstructure:"url" json:"url,omitempty"`
+	Method  string        `mapstructure:"method" json:"method,omitempty"`
+	Path    string        `mapstructure:"path" json:"path,omitempty"`
+	Timeout time.Duration `mapstructure:"timeout" json:"timeout,omitempty"`
+}
+
+// Composite answers a route by calling several backends and merging their JSON responses.
+type Composite struct {
+	Calls   []CompositeCall `mapstructure:"calls" json:"calls,omitempty"`
+	OnError string          `mapstructure:"onError" json:"onError,omitempty"`
+}
+
+// UpstreamTLS configures the TLS connections a route opens to https:// backends.
+type UpstreamTLS struct {
+	CAFile             string `mapstructure:"caFile" json:"caFile,omitempty"`
+	CertFile           string `mapstructure:"certFile" json:"certFile,omitempty"`
+	KeyFile            string `mapstructure:"keyFile" json:"keyFile,omitempty"`
+	ServerName         string `mapstructure:"serverName" json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `mapstructure:"insecureSkipVerify" json:"insecureSkipVerify,omitempty"`
+}
+
+// ValueMatch matches a named header or query parameter.
+type ValueMatch struct {
+	Name  string `mapstructure:"name" json:"name,omitempty"`
+	Value string `mapstructure:"value" json:"value,omitempty"`
+	Regex string `mapstructure:"regex" json:"regex,omitempty"`
+}
+
+// RouteMatch holds the conditions besides the path a request must meet to take a route.
+type RouteMatch struct {
+	Methods []string     `mapstructure:"methods" json:"methods,omitempty"`
+	Headers []ValueMatch `mapstructure:"headers" json:"headers,omitempty"`
+	Query   []ValueMatch `mapstructure:"query" json:"query,omitempty"`
+	// Cookies are names of cookies the request must carry
+	Cookies []string `mapstructure:"cookies" json:"cookies,omitempty"`
+}
+
+// Route maps the requests for a path to its backends.
 type Route struct {
-	Name       string `mapstructure:"name"`
-	Prefix     string `mapstructure:"prefix"`
-	BackendUrl string `mapstructure:"backendUrl"`
+	Name string `mapstructure:"name" json:"name,omitempty"`
+	// Hosts limits the route to requests for these hosts, exact or *.wildcard;
+	// routes without hosts serve every other host
+	Hosts []string `mapstructure:"hosts" json:"hosts,omitempty"`
+	// Prefix is the path pattern of the route, with :param and trailing *wildcard segments
+	Prefix string `mapstructure:"prefix" json:"prefix,omitempty"`
+	// Exact routes match their pattern only, not the paths below it
+	Exact bool `mapstructure:"exact" json:"exact,omitempty"`
+	// Match narrows the route down to some requests; several routes may share a path if all but one have it
+	Match *RouteMatch `mapstructure:"match" json:"match,omitempty"`
+	// Priority orders routes with the same path, highest first; ties go to the route with more match conditions
+	Priority int `mapstructure:"priority" json:"priority,omitempty"`
+	// Protocol is http (the default) or grpc. gRPC routes keep the /package.Service/Method
+	// path and talk HTTP/2 to their backends, h2c for http:// and TLS for https:// backends
+	Protocol string `mapstructure:"protocol" json:"protocol,omitempty"`
+	// Transcoding turns JSON requests into calls of the gRPC backends of the route
+	Transcoding      *GrpcTranscoding  `mapstructure:"transcoding" json:"transcoding,omitempty"`
+	Rewrite          *PathRewrite      `mapstructure:"rewrite" json:"rewrite,omitempty"`
+	Backends         []Backend         `mapstructure:"backends" json:"backends,omitempty"`
+	Split            *TrafficSplit     `mapstructure:"split" json:"split,omitempty"`
+	Composite        *Composite        `mapstructure:"composite" json:"composite,omitempty"`
+	LoadBalancer     string            `mapstructure:"loadBalancer" json:"loadBalancer,omitempty"`
+	HealthCheck      *HealthCheck      `mapstructure:"healthCheck" json:"healthCheck,omitempty"`
+	OutlierDetection *OutlierDetection `mapstructure:"outlierDetection" json:"outlierDetection,omitempty"`
+	CircuitBreaker   *CircuitBreaker   `mapstructure:"circuitBreaker" json:"circuitBreaker,omitempty"`
+	Retry            *RetryPolicy      `mapstructure:"retry" json:"retry,omitempty"`
+	Hedging          *Hedging          `mapstructure:"hedging" json:"hedging,omitempty"`
+	Mirror           *Mirror           `mapstructure:"mirror" json:"mirror,omitempty"`
+	WebSocket        *WebSocket        `mapstructure:"webSocket" json:"webSocket,omitempty"`
+	Streaming        *Streaming        `mapstructure:"streaming" json:"streaming,omitempty"`
+	ErrorMappings    []ErrorMapping    `mapstructure:"errorMappings" json:"errorMappings,omitempty"`
+	ErrorTemplate    *ErrorTemplate    `mapstructure:"errorTemplate" json:"errorTemplate,omitempty"`
+	// UpstreamTLS applies to every connection of the route: to its backends, their
+	// health checks and WebSocket tunnels, to composite calls and to the mirror
+	UpstreamTLS *UpstreamTLS `mapstructure:"upstreamTLS" json:"upstreamTLS,omitempty"`
+}
+
+// Key identifies the route, see RouteKey. Only routes with match conditions are told apart by name.
+func (r Route) Key() string {
+	if r.Match == nil {
+		return RouteKey(r.Hosts, r.Prefix, "")
+	}
+
+	return RouteKey(r.Hosts, r.Prefix, r.Name)
+}
+
+// AllBackends returns the backends of the route, including those of its split variants.
+func (r Route) AllBackends() []Backend {
+	if r.Split == nil {
+		return r.Backends
+	}
+
+	var backends []Backend
+	for _, variant := range r.Split.Variants {
+		backends = append(backends, variant.Backends...)
+	}
+
+	return backends
 }
 
+// RouteKey builds a route key: the prefix, preceded by the hosts when there
+// are any and followed by #name when a name is given.
+func RouteKey(hosts []string, prefix, name string) string {
+	key := prefix
+
+	if len(hosts) > 0 {
+		lowered := make([]string, len(hosts))
+		for i, host := range hosts {
+			lowered[i] = strings.ToLower(host)
+		}
+		slices.Sort(lowered)
+		key = strings.Join(lowered, ",") + key
+	}
+
+	if name != "" {
+		key += "#" + name
+	}
+
+	return key
+}
+
+// VirtualHost groups the routes served for requests to its hosts.
+type VirtualHost struct {
+	Name   string   `mapstructure:"name"`
+	Hosts  []string `mapstructure:"hosts"`
+	Routes []Route  `mapstructure:"routes"`
+}
+
+// TLS versions a TLS listener may require at least.
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// Certificate is a PEM encoded certificate chain and its private key.
+type Certificate struct {
+	CertFile string `mapstructure:"certFile"`
+	KeyFile  string `mapstructure:"keyFile"`
+}
+
+// TLSListener terminates TLS on Address and serves HTTP/1.1 and HTTP/2.
+type TLSListener struct {
+	Address      string        `mapstructure:"address"`
+	Certificates []Certificate `mapstructure:"certificates"`
+	MinVersion   string        `mapstructure:"minVersion"`
+	CipherSuites []string      `mapstructure:"cipherSuites"`
+}
+
+// GatewayConfiguration is the configuration file of the gateway.
 type GatewayConfiguration struct {
-	ListenAddress  string        `mapstructure:"listenAddress"`
-	RequestTimeout time.Duration `mapstructure:"requestTimeout"`
-	Routes         []Route       `mapstructure:"routes"`
+	// ListenAddress serves plaintext HTTP/1.1 and h2c, which is disabled when
+	// empty as long as there are TLS listeners
+	ListenAddress string `mapstructure:"listenAddress"`
+	// AdminListenAddress serves the admin API, which is disabled when empty
+	AdminListenAddress string        `mapstructure:"adminListenAddress"`
+	TLSListeners       []TLSListener `mapstructure:"tlsListeners"`
+	RequestTimeout     time.Duration `mapstructure:"requestTimeout"`
+	RetryBudget        *RetryBudget  `mapstructure:"retryBudget"`
+	Routes             []Route       `mapstructure:"routes"`
+	VirtualHosts       []VirtualHost `mapstructure:"virtualHosts"`
 }
 
-func loadGatewayConfiguration() error {
-	viper.SetConfigFile("./config/gatewayConfig.yml")
+// AllRoutes returns the routes of the default host followed by the routes
+// of every virtual host, which take the hosts of their virtual host.
+func (c *GatewayConfiguration) AllRoutes() []Route {
+	routes := slices.Clone(c.Routes)
+
+	for _, virtualHost := range c.VirtualHosts {
+		for _, route := range virtualHost.Routes {
+			route.Hosts = virtualHost.Hosts
+			routes = append(routes, route)
+		}
+	}
 
-	err := viper.ReadInConfig()
+	return routes
+}
+
+// GatewayConfigurationPath is the file the gateway reads its configuration from.
+const GatewayConfigurationPath = "./config/gatewayConfig.yml"
+
+func loadGatewayConfiguration(v *viper.Viper, path string) error {
+	v.SetConfigFile(path)
+
+	err := v.ReadInConfig()
 	if err != nil {
 		return err
-		// log.Fatalf("error on reading gateway configuration file: %v", err)
 	}
 
 	return nil
 }
 
 func NewGatewayConfiguration() (*GatewayConfiguration, error) {
-	err := loadGatewayConfiguration()
+	return LoadGatewayConfiguration(GatewayConfigurationPath)
+}
+
+// LoadGatewayConfiguration reads and validates the gateway configuration at path.
+// It uses its own viper instance, so reloading it does not disturb other configuration files.
+func LoadGatewayConfiguration(path string) (*GatewayConfiguration, error) {
+	v := viper.New()
+
+	err := loadGatewayConfiguration(v, path)
 	if err != nil {
 		return nil, err
 	}
 
 	var config GatewayConfiguration
 
-	err = viper.Unmarshal(&config)
+	err = v.Unmarshal(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
 	if err != nil {
-		// log.Fatalf("unable to decode gateway configuration into struct: %v", err)
 		return nil, err
 	}
 
 	return &config, nil
 }
+
+// Validate checks the structure of the configuration. Settings that only
+// the proxy understands, such as load balancer names, are checked when the
+// routes are built.
+func (c *GatewayConfiguration) Validate() error {
+	var errs []error
+
+	if c.ListenAddress == "" && len(c.TLSListeners) == 0 {
+		errs = append(errs, errors.New("listenAddress or a TLS listener is required"))
+	}
+
+	if c.ListenAddress != "" && c.ListenAddress == c.AdminListenAddress {
+		errs = append(errs, errors.New("adminListenAddress must differ from listenAddress"))
+	}
+
+	addresses := map[string]bool{c.ListenAddress: true, c.AdminListenAddress: true}
+	for i, listener := range c.TLSListeners {
+		if listener.Address == "" || addresses[listener.Address] {
+			errs = append(errs, fmt.Errorf("TLS listener %d: address must be set and differ from the other listen addresses, got %q", i, listener.Address))
+		}
+		addresses[listener.Address] = true
+
+		if err := validateTLSListener(listener); err != nil {
+			errs = append(errs, fmt.Errorf("TLS listener %d (%v): %w", i, listener.Address, err))
+		}
+	}
+
+	for i, virtualHost := range c.VirtualHosts {
+		if len(virtualHost.Hosts) == 0 {
+			errs = append(errs, fmt.Errorf("virtual host %d (%v): at least one host is required", i, virtualHost.Name))
+		}
+		for _, route := range virtualHost.Routes {
+			if len(route.Hosts) > 0 {
+				errs = append(errs, fmt.Errorf("virtual host %d (%v): route %v must not set hosts", i, virtualHost.Name, route.Prefix))
+			}
+		}
+	}
+
+	if err := validateRoutes(c.AllRoutes()); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w: %w", ErrInvalidConfiguration, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// ValidateRoutes checks a set of routes the way Validate checks the routes of a configuration file.
+func ValidateRoutes(routes []Route) error {
+	err := validateRoutes(routes)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+	}
+
+	return nil
+}
+
+func validateRoutes(routes []Route) error {
+	var errs []error
+
+	keys := make(map[string]bool, len(routes))
+
+	for i, route := range routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			errs = append(errs, fmt.Errorf("route %d (%v): prefix %q must start with /", i, route.Name, route.Prefix))
+		}
+		if keys[route.Key()] {
+			errs = append(errs, fmt.Errorf("route %d (%v): duplicate prefix %q for hosts %v", i, route.Name, route.Prefix, route.Hosts))
+		}
+		keys[route.Key()] = true
+
+		for _, host := range route.Hosts {
+			if err := validateHostPattern(host); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): %w", i, route.Name, err))
+			}
+		}
+
+		if route.Match != nil {
+			if err := validateRouteMatch(route); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): %w", i, route.Name, err))
+			}
+		}
+
+		switch route.Protocol {
+		case "", ProtocolHTTP:
+		case ProtocolGrpc:
+			if route.Composite != nil || route.Rewrite != nil || route.WebSocket != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): gRPC routes cannot be composite, rewrite paths or tunnel WebSockets", i, route.Name))
+			}
+			// request bodies of gRPC calls are streamed, so they cannot be buffered for replay
+			if route.Retry != nil || route.Hedging != nil || route.Mirror != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): gRPC routes cannot retry, hedge or mirror requests", i, route.Name))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("route %d (%v): unknown protocol %q", i, route.Name, route.Protocol))
+		}
+		if route.Transcoding != nil {
+			if route.Protocol != ProtocolGrpc {
+				errs = append(errs, fmt.Errorf("route %d (%v): transcoding needs a gRPC route", i, route.Name))
+			}
+			if route.Transcoding.DescriptorSet == "" {
+				errs = append(errs, fmt.Errorf("route %d (%v): transcoding needs a descriptor set", i, route.Name))
+			}
+		}
+
+		if upstreamTLS := route.UpstreamTLS; upstreamTLS != nil && (upstreamTLS.CertFile == "") != (upstreamTLS.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("route %d (%v): upstream client certificates need both a certFile and a keyFile", i, route.Name))
+		}
+
+		if route.Composite != nil {
+			if len(route.Backends) > 0 || route.Split != nil || route.Mirror != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): composite routes call the backends of their calls only", i, route.Name))
+			}
+			if err := validateComposite(*route.Composite); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): %w", i, route.Name, err))
+			}
+		} else if route.Split != nil {
+			if len(route.Backends) > 0 {
+				errs = append(errs, fmt.Errorf("route %d (%v): backends belong to the split variants of split routes", i, route.Name))
+			}
+			if err := validateTrafficSplit(*route.Split); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): %w", i, route.Name, err))
+			}
+		} else if len(route.Backends) == 0 {
+			errs = append(errs, fmt.Errorf("route %d (%v): at least one backend is required", i, route.Name))
+		}
+		for _, backend := range route.AllBackends() {
+			if _, err := url.ParseRequestURI(backend.Url); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): invalid backend url %q: %w", i, route.Name, backend.Url, err))
+			}
+		}
+		if route.Mirror != nil {
+			if _, err := url.ParseRequestURI(route.Mirror.Url); err != nil {
+				errs = append(errs, fmt.Errorf("route %d (%v): invalid mirror url %q: %w", i, route.Name, route.Mirror.Url, err))
+			}
+			if route.Mirror.Percentage < 0 || route.Mirror.Percentage > 100 {
+				errs = append(errs, fmt.Errorf("route %d (%v): mirror percentage must be between 0 and 100", i, route.Name))
+			}
+			if compare := route.Mirror.Compare; compare != nil && (compare.DiffPercentage < 0 || compare.DiffPercentage > 100) {
+				errs = append(errs, fmt.Errorf("route %d (%v): diff percentage must be between 0 and 100", i, route.Name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateTLSListener(listener TLSListener) error {
+	var errs []error
+
+	if len(listener.Certificates) == 0 {
+		errs = append(errs, errors.New("at least one certificate is required"))
+	}
+	for _, certificate := range listener.Certificates {
+		if certificate.CertFile == "" || certificate.KeyFile == "" {
+			errs = append(errs, errors.New("certificates need both a certFile and a keyFile"))
+		}
+	}
+
+	switch listener.MinVersion {
+	case "", TLSVersion12:
+	case TLSVersion13:
+		if len(listener.CipherSuites) > 0 {
+			errs = append(errs, errors.New("cipher suites cannot be chosen for TLS 1.3"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown minimum TLS version %q", listener.MinVersion))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateComposite(composite Composite) error {
+	var errs []error
+
+	if composite.OnError != "" && composite.OnError != CompositeFailAll && composite.OnError != CompositePartial {
+		errs = append(errs, fmt.Errorf("unknown composite error policy %q", composite.OnError))
+	}
+
+	if len(composite.Calls) == 0 {
+		errs = append(errs, errors.New("composite routes need at least one call"))
+	}
+
+	keys := make(map[string]bool, len(composite.Calls))
+	for _, call := range composite.Calls {
+		if call.Key == "" || keys[call.Key] {
+			errs = append(errs, fmt.Errorf("composite call keys must be set and unique, got %q", call.Key))
+		}
+		keys[call.Key] = true
+
+		if _, err := url.ParseRequestURI(call.Url); err != nil {
+			errs = append(errs, fmt.Errorf("invalid composite call url %q: %w", call.Url, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateTrafficSplit(split TrafficSplit) error {
+	var errs []error
+
+	if split.StickyHeader != "" && split.StickyCookie != "" {
+		errs = append(errs, errors.New("split sets both a sticky header and a sticky cookie"))
+	}
+
+	names := make(map[string]bool, len(split.Variants))
+	totalWeight := 0
+
+	for _, variant := range split.Variants {
+		if variant.Name == "" || names[variant.Name] {
+			errs = append(errs, fmt.Errorf("split variant names must be set and unique, got %q", variant.Name))
+		}
+		names[variant.Name] = true
+
+		if variant.Weight < 0 {
+			errs = append(errs, fmt.Errorf("split variant %v has a negative weight", variant.Name))
+		}
+		totalWeight += variant.Weight
+
+		if len(variant.Backends) == 0 {
+			errs = append(errs, fmt.Errorf("split variant %v needs at least one backend", variant.Name))
+		}
+	}
+
+	if totalWeight <= 0 {
+		errs = append(errs, errors.New("split weights must add up to more than 0"))
+	}
+
+	return errors.Join(errs...)
+}
+
+func validateRouteMatch(route Route) error {
+	var errs []error
+
+	if route.Name == "" {
+		errs = append(errs, errors.New("routes with match conditions need a name"))
+	}
+
+	for _, valueMatch := range slices.Concat(route.Match.Headers, route.Match.Query) {
+		if valueMatch.Name == "" {
+			errs = append(errs, errors.New("header and query conditions need a name"))
+		}
+		if valueMatch.Value != "" && valueMatch.Regex != "" {
+			errs = append(errs, fmt.Errorf("condition on %v sets both value and regex", valueMatch.Name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateHostPattern accepts a host name, or a host name whose first label is * to match any subdomain.
+func validateHostPattern(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if name == "" || strings.ContainsAny(name, "*/:") {
+		return fmt.Errorf("invalid host pattern %q", host)
+	}
+
+	return nil
+}
+
+// DecodeRoute decodes a route from generic data, such as a parsed JSON
+// document, using the same keys and duration strings as the configuration
+// file. Unknown keys are rejected.
+func DecodeRoute(input any) (Route, error) {
+	var route Route
+
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:  mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused: true,
+		Result:      &route,
+	})
+	if err != nil {
+		return route, err
+	}
+
+	err = decoder.Decode(input)
+	if err != nil {
+		return route, fmt.Errorf("%w: %w", ErrInvalidConfiguration, err)
+	}
+
+	return route, nil
+}
@@ -0,0 +1,25 @@
+package config
+
+import (
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// WatchGatewayConfiguration calls onChange every time the configuration
+// file at path is written, renamed or replaced. The watch lasts for the
+// life of the process.
+func WatchGatewayConfiguration(path string, onChange func()) error {
+	v := viper.New()
+
+	err := loadGatewayConfiguration(v, path)
+	if err != nil {
+		return err
+	}
+
+	v.OnConfigChange(func(event fsnotify.Event) {
+		onChange()
+	})
+	v.WatchConfig()
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxAdminBodyBytes caps the size of route documents sent to the admin API.
+const maxAdminBodyBytes = 1 << 20
+
+// adminHandler serves the admin API. Routes are addressed by their prefix,
+// so /routes/order/v2 is the route with prefix /order/v2 of the default
+// host; routes of virtual hosts add their hosts as a comma separated hosts
+// query parameter and routes with match conditions their name as a name
+// query parameter. Every change installs a new version of the routing
+// table; responses carry the version as an ETag and writes sent with
+// If-Match are rejected with 412 when the table has changed since, or with
+// 400 when If-Match is not a version. Changes last until the next config
+// file reload.
+type adminHandler struct {
+	proxy *ProxyHandler
+}
+
+// routeList is the body of GET /routes.
+type routeList struct {
+	Version uint64         `json:"version"`
+	Routes  []config.Route `json:"routes"`
+}
+
+// routeStatus describes a route of the effective routing table.
+type routeStatus struct {
+	Name         string          `json:"name,omitempty"`
+	Hosts        []string        `json:"hosts,omitempty"`
+	Prefix       string          `json:"prefix"`
+	LoadBalancer string          `json:"loadBalancer,omitempty"`
+	Backends     []backendStatus `json:"backends"`
+}
+
+// backendStatus describes the live state of a backend.
+type backendStatus struct {
+	Url               string `json:"url"`
+	Weight            int    `json:"weight"`
+	Variant           string `json:"variant,omitempty"`
+	Healthy           bool   `json:"healthy"`
+	Ejected           bool   `json:"ejected"`
+	CircuitState      string `json:"circuitState,omitempty"`
+	ActiveConnections int64  `json:"activeConnections"`
+}
+
+// routingTableStatus is the body of GET /routing-table.
+type routingTableStatus struct {
+	Version uint64        `json:"version"`
+	Routes  []routeStatus `json:"routes"`
+}
+
+// NewAdminHandler returns the admin API of the proxy handler. It is meant
+// for a separate listener that is not exposed to API clients.
+func NewAdminHandler(proxyHandler *ProxyHandler) http.Handler {
+	admin := &adminHandler{proxy: proxyHandler}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /routes", admin.listRoutes)
+	mux.HandleFunc("POST /routes", admin.createRoute)
+	mux.HandleFunc("GET /routes/{prefix...}", admin.getRoute)
+	mux.HandleFunc("PUT /routes/{prefix...}", admin.putRoute)
+	mux.HandleFunc("DELETE /routes/{prefix...}", admin.deleteRoute)
+	mux.HandleFunc("GET /routing-table", admin.routingTable)
+
+	return mux
+}
+
+func (a *adminHandler) listRoutes(w http.ResponseWriter, r *http.Request) {
+	table := a.proxy.routes.Load()
+
+	list := routeList{Version: table.version, Routes: make([]config.Route, 0, len(table.routes))}
+	for _, key := range sortedKeys(table.routes) {
+		list.Routes = append(list.Routes, table.routes[key].routeConfig)
+	}
+
+	writeAdminJSON(w, http.StatusOK, table.version, list)
+}
+
+func (a *adminHandler) getRoute(w http.ResponseWriter, r *http.Request) {
+	table := a.proxy.routes.Load()
+
+	route, exists := table.routes[routeKey(r)]
+	if !exists {
+		a.fail(w, r, ErrRouteNotFound)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, table.version, route.routeConfig)
+}
+
+func (a *adminHandler) createRoute(w http.ResponseWriter, r *http.Request) {
+	routeConfig, err := readRoute(r)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	key := routeConfig.Key()
+	a.change(w, r, routeConfig, func(configs map[string]config.Route) (int, error) {
+		if _, exists := configs[key]; exists {
+			return 0, fmt.Errorf("%w: %v", ErrRouteExists, key)
+		}
+		configs[key] = routeConfig
+		return http.StatusCreated, nil
+	})
+}
+
+func (a *adminHandler) putRoute(w http.ResponseWriter, r *http.Request) {
+	routeConfig, err := readRoute(r)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	if routeConfig.Prefix == "" {
+		routeConfig.Prefix = routePrefix(r)
+	}
+	if routeConfig.Hosts == nil {
+		routeConfig.Hosts = routeHosts(r)
+	}
+	if routeConfig.Name == "" {
+		routeConfig.Name = r.URL.Query().Get("name")
+	}
+
+	key := routeKey(r)
+	if routeConfig.Key() != key {
+		a.fail(w, r, fmt.Errorf("%w: route %q does not match the path %q", config.ErrInvalidConfiguration, routeConfig.Key(), key))
+		return
+	}
+
+	a.change(w, r, routeConfig, func(configs map[string]config.Route) (int, error) {
+		statusCode := http.StatusOK
+		if _, exists := configs[key]; !exists {
+			statusCode = http.StatusCreated
+		}
+		configs[key] = routeConfig
+		return statusCode, nil
+	})
+}
+
+func (a *adminHandler) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	key := routeKey(r)
+
+	expected, err := expectedVersion(r)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	version, err := a.proxy.changeRoutes(expected, func(configs map[string]config.Route) error {
+		if _, exists := configs[key]; !exists {
+			return ErrRouteNotFound
+		}
+		delete(configs, key)
+		return nil
+	})
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	a.proxy.Telemetry.LogInfof("admin: deleted route %v, routing table version %d", key, version)
+	w.Header().Set("ETag", versionTag(version))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminHandler) routingTable(w http.ResponseWriter, r *http.Request) {
+	table := a.proxy.routes.Load()
+	now := time.Now()
+
+	status := routingTableStatus{Version: table.version, Routes: make([]routeStatus, 0, len(table.routes))}
+	for _, key := range sortedKeys(table.routes) {
+		route := table.routes[key]
+
+		routeState := routeStatus{
+			Name:         route.Name,
+			Hosts:        route.routeConfig.Hosts,
+			Prefix:       route.Prefix,
+			LoadBalancer: route.routeConfig.LoadBalancer,
+			Backends:     make([]backendStatus, 0, len(route.Backends)),
+		}
+
+		for _, backend := range route.Backends {
+			backendState := backendStatus{
+				Url:               backend.Url.String(),
+				Weight:            backend.Weight,
+				Healthy:           backend.Healthy(),
+				Ejected:           backend.Ejected(now),
+				ActiveConnections: backend.ActiveConnections(),
+			}
+			if backend.variant != nil {
+				backendState.Variant = backend.variant.name
+			}
+			if backend.breaker != nil {
+				backendState.CircuitState = backend.breaker.State(now).String()
+			}
+			routeState.Backends = append(routeState.Backends, backendState)
+		}
+
+		status.Routes = append(status.Routes, routeState)
+	}
+
+	writeAdminJSON(w, http.StatusOK, table.version, status)
+}
+
+// change applies a change that stores routeConfig and answers with the
+// route and the status code returned by the change.
+func (a *adminHandler) change(w http.ResponseWriter, r *http.Request, routeConfig config.Route, change func(map[string]config.Route) (int, error)) {
+	var statusCode int
+
+	expected, err := expectedVersion(r)
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	version, err := a.proxy.changeRoutes(expected, func(configs map[string]config.Route) error {
+		var err error
+		statusCode, err = change(configs)
+		return err
+	})
+	if err != nil {
+		a.fail(w, r, err)
+		return
+	}
+
+	a.proxy.Telemetry.LogInfof("admin: stored route %v, routing table version %d", routeConfig.Key(), version)
+	writeAdminJSON(w, statusCode, version, routeConfig)
+}
+
+// fail answers with a problem response for an admin API error.
+func (a *adminHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	statusCode := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, ErrRouteNotFound):
+		statusCode = http.StatusNotFound
+	case errors.Is(err, ErrRouteExists):
+		statusCode = http.StatusConflict
+	case errors.Is(err, ErrVersionConflict):
+		statusCode = http.StatusPreconditionFailed
+	case errors.Is(err, config.ErrInvalidConfiguration):
+		statusCode = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrReadRequestBody), errors.Is(err, ErrInvalidPrecondition):
+		statusCode = http.StatusBadRequest
+	}
+
+	if statusCode >= http.StatusInternalServerError {
+		a.proxy.Telemetry.LogErrorln("admin:", err)
+	}
+
+	writeProblem(w, newProblem(r, trace.SpanFromContext(r.Context()), err, statusCode))
+}
+
+// readRoute decodes a route document from the request body.
+func readRoute(r *http.Request) (config.Route, error) {
+	var document map[string]any
+
+	err := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxAdminBodyBytes)).Decode(&document)
+	if err != nil {
+		return config.Route{}, fmt.Errorf("%w: %w", ErrReadRequestBody, err)
+	}
+
+	return config.DecodeRoute(document)
+}
+
+// routePrefix returns the route prefix addressed by the request path.
+func routePrefix(r *http.Request) string {
+	return "/" + r.PathValue("prefix")
+}
+
+// routeHosts returns the hosts of the addressed route, nil for the default host.
+func routeHosts(r *http.Request) []string {
+	hosts := r.URL.Query().Get("hosts")
+	if hosts == "" {
+		return nil
+	}
+
+	return strings.Split(hosts, ",")
+}
+
+// routeKey returns the key of the route addressed by the request.
+func routeKey(r *http.Request) string {
+	return config.RouteKey(routeHosts(r), routePrefix(r), r.URL.Query().Get("name"))
+}
+
+// expectedVersion returns the routing table version sent in If-Match, or
+// nil when there is none. Anything but a version tag, such as * or a weak
+// tag, is rejected, so a write is never applied unconditionally by mistake.
+func expectedVersion(r *http.Request) (*uint64, error) {
+	values := r.Header.Values("If-Match")
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	tag := strings.Join(values, ", ")
+	version, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(tag, `"`), `"`), 10, 64)
+	if err != nil || !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) {
+		return nil, fmt.Errorf("%w: expected a routing table version such as \"3\", got %q", ErrInvalidPrecondition, tag)
+	}
+
+	return &version, nil
+}
+
+func versionTag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+func writeAdminJSON(w http.ResponseWriter, statusCode int, version uint64, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", versionTag(version))
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func sortedKeys(routes map[string]*Route) []string {
+	keys := make([]string, 0, len(routes))
+	for key := range routes {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func serveAdmin(handler http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestAdmin_RouteLifecycle(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	admin := NewAdminHandler(proxyHandler)
+
+	rr := serveAdmin(admin, http.MethodPost, "/routes", `{"name":"order","prefix":"/order","backends":[{"url":"http://order:6002"}],"healthCheck":{"interval":"1h"}}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, `"1"`, rr.Header().Get("ETag"))
+	assert.Equal(t, time.Hour, proxyHandler.Routes()["/order"].routeConfig.HealthCheck.Interval)
+
+	rr = serveAdmin(admin, http.MethodPost, "/routes", `{"prefix":"/order","backends":[{"url":"http://order:6002"}]}`)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+
+	rr = serveAdmin(admin, http.MethodPut, "/routes/order", `{"name":"order","backends":[{"url":"http://order:6002"},{"url":"http://order-2:6002"}]}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, proxyHandler.Routes()["/order"].Backends, 2)
+
+	rr = serveAdmin(admin, http.MethodGet, "/routes/order", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var routeConfig config.Route
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &routeConfig))
+	assert.Equal(t, "/order", routeConfig.Prefix)
+	assert.Len(t, routeConfig.Backends, 2)
+
+	rr = serveAdmin(admin, http.MethodGet, "/routes", "")
+	var list routeList
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+	assert.Equal(t, uint64(2), list.Version)
+	assert.Len(t, list.Routes, 1)
+
+	rr = serveAdmin(admin, http.MethodDelete, "/routes/order", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, proxyHandler.Routes())
+
+	rr = serveAdmin(admin, http.MethodDelete, "/routes/order", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, problemContentType, rr.Header().Get("Content-Type"))
+}
+
+func TestAdmin_RejectsInvalidRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/user", "http://user:6001"))
+	admin := NewAdminHandler(proxyHandler)
+	before := proxyHandler.Routes()
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		body         string
+		expectedCode int
+	}{
+		{"malformed json", http.MethodPost, "/routes", `{"prefix":`, http.StatusBadRequest},
+		{"unknown field", http.MethodPost, "/routes", `{"prefix":"/order","backend":"http://order:6002"}`, http.StatusUnprocessableEntity},
+		{"no backends", http.MethodPost, "/routes", `{"prefix":"/order"}`, http.StatusUnprocessableEntity},
+		{"prefix without slash", http.MethodPost, "/routes", `{"prefix":"order","backends":[{"url":"http://order:6002"}]}`, http.StatusUnprocessableEntity},
+		{"unknown load balancer", http.MethodPut, "/routes/user", `{"loadBalancer":"fastest","backends":[{"url":"http://user:6001"}]}`, http.StatusUnprocessableEntity},
+		{"prefix differs from path", http.MethodPut, "/routes/user", `{"prefix":"/order","backends":[{"url":"http://order:6002"}]}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range tests {
+		rr := serveAdmin(admin, tc.method, tc.target, tc.body)
+		assert.Equal(t, tc.expectedCode, rr.Code, tc.name)
+		assert.Equal(t, before, proxyHandler.Routes(), tc.name)
+	}
+}
+
+func TestAdmin_VersionConflict(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/user", "http://user:6001"))
+	admin := NewAdminHandler(proxyHandler)
+
+	etag := serveAdmin(admin, http.MethodGet, "/routes", "").Header().Get("ETag")
+
+	rr := serveAdmin(admin, http.MethodPut, "/routes/user", `{"backends":[{"url":"http://user-2:6001"}]}`, "If-Match", etag)
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// a second writer holding the same version loses
+	rr = serveAdmin(admin, http.MethodDelete, "/routes/user", "", "If-Match", etag)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+	assert.Contains(t, proxyHandler.Routes(), "/user")
+}
+
+func TestAdmin_InvalidIfMatch(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	admin := NewAdminHandler(proxyHandler)
+
+	// the empty table is at version 0, which a client may expect like any other version
+	rr := serveAdmin(admin, http.MethodPost, "/routes", `{"prefix":"/user","backends":[{"url":"http://user:6001"}]}`, "If-Match", `"0"`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr = serveAdmin(admin, http.MethodDelete, "/routes/user", "", "If-Match", `"0"`)
+	assert.Equal(t, http.StatusPreconditionFailed, rr.Code)
+
+	for _, ifMatch := range []string{"*", `W/"1"`, "1", `"one"`, `"`, ""} {
+		rr = serveAdmin(admin, http.MethodPut, "/routes/user", `{"backends":[{"url":"http://user-2:6001"}]}`, "If-Match", ifMatch)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, ifMatch)
+
+		rr = serveAdmin(admin, http.MethodDelete, "/routes/user", "", "If-Match", ifMatch)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, ifMatch)
+	}
+
+	assert.Equal(t, "http://user:6001", proxyHandler.Routes()["/user"].Backends[0].Url.String())
+}
+
+func TestAdmin_RoutingTable(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	routeConfig := newTestRouteConfig("/order", "http://order:6002", "http://order-2:6002")
+	routeConfig.CircuitBreaker = &config.CircuitBreaker{}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	route := proxyHandler.Routes()["/order"]
+	route.Backends[1].healthy.Store(false)
+
+	rr := serveAdmin(NewAdminHandler(proxyHandler), http.MethodGet, "/routing-table", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var status routingTableStatus
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Len(t, status.Routes, 1)
+	assert.Equal(t, []backendStatus{
+		{Url: "http://order:6002", Weight: 1, Healthy: true, CircuitState: "closed"},
+		{Url: "http://order-2:6002", Weight: 1, Healthy: false, CircuitState: "closed"},
+	}, status.Routes[0].Backends)
+}
+
+func TestChangeRoutes_KeepsUnchangedRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{
+		newTestRouteConfig("/user", "http://user:6001"),
+		newTestRouteConfig("/order", "http://order:6002"),
+	}))
+	user := proxyHandler.Routes()["/user"]
+
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{
+		newTestRouteConfig("/user", "http://user:6001"),
+		newTestRouteConfig("/order", "http://order-2:6002"),
+	}))
+
+	assert.Same(t, user, proxyHandler.Routes()["/user"])
+	assert.Equal(t, "http://order-2:6002", proxyHandler.Routes()["/order"].Backends[0].Url.String())
+	assert.Equal(t, uint64(2), proxyHandler.RoutingTableVersion())
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing strategies selectable per route.
+const (
+	LoadBalancerRoundRobin       = "roundRobin"
+	LoadBalancerRandom           = "random"
+	LoadBalancerLeastConnections = "leastConnections"
+	LoadBalancerWeighted         = "weighted"
+)
+
+// Balancer picks the backend that should serve the next request.
+type Balancer interface {
+	// Next returns one of the given backends, or nil if there are none.
+	Next(backends []*Backend) *Backend
+}
+
+// NewBalancer returns the balancer for the given strategy. An empty strategy defaults to round-robin.
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case "", LoadBalancerRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case LoadBalancerRandom:
+		return &randomBalancer{}, nil
+	case LoadBalancerLeastConnections:
+		return &leastConnectionsBalancer{}, nil
+	case LoadBalancerWeighted:
+		return &weightedBalancer{current: make(map[*Backend]int)}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownLoadBalancer, strategy)
+	}
+}
+
+// roundRobinBalancer cycles through the backends in order.
+type roundRobinBalancer struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Next(backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	n := b.counter.Add(1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+// randomBalancer picks a backend uniformly at random.
+type randomBalancer struct{}
+
+func (b *randomBalancer) Next(backends []*Backend) *Backend {
+	if len(backends) == 0 {
+		return nil
+	}
+
+	return backends[rand.IntN(len(backends))]
+}
+
+// leastConnectionsBalancer picks the backend with the fewest in-flight requests.
+type leastConnectionsBalancer struct{}
+
+func (b *leastConnectionsBalancer) Next(backends []*Backend) *Backend {
+	var selected *Backend
+
+	for _, backend := range backends {
+		if selected == nil || backend.ActiveConnections() < selected.ActiveConnections() {
+			selected = backend
+		}
+	}
+
+	return selected
+}
+
+// weightedBalancer implements smooth weighted round-robin, spreading
+// picks of heavier backends evenly instead of sending them in bursts.
+type weightedBalancer struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (b *weightedBalancer) Next(backends []*Backend) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var selected *Backend
+	total := 0
+
+	for _, backend := range backends {
+		b.current[backend] += backend.Weight
+		total += backend.Weight
+
+		if selected == nil || b.current[backend] > b.current[selected] {
+			selected = backend
+		}
+	}
+
+	if selected != nil {
+		b.current[selected] -= total
+	}
+
+	return selected
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBackends(t *testing.T, weights ...int) []*Backend {
+	t.Helper()
+
+	backends := make([]*Backend, 0, len(weights))
+	for i, weight := range weights {
+		target, err := url.Parse("http://backend-" + string(rune('a'+i)) + ":8000")
+		if err != nil {
+			t.Fatalf("failed to parse backend url: %v", err)
+		}
+		backends = append(backends, &Backend{Url: target, Weight: weight})
+	}
+
+	return backends
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		strategy     string
+		expected     Balancer
+		expectToFail bool
+	}{
+		{"", &roundRobinBalancer{}, false},
+		{LoadBalancerRoundRobin, &roundRobinBalancer{}, false},
+		{LoadBalancerRandom, &randomBalancer{}, false},
+		{LoadBalancerLeastConnections, &leastConnectionsBalancer{}, false},
+		{LoadBalancerWeighted, &weightedBalancer{}, false},
+		{"fastest", nil, true},
+	}
+
+	for _, tc := range tests {
+		balancer, err := NewBalancer(tc.strategy)
+
+		if tc.expectToFail {
+			assert.ErrorIs(t, err, ErrUnknownLoadBalancer)
+		} else {
+			assert.NoError(t, err)
+			assert.IsType(t, tc.expected, balancer)
+		}
+	}
+}
+
+func TestBalancers_NoBackends(t *testing.T) {
+	for _, strategy := range []string{LoadBalancerRoundRobin, LoadBalancerRandom, LoadBalancerLeastConnections, LoadBalancerWeighted} {
+		balancer, _ := NewBalancer(strategy)
+		assert.Nil(t, balancer.Next(nil), strategy)
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	backends := newTestBackends(t, 1, 1, 1)
+	balancer := &roundRobinBalancer{}
+
+	for i := 0; i < 6; i++ {
+		assert.Same(t, backends[i%3], balancer.Next(backends))
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	backends := newTestBackends(t, 1, 1)
+	balancer := &randomBalancer{}
+
+	seen := make(map[*Backend]bool)
+	for i := 0; i < 100; i++ {
+		backend := balancer.Next(backends)
+		assert.Contains(t, backends, backend)
+		seen[backend] = true
+	}
+
+	assert.Len(t, seen, 2)
+}
+
+func TestLeastConnectionsBalancer(t *testing.T) {
+	backends := newTestBackends(t, 1, 1, 1)
+	backends[0].activeConnections.Store(5)
+	backends[1].activeConnections.Store(2)
+	backends[2].activeConnections.Store(7)
+
+	balancer := &leastConnectionsBalancer{}
+	assert.Same(t, backends[1], balancer.Next(backends))
+
+	backends[1].activeConnections.Store(9)
+	assert.Same(t, backends[0], balancer.Next(backends))
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	backends := newTestBackends(t, 5, 1, 1)
+	balancer := &weightedBalancer{current: make(map[*Backend]int)}
+
+	var picks []*Backend
+	counts := make(map[*Backend]int)
+	for i := 0; i < 7; i++ {
+		backend := balancer.Next(backends)
+		picks = append(picks, backend)
+		counts[backend]++
+	}
+
+	assert.Equal(t, 5, counts[backends[0]])
+	assert.Equal(t, 1, counts[backends[1]])
+	assert.Equal(t, 1, counts[backends[2]])
+
+	// smooth weighted round-robin interleaves the lighter backends instead of bursting the heavy one
+	assert.Equal(t, []*Backend{
+		backends[0], backends[0], backends[1], backends[0], backends[2], backends[0], backends[0],
+	}, picks)
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultCircuitFailureRatio    = 0.5
+	defaultCircuitMinimumRequests = 20
+	defaultCircuitInterval        = 10 * time.Second
+	defaultCircuitOpenDuration    = 30 * time.Second
+	defaultCircuitHalfOpenProbes  = 1
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker guards a single backend. While closed it counts requests
+// and failures per interval and opens once the failure ratio is crossed.
+// While open it rejects requests until the open duration has passed, then
+// lets a limited number of probe requests through in the half-open state:
+// if they all succeed the circuit closes, a single failure opens it again.
+// Outcomes of requests let through before the last state change are ignored.
+type circuitBreaker struct {
+	config        config.CircuitBreaker
+	onStateChange func(from, to circuitState)
+
+	mu                sync.Mutex
+	state             circuitState
+	windowStart       time.Time
+	requests          int
+	failures          int
+	openedAt          time.Time
+	halfOpenInFlight  int
+	halfOpenSuccesses int
+	// generation counts the state changes, permits carry the one they were issued in
+	generation uint64
+}
+
+// circuitPermit is handed out for every request a circuit breaker lets
+// through and ties the outcome of the request to the state it was let
+// through in.
+type circuitPermit struct {
+	generation uint64
+}
+
+func newCircuitBreaker(breakerConfig config.CircuitBreaker, onStateChange func(from, to circuitState)) *circuitBreaker {
+	if breakerConfig.FailureRatio <= 0 {
+		breakerConfig.FailureRatio = defaultCircuitFailureRatio
+	}
+	if breakerConfig.MinimumRequests <= 0 {
+		breakerConfig.MinimumRequests = defaultCircuitMinimumRequests
+	}
+	if breakerConfig.Interval <= 0 {
+		breakerConfig.Interval = defaultCircuitInterval
+	}
+	if breakerConfig.OpenDuration <= 0 {
+		breakerConfig.OpenDuration = defaultCircuitOpenDuration
+	}
+	if breakerConfig.HalfOpenProbes <= 0 {
+		breakerConfig.HalfOpenProbes = defaultCircuitHalfOpenProbes
+	}
+
+	return &circuitBreaker{
+		config:        breakerConfig,
+		onStateChange: onStateChange,
+		windowStart:   time.Now(),
+	}
+}
+
+// State returns the current state, moving an expired open circuit to half-open.
+func (cb *circuitBreaker) State(now time.Time) circuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(now)
+	return cb.state
+}
+
+// available reports whether the breaker would currently let a request through.
+func (cb *circuitBreaker) available(now time.Time) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(now)
+
+	switch cb.state {
+	case circuitOpen:
+		return false
+	case circuitHalfOpen:
+		return cb.halfOpenInFlight < cb.config.HalfOpenProbes-cb.halfOpenSuccesses
+	default:
+		return true
+	}
+}
+
+// allow reserves a slot for a request. When the circuit rejects it, allow
+// returns ErrCircuitOpen and how long the caller should wait before retrying.
+// Every allowed request must be followed by a call to record or release
+// with the permit allow returned.
+func (cb *circuitBreaker) allow(now time.Time) (circuitPermit, time.Duration, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(now)
+
+	switch cb.state {
+	case circuitOpen:
+		return circuitPermit{}, cb.openedAt.Add(cb.config.OpenDuration).Sub(now), ErrCircuitOpen
+	case circuitHalfOpen:
+		if cb.halfOpenInFlight >= cb.config.HalfOpenProbes-cb.halfOpenSuccesses {
+			return circuitPermit{}, time.Second, ErrCircuitOpen
+		}
+		cb.halfOpenInFlight++
+	}
+
+	return circuitPermit{generation: cb.generation}, 0, nil
+}
+
+// retryAfter returns how long until an open circuit lets probes through.
+func (cb *circuitBreaker) retryAfter(now time.Time) time.Duration {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state != circuitOpen {
+		return 0
+	}
+
+	return cb.openedAt.Add(cb.config.OpenDuration).Sub(now)
+}
+
+// record counts the outcome of an allowed request. A request let through
+// before the state last changed, such as one sent while the circuit was
+// still closed that completes once it is half-open, is not counted.
+func (cb *circuitBreaker) record(now time.Time, permit circuitPermit, failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.advance(now)
+
+	if permit.generation != cb.generation {
+		return
+	}
+
+	switch cb.state {
+	case circuitClosed:
+		cb.requests++
+		if failed {
+			cb.failures++
+		}
+
+		if cb.requests >= cb.config.MinimumRequests &&
+			float64(cb.failures)/float64(cb.requests) >= cb.config.FailureRatio {
+			cb.open(now)
+		}
+	case circuitHalfOpen:
+		cb.halfOpenInFlight--
+
+		if failed {
+			cb.open(now)
+			return
+		}
+
+		cb.halfOpenSuccesses++
+		if cb.halfOpenSuccesses >= cb.config.HalfOpenProbes {
+			cb.setState(circuitClosed)
+			cb.resetWindow(now)
+		}
+	}
+}
+
+// release gives back the slot of an allowed request whose outcome says
+// nothing about the backend, such as one cancelled by the client.
+func (cb *circuitBreaker) release(permit circuitPermit) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if cb.state == circuitHalfOpen && permit.generation == cb.generation && cb.halfOpenInFlight > 0 {
+		cb.halfOpenInFlight--
+	}
+}
+
+// advance applies time based transitions. Must be called with mu held.
+func (cb *circuitBreaker) advance(now time.Time) {
+	switch cb.state {
+	case circuitClosed:
+		if now.Sub(cb.windowStart) >= cb.config.Interval {
+			cb.resetWindow(now)
+		}
+	case circuitOpen:
+		if now.Sub(cb.openedAt) >= cb.config.OpenDuration {
+			cb.halfOpenInFlight = 0
+			cb.halfOpenSuccesses = 0
+			cb.setState(circuitHalfOpen)
+		}
+	}
+}
+
+func (cb *circuitBreaker) open(now time.Time) {
+	cb.openedAt = now
+	cb.setState(circuitOpen)
+}
+
+func (cb *circuitBreaker) resetWindow(now time.Time) {
+	cb.windowStart = now
+	cb.requests = 0
+	cb.failures = 0
+}
+
+func (cb *circuitBreaker) setState(state circuitState) {
+	if cb.state == state {
+		return
+	}
+
+	from := cb.state
+	cb.state = state
+	cb.generation++
+
+	if cb.onStateChange != nil {
+		cb.onStateChange(from, state)
+	}
+}
+
+// newCircuitBreaker creates the breaker of a backend, logging its state
+// changes and reporting them to the circuit breaker state gauge.
+func (p *ProxyHandler) newCircuitBreaker(route *Route, backend *Backend, breakerConfig config.CircuitBreaker) *circuitBreaker {
+	attributes := metric.WithAttributes(
+		attribute.String("route", route.Prefix),
+		attribute.String("backend", backend.Url.String()),
+	)
+	p.metrics.circuitBreakerState.Record(context.Background(), int64(circuitClosed), attributes)
+
+	return newCircuitBreaker(breakerConfig, func(from, to circuitState) {
+		p.metrics.circuitBreakerState.Record(context.Background(), int64(to), attributes)
+		p.Telemetry.LogInfof("circuit breaker of backend %v on route %v changed from %v to %v", backend.Url.String(), route.Prefix, from, to)
+	})
+}
+
+// retryAfterSeconds formats a wait duration as a Retry-After header value.
+func retryAfterSeconds(retryAfter time.Duration) string {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return strconv.Itoa(seconds)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker_StateMachine(t *testing.T) {
+	var transitions []string
+	breaker := newCircuitBreaker(config.CircuitBreaker{
+		FailureRatio:    0.5,
+		MinimumRequests: 4,
+		Interval:        time.Minute,
+		OpenDuration:    10 * time.Second,
+		HalfOpenProbes:  2,
+	}, func(from, to circuitState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	})
+	now := time.Now()
+
+	// below the minimum number of requests the circuit stays closed
+	for _, failed := range []bool{true, true, false} {
+		permit, _, err := breaker.allow(now)
+		assert.NoError(t, err)
+		breaker.record(now, permit, failed)
+	}
+	assert.Equal(t, circuitClosed, breaker.State(now))
+
+	permit, _, _ := breaker.allow(now)
+	breaker.record(now, permit, false)
+	assert.Equal(t, circuitOpen, breaker.State(now), "2 of 4 requests failed")
+
+	_, retryAfter, err := breaker.allow(now.Add(4 * time.Second))
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 6*time.Second, retryAfter)
+
+	// after the open duration only the configured number of probes get through
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, circuitHalfOpen, breaker.State(now))
+	first, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+	second, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+	_, _, err = breaker.allow(now)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	breaker.record(now, first, false)
+	breaker.record(now, second, false)
+	assert.Equal(t, circuitClosed, breaker.State(now))
+
+	assert.Equal(t, []string{"closed->open", "open->half-open", "half-open->closed"}, transitions)
+}
+
+func TestCircuitBreaker_HalfOpenFailureReopens(t *testing.T) {
+	breaker := newCircuitBreaker(config.CircuitBreaker{MinimumRequests: 1, OpenDuration: time.Second}, nil)
+	now := time.Now()
+
+	permit, _, _ := breaker.allow(now)
+	breaker.record(now, permit, true)
+	assert.Equal(t, circuitOpen, breaker.State(now))
+
+	now = now.Add(time.Second)
+	permit, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+	breaker.record(now, permit, true)
+	assert.Equal(t, circuitOpen, breaker.State(now))
+}
+
+func TestCircuitBreaker_ReleaseFreesProbeSlot(t *testing.T) {
+	breaker := newCircuitBreaker(config.CircuitBreaker{MinimumRequests: 1, OpenDuration: time.Second}, nil)
+	now := time.Now()
+
+	permit, _, _ := breaker.allow(now)
+	breaker.record(now, permit, true)
+
+	now = now.Add(time.Second)
+	permit, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+	assert.False(t, breaker.available(now))
+
+	breaker.release(permit)
+	assert.True(t, breaker.available(now))
+}
+
+func TestCircuitBreaker_IgnoresRequestsFromBeforeHalfOpen(t *testing.T) {
+	breaker := newCircuitBreaker(config.CircuitBreaker{MinimumRequests: 1, OpenDuration: time.Second}, nil)
+	now := time.Now()
+
+	// a slow request is let through while the circuit is closed, then another one opens it
+	slow, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+	permit, _, _ := breaker.allow(now)
+	breaker.record(now, permit, true)
+
+	now = now.Add(time.Second)
+	probe, _, err := breaker.allow(now)
+	assert.NoError(t, err)
+
+	// the slow request completing neither frees the probe slot nor counts as a probe
+	breaker.record(now, slow, false)
+	assert.Equal(t, circuitHalfOpen, breaker.State(now))
+	assert.False(t, breaker.available(now))
+	_, _, err = breaker.allow(now)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	breaker.release(slow)
+	assert.False(t, breaker.available(now))
+
+	breaker.record(now, probe, false)
+	assert.Equal(t, circuitClosed, breaker.State(now))
+}
+
+func TestServeHTTP_CircuitOpenFailsFast(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.CircuitBreaker = &config.CircuitBreaker{
+		MinimumRequests: 2,
+		OpenDuration:    30 * time.Second,
+	}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	for i := 0; i < 2; i++ {
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/order/create", nil))
+	}
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/order/create", nil))
+
+	assert.Equal(t, 2, requests, "open circuit must not reach the backend")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "30", rr.Header().Get("Retry-After"))
+	assert.Contains(t, rr.Body.String(), ErrCircuitOpen.Error())
+}
@@ -0,0 +1,239 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// maxCompositeResponseBytes caps the response of a single composite call
+	maxCompositeResponseBytes = 10 << 20
+
+	// CompositeFailedHeader lists the keys of the calls that failed in a partial composite response.
+	CompositeFailedHeader = "X-Composite-Failed"
+)
+
+// compositeRoute answers requests by calling several backends in parallel
+// and merging their JSON responses under the keys of the calls. Unless the
+// route accepts partial responses a failed call fails the request; with
+// partial responses the key of a failed call is null.
+type compositeRoute struct {
+	calls   []compositeCall
+	partial bool
+}
+
+// compositeCall is one of the backend calls of a composite route. Its path
+// may use the {param} placeholders of the route pattern.
+type compositeCall struct {
+	key    string
+	target *url.URL
+	method string
+	// path is nil when the call uses the upstream path of the route
+	path    *pathTemplate
+	timeout time.Duration
+}
+
+func newCompositeRoute(compositeConfig config.Composite, pattern routePattern) (*compositeRoute, error) {
+	composite := &compositeRoute{
+		calls:   make([]compositeCall, 0, len(compositeConfig.Calls)),
+		partial: compositeConfig.OnError == config.CompositePartial,
+	}
+
+	for _, callConfig := range compositeConfig.Calls {
+		target, err := url.ParseRequestURI(callConfig.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		call := compositeCall{
+			key:     callConfig.Key,
+			target:  target,
+			method:  strings.ToUpper(callConfig.Method),
+			timeout: callConfig.Timeout,
+		}
+		if call.method == "" {
+			call.method = http.MethodGet
+		}
+
+		if callConfig.Path != "" {
+			call.path, err = parsePathTemplate(callConfig.Path, pattern)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		composite.calls = append(composite.calls, call)
+	}
+
+	return composite, nil
+}
+
+// compositeResult is the outcome of a single composite call.
+type compositeResult struct {
+	body json.RawMessage
+	err  error
+}
+
+// serveComposite calls the backends of a composite route in parallel and
+// answers with their merged responses. Unless the route allows partial
+// responses, the first failed call cancels the others and fails the request.
+func (p *ProxyHandler) serveComposite(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, match *routeMatch, upstreamPath string) {
+	composite := route.composite
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if p.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.RequestTimeout)
+		defer cancel()
+	}
+
+	results := make([]compositeResult, len(composite.calls))
+	var firstErr error
+	var firstErrOnce sync.Once
+	var wg sync.WaitGroup
+
+	for i, call := range composite.calls {
+		path := upstreamPath
+		if call.path != nil {
+			path = call.path.expand(match.params)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			body, err := p.callComposite(ctx, r, route, call, path)
+			results[i] = compositeResult{body: body, err: err}
+
+			if err != nil && !composite.partial {
+				firstErrOnce.Do(func() {
+					firstErr = fmt.Errorf("%w: %v: %w", ErrCompositeCall, call.key, err)
+					cancel()
+				})
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		p.Telemetry.LogErrorln(firstErr)
+		statusCode := http.StatusBadGateway
+		if errors.Is(firstErr, context.DeadlineExceeded) {
+			statusCode = http.StatusGatewayTimeout
+		}
+		p.failRequest(w, r, span, route, firstErr, statusCode)
+		return
+	}
+
+	merged := make(map[string]json.RawMessage, len(composite.calls))
+	var failed []string
+
+	for i, call := range composite.calls {
+		if results[i].err != nil {
+			p.Telemetry.LogErrorf("composite call %v of route %v failed: %v", call.key, route.Prefix, results[i].err)
+			merged[call.key] = json.RawMessage("null")
+			failed = append(failed, call.key)
+			continue
+		}
+		merged[call.key] = results[i].body
+	}
+
+	body, err := json.Marshal(merged)
+	if err != nil {
+		p.failRequest(w, r, span, route, fmt.Errorf("%w: %w", ErrCompositeCall, err), http.StatusInternalServerError)
+		return
+	}
+
+	if len(failed) > 0 {
+		w.Header().Set(CompositeFailedHeader, strings.Join(failed, ", "))
+		span.SetAttributes(attribute.StringSlice("gateway.composite.failed", failed))
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(http.StatusOK))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// callComposite sends one call of a composite route, without the request
+// body, and returns its JSON response. Error statuses, bodies that are not
+// JSON and responses larger than maxCompositeResponseBytes fail the call.
+func (p *ProxyHandler) callComposite(ctx context.Context, r *http.Request, route *Route, call compositeCall, path string) (json.RawMessage, error) {
+	if call.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, call.timeout)
+		defer cancel()
+	}
+
+	ctx, span := p.Telemetry.TraceStart(ctx, "api_gateway_composite_call", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("gateway.composite.key", call.key),
+		attribute.String("gateway.backend", call.target.String()),
+	)
+
+	fail := func(err error) (json.RawMessage, error) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	// the calls run concurrently, so each gets its own headers
+	callRequest := r.WithContext(ctx)
+	callRequest.Method = call.method
+	callRequest.Header = r.Header.Clone()
+	callRequest.Body = http.NoBody
+	callRequest.ContentLength = 0
+
+	proxyRequest, err := p.createProxyRequest(callRequest, call.target, path)
+	if err != nil {
+		return fail(err)
+	}
+
+	span.SetAttributes(clientRequestAttributes(proxyRequest, route)...)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyRequest.Header))
+
+	response, err := p.clientFor(route).Do(proxyRequest)
+	if err != nil {
+		err = upstreamError(span, err)
+		span.SetAttributes(errorTypeAttribute(0, err))
+		return fail(err)
+	}
+	defer response.Body.Close()
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+	if response.StatusCode >= http.StatusBadRequest {
+		span.SetAttributes(errorTypeAttribute(response.StatusCode, nil))
+		return fail(fmt.Errorf("backend answered %v", response.Status))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxCompositeResponseBytes+1))
+	if err != nil {
+		return fail(err)
+	}
+	if len(body) > maxCompositeResponseBytes {
+		return fail(fmt.Errorf("response is larger than %d bytes", maxCompositeResponseBytes))
+	}
+	if !json.Valid(body) {
+		return fail(errors.New("response is not JSON"))
+	}
+
+	return body, nil
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCompositeBackend(t *testing.T, status int, body string, delay time.Duration) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestServeHTTP_Composite(t *testing.T) {
+	var profilePath string
+	profile := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		profilePath = r.URL.RequestURI()
+		_, _ = w.Write([]byte(`{"name":"Ada"}`))
+	}))
+	defer profile.Close()
+
+	orders := newCompositeBackend(t, http.StatusOK, `[{"id":7}]`, 0)
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(config.Route{
+		Prefix: "/users/:id/overview",
+		Exact:  true,
+		Composite: &config.Composite{Calls: []config.CompositeCall{
+			{Key: "profile", Url: profile.URL, Path: "/profiles/{id}"},
+			{Key: "orders", Url: orders.URL, Path: "/orders?user={id}", Timeout: time.Second},
+		}},
+	}))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/users/42/overview?fields=all", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.JSONEq(t, `{"profile":{"name":"Ada"},"orders":[{"id":7}]}`, rr.Body.String())
+	assert.Equal(t, "/profiles/42?fields=all", profilePath)
+
+	request := telem.endedSpan("api_gateway_request")
+	calls := 0
+	for _, span := range telem.recorder.Ended() {
+		if span.Name() == "api_gateway_composite_call" {
+			calls++
+			assert.Equal(t, request.SpanContext().SpanID(), span.Parent().SpanID())
+		}
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestServeHTTP_CompositeErrorPolicies(t *testing.T) {
+	profile := newCompositeBackend(t, http.StatusOK, `{"name":"Ada"}`, 0)
+	failing := newCompositeBackend(t, http.StatusInternalServerError, `{}`, 0)
+	slow := newCompositeBackend(t, http.StatusOK, `[]`, time.Second)
+	plain := newCompositeBackend(t, http.StatusOK, `not json`, 0)
+
+	tests := []struct {
+		name           string
+		onError        string
+		call           config.CompositeCall
+		expectedStatus int
+		expectedBody   string
+		expectedFailed string
+	}{
+		{"failing call", config.CompositeFailAll, config.CompositeCall{Key: "orders", Url: failing.URL}, http.StatusBadGateway, "", ""},
+		{"call timeout", "", config.CompositeCall{Key: "orders", Url: slow.URL, Timeout: 20 * time.Millisecond}, http.StatusGatewayTimeout, "", ""},
+		{"not json", config.CompositeFailAll, config.CompositeCall{Key: "orders", Url: plain.URL}, http.StatusBadGateway, "", ""},
+		{"partial failing call", config.CompositePartial, config.CompositeCall{Key: "orders", Url: failing.URL}, http.StatusOK, `{"profile":{"name":"Ada"},"orders":null}`, "orders"},
+		{"partial call timeout", config.CompositePartial, config.CompositeCall{Key: "orders", Url: slow.URL, Timeout: 20 * time.Millisecond}, http.StatusOK, `{"profile":{"name":"Ada"},"orders":null}`, "orders"},
+	}
+
+	for _, tc := range tests {
+		proxyHandler := newTestProxyHandler(t, 5*time.Second)
+		assert.NoError(t, proxyHandler.AddRoute(config.Route{
+			Prefix: "/overview",
+			Composite: &config.Composite{OnError: tc.onError, Calls: []config.CompositeCall{
+				{Key: "profile", Url: profile.URL},
+				tc.call,
+			}},
+		}), tc.name)
+
+		start := time.Now()
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/overview", nil))
+		assert.Less(t, time.Since(start), 500*time.Millisecond, tc.name)
+		assert.Equal(t, tc.expectedStatus, rr.Code, tc.name)
+		assert.Equal(t, tc.expectedFailed, rr.Header().Get(CompositeFailedHeader), tc.name)
+
+		if tc.expectedBody != "" {
+			assert.JSONEq(t, tc.expectedBody, rr.Body.String(), tc.name)
+			continue
+		}
+
+		var problem Problem
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem), tc.name)
+		assert.Equal(t, problemTypePrefix+"composite-call", problem.Type, tc.name)
+	}
+}
+
+func TestReplaceRoutes_InvalidComposites(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	call := config.CompositeCall{Key: "profile", Url: "http://user:6001"}
+
+	tests := []struct {
+		name  string
+		route config.Route
+	}{
+		{"no calls", config.Route{Prefix: "/overview", Composite: &config.Composite{}}},
+		{"duplicate keys", config.Route{Prefix: "/overview", Composite: &config.Composite{Calls: []config.CompositeCall{call, call}}}},
+		{"missing key", config.Route{Prefix: "/overview", Composite: &config.Composite{Calls: []config.CompositeCall{{Url: "http://user:6001"}}}}},
+		{"unknown error policy", config.Route{Prefix: "/overview", Composite: &config.Composite{OnError: "ignore", Calls: []config.CompositeCall{call}}}},
+		{"backends", config.Route{Prefix: "/overview", Backends: []config.Backend{{Url: "http://user:6001"}}, Composite: &config.Composite{Calls: []config.CompositeCall{call}}}},
+		{"unknown parameter", config.Route{Prefix: "/overview", Composite: &config.Composite{Calls: []config.CompositeCall{{Key: "profile", Url: "http://user:6001", Path: "/{id}"}}}}},
+	}
+
+	for _, tc := range tests {
+		err := proxyHandler.ReplaceRoutes([]config.Route{tc.route})
+		assert.ErrorIs(t, err, config.ErrInvalidConfiguration, tc.name)
+	}
+}
@@ -3,8 +3,37 @@ package proxy
 import "errors"
 
 var (
-	ErrServiceNotFound    = errors.New("service not found")
-	ErrCreateProxyRequest = errors.New("failed to create proxy request")
-	ErrBackendResponse    = errors.New("something went wrong in backend service")
-	ErrRouteNotExist      = errors.New("route not exists")
+	ErrServiceNotFound      = errors.New("service not found")
+	ErrCreateProxyRequest   = errors.New("failed to create proxy request")
+	ErrBackendResponse      = errors.New("something went wrong in backend service")
+	ErrNoBackends           = errors.New("route has no backends")
+	ErrUnknownLoadBalancer  = errors.New("unknown load balancer")
+	ErrNoHealthyBackend     = errors.New("no healthy backend available")
+	ErrCircuitOpen          = errors.New("circuit breaker is open")
+	ErrReadRequestBody      = errors.New("failed to read request body")
+	ErrInvalidErrorTemplate = errors.New("invalid error template")
+	ErrRouteNotFound        = errors.New("route not found")
+	ErrRouteExists          = errors.New("route already exists")
+	ErrVersionConflict      = errors.New("routing table version conflict")
+	ErrInvalidPrecondition  = errors.New("invalid If-Match header")
+	ErrInvalidRoutePattern  = errors.New("invalid route pattern")
+	ErrRouteConflict        = errors.New("conflicting routes")
+	ErrInvalidRewrite       = errors.New("invalid path rewrite")
+	ErrInvalidPredicate     = errors.New("invalid route match condition")
+	ErrMethodNotAllowed     = errors.New("method not allowed")
+	ErrCompositeCall        = errors.New("composite call failed")
+	ErrStreamIdle           = errors.New("stream idle timeout")
+	ErrInvalidTranscoding   = errors.New("invalid gRPC transcoding")
+	ErrNoGrpcBinding        = errors.New("no gRPC method is bound to this path")
+	ErrTranscodeRequest     = errors.New("failed to transcode request")
+	ErrTranscodeResponse    = errors.New("failed to transcode response")
+	ErrLoadCertificate      = errors.New("failed to load certificate")
+	ErrInvalidTLSPolicy     = errors.New("invalid TLS policy")
+	ErrInvalidUpstreamTLS   = errors.New("invalid upstream TLS settings")
+	// upstream TLS handshake failures, see upstreamTLSError
+	ErrUpstreamUnknownAuthority   = errors.New("upstream certificate is signed by an unknown authority")
+	ErrUpstreamHostnameMismatch   = errors.New("upstream certificate is not valid for the server name")
+	ErrUpstreamInvalidCertificate = errors.New("upstream certificate is invalid")
+	ErrUpstreamHandshakeRejected  = errors.New("upstream rejected the TLS handshake")
+	ErrUpstreamHandshake          = errors.New("upstream TLS handshake failed")
 )
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// circuitOpenError is returned when the circuit breakers of a route reject a request.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string { return ErrCircuitOpen.Error() }
+
+func (e *circuitOpenError) Unwrap() error { return ErrCircuitOpen }
+
+// attemptResult is a backend response that is being relayed to the client.
+type attemptResult struct {
+	response *http.Response
+	backend  *Backend
+	span     trace.Span
+	attempt  int
+	// cancel releases the context of a hedged attempt, if any
+	cancel context.CancelFunc
+
+	// timeout cancels the attempt when the request timeout expires, it is nil without a request timeout
+	timeout       *time.Timer
+	cancelAttempt context.CancelCauseFunc
+}
+
+// close releases the response and ends the attempt span.
+func (a *attemptResult) close() {
+	a.response.Body.Close()
+	a.backend.activeConnections.Add(-1)
+	a.span.End()
+
+	if a.timeout != nil {
+		a.timeout.Stop()
+	}
+	if a.cancelAttempt != nil {
+		a.cancelAttempt(nil)
+	}
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// stopTimeout exempts the rest of the attempt from the request timeout.
+// It returns false when the timeout has already expired.
+func (a *attemptResult) stopTimeout() bool {
+	return a.timeout == nil || a.timeout.Stop()
+}
+
+// discard drains and releases the response of an attempt that is being retried.
+func (a *attemptResult) discard() {
+	_, _ = io.Copy(io.Discard, io.LimitReader(a.response.Body, 4<<10))
+	a.close()
+}
+
+// forward sends the request to the route's backends, retrying failed
+// attempts as allowed by the route's retry policy and the retry budget.
+// On split routes attempts stay within the chosen variant.
+func (p *ProxyHandler) forward(ctx context.Context, r *http.Request, route *Route, variant *splitVariant, upstreamPath string) (result *attemptResult, err error) {
+	p.retryBudget.Load().recordRequest(time.Now())
+
+	maxAttempts := route.retryPolicy.maxAttempts(r.Method)
+
+	body := &requestBody{rest: r.Body}
+	if r.Body == nil {
+		body = &requestBody{replayable: true}
+	}
+	hedging := route.hedgingPolicy.appliesTo(r.Method)
+	mirroring := route.mirror.sample()
+
+	if maxAttempts > 1 || hedging || mirroring {
+		maxBodyBytes := route.retryPolicy.maxBodyBytes()
+		if mirroring {
+			maxBodyBytes = max(maxBodyBytes, route.mirror.config.MaxBodyBytes)
+		}
+
+		body, err = bufferRequestBody(r, maxBodyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrReadRequestBody, err)
+		}
+		if !body.replayable || int64(len(body.buffered)) > route.retryPolicy.maxBodyBytes() {
+			maxAttempts = 1
+			hedging = false
+		}
+		if mirroring && (!body.replayable || int64(len(body.buffered)) > route.mirror.config.MaxBodyBytes) {
+			mirroring = false
+		}
+	}
+
+	if mirroring {
+		if comparison := p.mirror(ctx, r, route, upstreamPath, body); comparison != nil {
+			// the mirror compares its response with the one relayed to the client
+			defer func() {
+				if result == nil {
+					comparison.abandon()
+					return
+				}
+				comparison.capture(result.response, route.mirror.comparer.config.MaxBodyBytes)
+			}()
+		}
+	}
+
+	var tried []*Backend
+
+	for attempt := 1; ; attempt++ {
+		backend, permit, pickErr := p.pickBackend(route, variant, tried)
+		if pickErr != nil {
+			if attempt == 1 {
+				return nil, pickErr
+			}
+			return result, err
+		}
+
+		if result != nil {
+			result.discard()
+		}
+
+		tried = append(tried, backend)
+		if hedging {
+			result, err = p.hedge(ctx, r, route, variant, upstreamPath, backend, permit, body, attempt, &tried)
+		} else {
+			result, err = p.attempt(ctx, r, route, upstreamPath, backend, permit, body, attempt, false)
+		}
+
+		if attempt >= maxAttempts || r.Context().Err() != nil || !p.shouldRetry(route, result, err) {
+			return result, err
+		}
+
+		if !p.retryBudget.Load().withdraw(time.Now()) {
+			p.Telemetry.LogErrorf("retry budget exhausted, not retrying %v %v", r.Method, r.URL.Path)
+			trace.SpanFromContext(ctx).AddEvent("retry_budget_exhausted")
+			return result, err
+		}
+
+		if sleepErr := sleepContext(ctx, route.retryPolicy.backoff(attempt)); sleepErr != nil {
+			return result, err
+		}
+	}
+}
+
+// shouldRetry reports whether the outcome of an attempt is retryable under the route's policy.
+func (p *ProxyHandler) shouldRetry(route *Route, result *attemptResult, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrCreateProxyRequest) && route.retryPolicy.retryableError(err)
+	}
+
+	return route.retryPolicy.retryableStatus(result.response.StatusCode)
+}
+
+// pickBackend chooses the backend for the next attempt, preferring backends
+// that have not been tried yet, and reserves a slot in its circuit breaker.
+// The outcome of the request must be recorded with the returned permit.
+// With a variant it picks among the backends of the variant, unless none
+// of them is available, in which case the other variants take over.
+func (p *ProxyHandler) pickBackend(route *Route, variant *splitVariant, tried []*Backend) (*Backend, circuitPermit, error) {
+	now := time.Now()
+	available := route.availableBackends()
+
+	if variant != nil {
+		inVariant := slices.DeleteFunc(slices.Clone(available), func(backend *Backend) bool {
+			return backend.variant != variant
+		})
+		if len(inVariant) > 0 {
+			available = inVariant
+		}
+	}
+
+	candidates := slices.DeleteFunc(slices.Clone(available), func(backend *Backend) bool {
+		return slices.Contains(tried, backend)
+	})
+	if len(candidates) == 0 {
+		candidates = available
+	}
+
+	backend := route.Balancer.Next(candidates)
+	if backend == nil {
+		if retryAfter, open := route.circuitRetryAfter(now); open {
+			return nil, circuitPermit{}, &circuitOpenError{retryAfter: retryAfter}
+		}
+		return nil, circuitPermit{}, ErrNoHealthyBackend
+	}
+
+	var permit circuitPermit
+	if backend.breaker != nil {
+		var retryAfter time.Duration
+		var err error
+		if permit, retryAfter, err = backend.breaker.allow(now); err != nil {
+			return nil, circuitPermit{}, &circuitOpenError{retryAfter: retryAfter}
+		}
+	}
+
+	return backend, permit, nil
+}
+
+// attempt sends one copy of the request to a backend under its own client
+// span. Hedged copies of a request are tagged on their span.
+func (p *ProxyHandler) attempt(ctx context.Context, r *http.Request, route *Route, upstreamPath string, backend *Backend, permit circuitPermit, body *requestBody, attempt int, hedged bool) (*attemptResult, error) {
+	// unlike a client timeout, the request timeout can be stopped once a response turns out to be a stream
+	attemptCtx, cancelAttempt := context.WithCancelCause(ctx)
+	var timeout *time.Timer
+	if p.RequestTimeout > 0 {
+		timeout = time.AfterFunc(p.RequestTimeout, func() { cancelAttempt(context.DeadlineExceeded) })
+	}
+	release := func() {
+		if timeout != nil {
+			timeout.Stop()
+		}
+		cancelAttempt(nil)
+	}
+
+	attemptCtx, span := p.Telemetry.TraceStart(attemptCtx, "api_gateway_attempt", trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(
+		attribute.Int("gateway.attempt", attempt),
+		attribute.String("gateway.backend", backend.Url.String()),
+		attribute.Bool("gateway.hedged", hedged),
+	)
+	if attempt > 1 {
+		span.SetAttributes(semconv.HTTPRequestResendCount(attempt - 1))
+	}
+
+	// copies of a request may be in flight concurrently, so each gets its own headers
+	attemptRequest := r.WithContext(attemptCtx)
+	attemptRequest.Header = r.Header.Clone()
+	attemptRequest.Body = body.reader()
+
+	proxyRequest, err := p.createProxyRequest(attemptRequest, backend.Url, upstreamPath)
+	if err != nil {
+		route.recordOutcome(ctx, backend, permit, outcomeCancelled)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		release()
+		return nil, fmt.Errorf("%w: %w", ErrCreateProxyRequest, err)
+	}
+
+	span.SetAttributes(clientRequestAttributes(proxyRequest, route)...)
+	if route.grpc {
+		span.SetAttributes(grpcMethodAttributes(proxyRequest.URL.Path)...)
+		// gRPC backends refuse calls of clients that do not announce trailer support
+		proxyRequest.Header.Set("Te", "trailers")
+	}
+
+	//  inject trace context into outbound request headers
+	otel.GetTextMapPropagator().Inject(attemptCtx, propagation.HeaderCarrier(proxyRequest.Header))
+
+	backend.activeConnections.Add(1)
+
+	proxyResponse, err := p.clientFor(route).Do(proxyRequest)
+	if err != nil {
+		backend.activeConnections.Add(-1)
+		err = upstreamError(span, err)
+
+		if ctx.Err() != nil {
+			route.recordOutcome(ctx, backend, permit, outcomeCancelled)
+		} else {
+			route.recordOutcome(ctx, backend, permit, outcomeFailure)
+		}
+
+		span.RecordError(err)
+		span.SetAttributes(errorTypeAttribute(0, err))
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		release()
+		return nil, err
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(proxyResponse.StatusCode))
+
+	// for client spans every error status is a failure
+	if proxyResponse.StatusCode >= http.StatusBadRequest {
+		span.SetAttributes(errorTypeAttribute(proxyResponse.StatusCode, nil))
+		span.SetStatus(codes.Error, proxyResponse.Status)
+	}
+
+	if proxyResponse.StatusCode >= http.StatusInternalServerError {
+		route.recordOutcome(ctx, backend, permit, outcomeFailure)
+	} else {
+		route.recordOutcome(ctx, backend, permit, outcomeSuccess)
+	}
+
+	return &attemptResult{
+		response: proxyResponse,
+		backend:  backend,
+		span:     span,
+		attempt:  attempt,
+
+		timeout:       timeout,
+		cancelAttempt: cancelAttempt,
+	}, nil
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                 = 0
+	grpcCanceled           = 1
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcAlreadyExists      = 6
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcAborted            = 10
+	grpcOutOfRange         = 11
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcDataLoss           = 15
+	grpcUnauthenticated    = 16
+)
+
+// grpcServerErrors are the status codes that fail the span of the gateway,
+// as the RPC semantic conventions have it for servers.
+var grpcServerErrors = map[int]bool{
+	grpcUnknown:          true,
+	grpcDeadlineExceeded: true,
+	grpcUnimplemented:    true,
+	grpcInternal:         true,
+	grpcUnavailable:      true,
+	grpcDataLoss:         true,
+}
+
+// newGrpcTransport returns a transport that talks HTTP/2 only: with prior
+// knowledge (h2c) to http:// backends and negotiated over TLS to https:// backends.
+func newGrpcTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+
+	return transport
+}
+
+// clientFor returns the client that sends the requests of a route to its
+// backends, which is the route's own client when it has upstream TLS settings.
+func (p *ProxyHandler) clientFor(route *Route) *http.Client {
+	if route.client != nil {
+		return route.client
+	}
+	if route.grpc {
+		return p.GrpcClient
+	}
+
+	return p.Client
+}
+
+// isGrpcRequest reports whether the request is a gRPC call.
+func isGrpcRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") || strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// grpcMethodAttributes describes a call to /package.Service/Method following
+// the RPC semantic conventions. Paths of another shape only get rpc.system.
+func grpcMethodAttributes(path string) []attribute.KeyValue {
+	attributes := []attribute.KeyValue{semconv.RPCSystemGRPC}
+
+	service, method, found := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if found && service != "" && method != "" && !strings.Contains(method, "/") {
+		attributes = append(attributes, semconv.RPCService(service), semconv.RPCMethod(method))
+	}
+
+	return attributes
+}
+
+// grpcStatus returns the grpc-status of a response, which is a trailer
+// unless the backend answered with headers only.
+func grpcStatus(response *http.Response) (int, bool) {
+	value := response.Trailer.Get("Grpc-Status")
+	if value == "" {
+		value = response.Header.Get("Grpc-Status")
+	}
+	if value == "" {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil {
+		return grpcUnknown, true
+	}
+
+	return code, true
+}
+
+// recordGrpcStatus records the grpc-status of a relayed response on the
+// span of the gateway and on the span of the attempt. Every status but OK
+// fails the attempt, only server errors fail the gateway span.
+func recordGrpcStatus(span, attemptSpan trace.Span, response *http.Response) {
+	code, ok := grpcStatus(response)
+	if !ok {
+		return
+	}
+
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(code))
+	attemptSpan.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(code))
+	if code == grpcOK {
+		return
+	}
+
+	message := response.Trailer.Get("Grpc-Message")
+	if message == "" {
+		message = response.Header.Get("Grpc-Message")
+	}
+	attemptSpan.SetStatus(codes.Error, message)
+	if grpcServerErrors[code] {
+		span.SetStatus(codes.Error, message)
+	}
+}
+
+// grpcCodeForStatus maps the status of a gateway generated error to a gRPC
+// status code. It starts from the mapping gRPC clients apply to HTTP
+// statuses, but since the gateway knows what a status stands for, it
+// reports rate limiting (429) as RESOURCE_EXHAUSTED, request timeouts (504)
+// as DEADLINE_EXCEEDED and methods a route does not allow (405) as
+// UNIMPLEMENTED, where a client would see UNAVAILABLE or UNKNOWN.
+func grpcCodeForStatus(statusCode int) int {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusMethodNotAllowed:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	default:
+		return grpcUnknown
+	}
+}
+
+// writeGrpcError answers a gRPC call with a trailers-only response carrying
+// the status code and message, as gRPC clients do not read error bodies.
+func writeGrpcError(w http.ResponseWriter, code int, message string) {
+	header := w.Header()
+	header.Set("Content-Type", "application/grpc")
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	header.Set("Grpc-Message", encodeGrpcMessage(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGrpcMessage percent-encodes a grpc-message, leaving printable ASCII other than % as is.
+func encodeGrpcMessage(message string) string {
+	var encoded strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			encoded.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&encoded, "%%%02X", c)
+	}
+
+	return encoded.String()
+}
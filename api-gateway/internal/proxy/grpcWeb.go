@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+
+	// grpcWebTrailerFlag marks the frame that carries the trailers at the end of a gRPC-Web response
+	grpcWebTrailerFlag = 0x80
+)
+
+// isGrpcWebRequest reports whether the request is a gRPC-Web call, binary or base64 encoded.
+func isGrpcWebRequest(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	for _, prefix := range []string{grpcWebContentType, grpcWebTextContentType} {
+		if contentType == prefix || strings.HasPrefix(contentType, prefix+"+") || strings.HasPrefix(contentType, prefix+";") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// translateGrpcWeb turns a gRPC-Web call into a native gRPC call and wraps
+// w to turn the gRPC response back into a gRPC-Web response. The returned
+// writer must be finished once the response has been relayed, which writes
+// the trailers as the last frame of the body.
+func translateGrpcWeb(w http.ResponseWriter, r *http.Request) (*grpcWebResponseWriter, *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	grpcRequest := r.Clone(r.Context())
+	// browsers send gRPC-Web over HTTP/1.1, whose connection headers HTTP/2 does not allow
+	removeHopByHopHeaders(grpcRequest.Header)
+	grpcRequest.Header.Set("Content-Type", "application/grpc"+grpcWebSubtype(contentType))
+	grpcRequest.Header.Del("Content-Length")
+	grpcRequest.Header.Del("X-Grpc-Web")
+	if text {
+		grpcRequest.Body = io.NopCloser(&base64ChunkReader{reader: bufio.NewReader(r.Body)})
+		grpcRequest.ContentLength = -1
+	}
+
+	writer := &grpcWebResponseWriter{
+		ResponseWriter: w,
+		contentType:    contentType,
+		text:           text,
+	}
+
+	return writer, grpcRequest
+}
+
+// grpcWebSubtype returns the +proto or +json suffix of a gRPC-Web content type, if any.
+func grpcWebSubtype(contentType string) string {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	if _, subtype, found := strings.Cut(contentType, "+"); found {
+		return "+" + subtype
+	}
+
+	return ""
+}
+
+// grpcWebResponseWriter relays a gRPC response as a gRPC-Web response. The
+// body passes through, base64 encoded for text clients, and the trailers
+// set with http.TrailerPrefix are written as a trailer frame by finish.
+type grpcWebResponseWriter struct {
+	http.ResponseWriter
+	contentType   string
+	text          bool
+	headerWritten bool
+}
+
+func (g *grpcWebResponseWriter) WriteHeader(statusCode int) {
+	if g.headerWritten {
+		return
+	}
+	g.headerWritten = true
+
+	header := g.Header()
+	if header.Get("Content-Type") != "" {
+		header.Set("Content-Type", g.contentType)
+	}
+	header.Del("Content-Length")
+	header.Del("Trailer")
+	g.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (g *grpcWebResponseWriter) Write(b []byte) (int, error) {
+	if !g.headerWritten {
+		g.WriteHeader(http.StatusOK)
+	}
+
+	if !g.text {
+		return g.ResponseWriter.Write(b)
+	}
+
+	// every write is encoded on its own, padding included, which gRPC-Web text clients decode chunk by chunk
+	if _, err := g.ResponseWriter.Write([]byte(base64.StdEncoding.EncodeToString(b))); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (g *grpcWebResponseWriter) Flush() {
+	_ = http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *grpcWebResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// finish writes the trailers of the response as the trailer frame. Responses
+// that carry their status in the headers, such as gateway errors, get none.
+func (g *grpcWebResponseWriter) finish() {
+	header := g.Header()
+
+	var keys []string
+	for key := range header {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	var trailer bytes.Buffer
+	for _, key := range keys {
+		name := strings.ToLower(strings.TrimPrefix(key, http.TrailerPrefix))
+		for _, value := range header[key] {
+			trailer.WriteString(name + ": " + value + "\r\n")
+		}
+		// the trailers go into the body, not into HTTP trailers
+		header.Del(key)
+	}
+
+	if len(keys) == 0 {
+		return
+	}
+
+	frame := make([]byte, 5, 5+trailer.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(trailer.Len()))
+	_, _ = g.Write(append(frame, trailer.Bytes()...))
+}
+
+// base64ChunkReader decodes a base64 stream that may be made of separately
+// padded chunks, as gRPC-Web text clients send it.
+type base64ChunkReader struct {
+	reader  *bufio.Reader
+	decoded []byte
+	err     error
+}
+
+func (b *base64ChunkReader) Read(p []byte) (int, error) {
+	for len(b.decoded) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.decodeQuantum()
+	}
+
+	n := copy(p, b.decoded)
+	b.decoded = b.decoded[n:]
+	return n, nil
+}
+
+// decodeQuantum decodes the next four base64 characters, skipping whitespace.
+func (b *base64ChunkReader) decodeQuantum() {
+	quantum := make([]byte, 0, 4)
+	for len(quantum) < 4 {
+		c, err := b.reader.ReadByte()
+		if err != nil {
+			if len(quantum) > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			b.err = err
+			return
+		}
+		if c == '\r' || c == '\n' || c == ' ' || c == '\t' {
+			continue
+		}
+		quantum = append(quantum, c)
+	}
+
+	decoded := make([]byte, 3)
+	n, err := base64.StdEncoding.Decode(decoded, quantum)
+	if err != nil {
+		b.err = err
+		return
+	}
+	b.decoded = decoded[:n]
+}
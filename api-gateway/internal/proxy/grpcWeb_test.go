@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newGrpcWebBackend answers every call with one message and OK in the trailers.
+func newGrpcWebBackend(t *testing.T) *httptest.Server {
+	return newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, "application/grpc+proto", r.Header.Get("Content-Type"))
+		assert.Empty(t, r.Header.Get("X-Grpc-Web"))
+
+		request, err := readGrpcFrame(r.Body)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/grpc+proto")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		_, _ = w.Write(grpcFrame("user " + request))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+	}))
+}
+
+// grpcWebTrailerFrame builds the frame a gRPC-Web response ends with.
+func grpcWebTrailerFrame(trailer string) []byte {
+	frame := grpcFrame(trailer)
+	frame[0] = grpcWebTrailerFlag
+	return frame
+}
+
+func TestServeHTTP_GrpcWeb(t *testing.T) {
+	backend := newGrpcWebBackend(t)
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/user.v1.UserService", backend.URL)))
+
+	// browsers talk HTTP/1.1 to the gateway
+	gateway := httptest.NewServer(proxyHandler)
+	t.Cleanup(gateway.Close)
+
+	request, err := http.NewRequest(http.MethodPost, gateway.URL+"/user.v1.UserService/GetUser", bytes.NewReader(grpcFrame("42")))
+	assert.NoError(t, err)
+	request.Header.Set("Content-Type", "application/grpc-web+proto")
+	request.Header.Set("X-Grpc-Web", "1")
+
+	response, err := http.DefaultClient.Do(request)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "application/grpc-web+proto", response.Header.Get("Content-Type"))
+
+	body, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	expected := append(grpcFrame("user 42"), grpcWebTrailerFrame("grpc-message: \r\ngrpc-status: 0\r\n")...)
+	assert.Equal(t, expected, body)
+	assert.Empty(t, response.Trailer)
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_request") != nil }, time.Second, 10*time.Millisecond)
+	attributes := spanAttributeMap(telem.endedSpan("api_gateway_request"))
+	assert.True(t, attributes["gateway.grpc_web"].AsBool())
+	assert.Equal(t, "GetUser", attributes["rpc.method"].AsString())
+	assert.Equal(t, int64(0), attributes["rpc.grpc.status_code"].AsInt64())
+}
+
+func TestServeHTTP_GrpcWebText(t *testing.T) {
+	backend := newGrpcWebBackend(t)
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/user.v1.UserService", backend.URL)))
+
+	// text clients may pad every chunk they send
+	requestBody := base64.StdEncoding.EncodeToString(grpcFrame("4")[:3]) + base64.StdEncoding.EncodeToString(grpcFrame("4")[3:])
+	request := httptest.NewRequest(http.MethodPost, "/user.v1.UserService/GetUser", bytes.NewBufferString(requestBody))
+	request.Header.Set("Content-Type", "application/grpc-web-text+proto")
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, request)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/grpc-web-text+proto", rr.Header().Get("Content-Type"))
+
+	body, err := io.ReadAll(&base64ChunkReader{reader: bufio.NewReader(rr.Body)})
+	assert.NoError(t, err)
+	expected := append(grpcFrame("user 4"), grpcWebTrailerFrame("grpc-message: \r\ngrpc-status: 0\r\n")...)
+	assert.Equal(t, expected, body)
+}
+
+func TestServeHTTP_GrpcWebGatewayError(t *testing.T) {
+	backend := newH2CServer(t, http.NotFoundHandler())
+	backendUrl := backend.URL
+	backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/user.v1.UserService", backendUrl)))
+
+	request := httptest.NewRequest(http.MethodPost, "/user.v1.UserService/GetUser", bytes.NewReader(grpcFrame("42")))
+	request.Header.Set("Content-Type", "application/grpc-web+proto")
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, request)
+
+	// gateway errors carry their status in the headers, without a trailer frame
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/grpc-web+proto", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "14", rr.Header().Get("Grpc-Status"))
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestIsGrpcWebRequest(t *testing.T) {
+	for contentType, expected := range map[string]bool{
+		"application/grpc-web":            true,
+		"application/grpc-web+proto":      true,
+		"application/grpc-web-text":       true,
+		"application/grpc-web-text+proto": true,
+		"application/grpc":                false,
+		"application/grpc-webby":          false,
+		"application/json":                false,
+	} {
+		request := httptest.NewRequest(http.MethodPost, "/", nil)
+		request.Header.Set("Content-Type", contentType)
+		assert.Equal(t, expected, isGrpcWebRequest(request), contentType)
+	}
+}
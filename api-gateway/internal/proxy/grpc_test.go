@@ -0,0 +1,225 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// h2cProtocols allows HTTP/2 without TLS only.
+func h2cProtocols() *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
+
+// newH2CServer starts a server that takes HTTP/2 without TLS, as gRPC servers do.
+func newH2CServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = h2cProtocols()
+	server.Start()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// newH2CClient returns a client that talks HTTP/2 without TLS by prior knowledge.
+func newH2CClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{Protocols: h2cProtocols()}}
+}
+
+// grpcFrame prefixes a message with the gRPC length-prefixed message header.
+func grpcFrame(message string) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	return append(frame, message...)
+}
+
+// readGrpcFrame reads one length-prefixed message.
+func readGrpcFrame(r io.Reader) (string, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	message := make([]byte, binary.BigEndian.Uint32(header[1:]))
+	_, err := io.ReadFull(r, message)
+	return string(message), err
+}
+
+func newTestGrpcRoute(prefix string, backendUrl string) config.Route {
+	routeConfig := newTestRouteConfig(prefix, backendUrl)
+	routeConfig.Protocol = config.ProtocolGrpc
+	return routeConfig
+}
+
+func newGrpcRequest(t *testing.T, url string, body io.Reader) *http.Request {
+	t.Helper()
+
+	request, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/grpc")
+	request.Header.Set("Te", "trailers")
+
+	return request
+}
+
+func TestServeHTTP_Grpc(t *testing.T) {
+	backend := newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		assert.Equal(t, "/user.v1.UserService/GetUser", r.URL.Path)
+		assert.Equal(t, "trailers", r.Header.Get("Te"))
+
+		request, err := readGrpcFrame(r.Body)
+		assert.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, X-Served-By")
+		_, _ = w.Write(grpcFrame("user " + request))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "")
+		w.Header().Set("X-Served-By", "user-1")
+	}))
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/user.v1.UserService", backend.URL)))
+
+	gateway := newH2CServer(t, proxyHandler)
+
+	response, err := newH2CClient().Do(newGrpcRequest(t, gateway.URL+"/user.v1.UserService/GetUser", bytes.NewReader(grpcFrame("42"))))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	assert.Equal(t, 2, response.ProtoMajor)
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	message, err := readGrpcFrame(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "user 42", message)
+
+	_, _ = io.Copy(io.Discard, response.Body)
+	assert.Equal(t, "0", response.Trailer.Get("Grpc-Status"))
+	assert.Equal(t, "user-1", response.Trailer.Get("X-Served-By"))
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_request") != nil }, time.Second, 10*time.Millisecond)
+	attributes := spanAttributeMap(telem.endedSpan("api_gateway_request"))
+	assert.Equal(t, "grpc", attributes["rpc.system"].AsString())
+	assert.Equal(t, "user.v1.UserService", attributes["rpc.service"].AsString())
+	assert.Equal(t, "GetUser", attributes["rpc.method"].AsString())
+	assert.Equal(t, int64(0), attributes["rpc.grpc.status_code"].AsInt64())
+
+	attemptAttributes := spanAttributeMap(telem.endedSpan("api_gateway_attempt"))
+	assert.Equal(t, "GetUser", attemptAttributes["rpc.method"].AsString())
+}
+
+func TestServeHTTP_GrpcErrorStatus(t *testing.T) {
+	backend := newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a trailers-only response carries the status in its headers
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+		w.Header().Set("Grpc-Message", "database down")
+	}))
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/order.v1.OrderService", backend.URL)))
+
+	gateway := newH2CServer(t, proxyHandler)
+
+	response, err := newH2CClient().Do(newGrpcRequest(t, gateway.URL+"/order.v1.OrderService/ListOrders", bytes.NewReader(grpcFrame(""))))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	assert.Equal(t, "14", response.Header.Get("Grpc-Status"))
+	assert.Equal(t, "database down", response.Header.Get("Grpc-Message"))
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_request") != nil }, time.Second, 10*time.Millisecond)
+	span := telem.endedSpan("api_gateway_request")
+	assert.Equal(t, int64(14), spanAttributeMap(span)["rpc.grpc.status_code"].AsInt64())
+	assert.Equal(t, codes.Error, span.Status().Code)
+	assert.Equal(t, codes.Error, telem.endedSpan("api_gateway_attempt").Status().Code)
+}
+
+func TestServeHTTP_GrpcBidirectionalStream(t *testing.T) {
+	backend := newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		for {
+			message, err := readGrpcFrame(r.Body)
+			if err != nil {
+				break
+			}
+			_, _ = w.Write(grpcFrame("echo " + message))
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestGrpcRoute("/chat.v1.ChatService", backend.URL)))
+
+	gateway := newH2CServer(t, proxyHandler)
+
+	requestBody, requestWriter := io.Pipe()
+	response, err := newH2CClient().Do(newGrpcRequest(t, gateway.URL+"/chat.v1.ChatService/Chat", requestBody))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	// every message is answered before the next one is sent
+	for _, message := range []string{"hello", "world"} {
+		_, err := requestWriter.Write(grpcFrame(message))
+		assert.NoError(t, err)
+
+		echo, err := readGrpcFrame(response.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "echo "+message, echo)
+	}
+	requestWriter.Close()
+
+	_, _ = io.Copy(io.Discard, response.Body)
+	assert.Equal(t, "0", response.Trailer.Get("Grpc-Status"))
+}
+
+func TestServeHTTP_GrpcGatewayError(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	request := httptest.NewRequest(http.MethodPost, "/unknown.v1.Service/Call", nil)
+	request.Header.Set("Content-Type", "application/grpc+proto")
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, request)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/grpc", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "12", rr.Header().Get("Grpc-Status"))
+	assert.Equal(t, ErrServiceNotFound.Error(), rr.Header().Get("Grpc-Message"))
+	assert.Empty(t, rr.Body.String())
+}
+
+func TestEncodeGrpcMessage(t *testing.T) {
+	assert.Equal(t, "plain message", encodeGrpcMessage("plain message"))
+	assert.Equal(t, "100%25 caf%C3%A9%0A", encodeGrpcMessage("100% café\n"))
+	assert.False(t, strings.ContainsAny(encodeGrpcMessage("\r\n\t"), "\r\n\t"))
+}
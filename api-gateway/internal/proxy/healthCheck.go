@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultHealthCheckPath               = "/health"
+	defaultHealthCheckInterval           = 10 * time.Second
+	defaultHealthCheckTimeout            = 2 * time.Second
+	defaultHealthCheckHealthyThreshold   = 2
+	defaultHealthCheckUnhealthyThreshold = 3
+)
+
+// healthChecker probes the backends of a route in the background and
+// takes them out of rotation once they fail enough consecutive probes.
+type healthChecker struct {
+	route     *Route
+	config    config.HealthCheck
+	client    *http.Client
+	telemetry telemetry.TelemetryProvider
+	metrics   *proxyMetrics
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newHealthChecker(route *Route, healthCheckConfig config.HealthCheck, telemetryProvider telemetry.TelemetryProvider, metrics *proxyMetrics) *healthChecker {
+	if healthCheckConfig.Path == "" {
+		healthCheckConfig.Path = defaultHealthCheckPath
+	}
+	if healthCheckConfig.Interval <= 0 {
+		healthCheckConfig.Interval = defaultHealthCheckInterval
+	}
+	if healthCheckConfig.Timeout <= 0 {
+		healthCheckConfig.Timeout = defaultHealthCheckTimeout
+	}
+	if healthCheckConfig.HealthyThreshold <= 0 {
+		healthCheckConfig.HealthyThreshold = defaultHealthCheckHealthyThreshold
+	}
+	if healthCheckConfig.UnhealthyThreshold <= 0 {
+		healthCheckConfig.UnhealthyThreshold = defaultHealthCheckUnhealthyThreshold
+	}
+
+	client := &http.Client{Timeout: healthCheckConfig.Timeout}
+	// probes connect to the backends the way the requests of the route do
+	if route.client != nil {
+		client.Transport = route.client.Transport
+	}
+
+	return &healthChecker{
+		route:     route,
+		config:    healthCheckConfig,
+		client:    client,
+		telemetry: telemetryProvider,
+		metrics:   metrics,
+	}
+}
+
+// start launches one probe loop per backend.
+func (h *healthChecker) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+
+	for _, backend := range h.route.Backends {
+		h.metrics.healthyBackends.Add(ctx, 1, h.backendAttributes(backend))
+
+		h.wg.Add(1)
+		go h.run(ctx, backend)
+	}
+}
+
+// stop ends all probe loops and waits for them to return.
+func (h *healthChecker) stop() {
+	if h.cancel == nil {
+		return
+	}
+
+	h.cancel()
+	h.wg.Wait()
+
+	for _, backend := range h.route.Backends {
+		if backend.Healthy() {
+			h.metrics.healthyBackends.Add(context.Background(), -1, h.backendAttributes(backend))
+		}
+	}
+}
+
+func (h *healthChecker) run(ctx context.Context, backend *Backend) {
+	defer h.wg.Done()
+
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.record(ctx, backend, h.probe(ctx, backend))
+		}
+	}
+}
+
+// probe reports whether the backend answered its health endpoint with a non-error status.
+func (h *healthChecker) probe(ctx context.Context, backend *Backend) bool {
+	probeUrl := *backend.Url
+	probeUrl.Path = h.config.Path
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, probeUrl.String(), nil)
+	if err != nil {
+		return false
+	}
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		return false
+	}
+	defer response.Body.Close()
+
+	return response.StatusCode < http.StatusBadRequest
+}
+
+// record updates the backend's consecutive probe counters and flips its
+// health state once the matching threshold is reached.
+func (h *healthChecker) record(ctx context.Context, backend *Backend, ok bool) {
+	if ok {
+		backend.consecutiveProbeFailures = 0
+		backend.consecutiveProbeSuccesses++
+
+		if !backend.Healthy() && backend.consecutiveProbeSuccesses >= h.config.HealthyThreshold {
+			backend.healthy.Store(true)
+			h.metrics.healthyBackends.Add(ctx, 1, h.backendAttributes(backend))
+			h.telemetry.LogInfof("backend %v of route %v is healthy", backend.Url.String(), h.route.Prefix)
+		}
+		return
+	}
+
+	backend.consecutiveProbeSuccesses = 0
+	backend.consecutiveProbeFailures++
+
+	if backend.Healthy() && backend.consecutiveProbeFailures >= h.config.UnhealthyThreshold {
+		backend.healthy.Store(false)
+		h.metrics.healthyBackends.Add(ctx, -1, h.backendAttributes(backend))
+		h.telemetry.LogErrorf("backend %v of route %v is unhealthy, taking it out of rotation", backend.Url.String(), h.route.Prefix)
+	}
+}
+
+func (h *healthChecker) backendAttributes(backend *Backend) metric.MeasurementOption {
+	return metric.WithAttributes(
+		attribute.String("route", h.route.Prefix),
+		attribute.String("backend", backend.Url.String()),
+	)
+}
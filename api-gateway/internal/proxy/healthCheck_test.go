@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecker_TakesUnhealthyBackendOutOfRotation(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("flaky"))
+	}))
+	defer flaky.Close()
+
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	defer proxyHandler.Close()
+
+	routeConfig := newTestRouteConfig("/api", flaky.URL, stable.URL)
+	routeConfig.HealthCheck = &config.HealthCheck{
+		Interval:           10 * time.Millisecond,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 2,
+	}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	route := proxyHandler.Routes()["/api"]
+	flakyBackend := route.Backends[0]
+
+	healthy.Store(false)
+	assert.Eventually(t, func() bool { return !flakyBackend.Healthy() }, time.Second, 5*time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hello", nil))
+		assert.Equal(t, "stable", rr.Body.String())
+	}
+
+	healthy.Store(true)
+	assert.Eventually(t, flakyBackend.Healthy, time.Second, 5*time.Millisecond)
+}
+
+func TestServeHTTP_NoHealthyBackend(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/api", "http://127.0.0.1:65534"))
+	proxyHandler.Routes()["/api"].Backends[0].healthy.Store(false)
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hello", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Contains(t, rr.Body.String(), ErrNoHealthyBackend.Error())
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+const (
+	defaultHedgingDelay       = 100 * time.Millisecond
+	defaultHedgingMaxRequests = 2
+
+	// hedgingLatencySamples is the number of recent latencies the percentile delay is computed from.
+	hedgingLatencySamples = 1000
+	// hedgingMinSamples is the number of latencies needed before the percentile delay replaces the fixed delay.
+	hedgingMinSamples = 20
+)
+
+// hedgingPolicy sends additional copies of a slow read-only request to
+// other backends and keeps whichever response arrives first.
+type hedgingPolicy struct {
+	config    config.Hedging
+	latencies *latencyTracker
+}
+
+func newHedgingPolicy(hedgingConfig config.Hedging) *hedgingPolicy {
+	if hedgingConfig.Delay <= 0 {
+		hedgingConfig.Delay = defaultHedgingDelay
+	}
+	if hedgingConfig.MaxRequests <= 1 {
+		hedgingConfig.MaxRequests = defaultHedgingMaxRequests
+	}
+
+	return &hedgingPolicy{
+		config:    hedgingConfig,
+		latencies: newLatencyTracker(hedgingLatencySamples),
+	}
+}
+
+// appliesTo reports whether requests with the given method may be hedged.
+func (h *hedgingPolicy) appliesTo(method string) bool {
+	return h != nil && slices.Contains([]string{http.MethodGet, http.MethodHead, http.MethodOptions}, method)
+}
+
+// delay returns how long to wait for a response before sending the next copy.
+func (h *hedgingPolicy) delay() time.Duration {
+	if h.config.Percentile > 0 {
+		if latency, ok := h.latencies.percentile(h.config.Percentile); ok {
+			return latency
+		}
+	}
+
+	return h.config.Delay
+}
+
+// latencyTracker keeps a ring of recent latencies to compute percentiles from.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, size)}
+}
+
+func (l *latencyTracker) record(latency time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.samples[l.next] = latency
+	l.next = (l.next + 1) % len(l.samples)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// percentile returns the p-th percentile (0-100) of the recorded latencies,
+// or false when there are too few samples.
+func (l *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	l.mu.Lock()
+	count := l.next
+	if l.full {
+		count = len(l.samples)
+	}
+	sorted := slices.Clone(l.samples[:count])
+	l.mu.Unlock()
+
+	if count < hedgingMinSamples {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+	index := int(math.Ceil(p/100*float64(count))) - 1
+	index = max(0, min(index, count-1))
+
+	return sorted[index], true
+}
+
+// hedgeOutcome is the result of one copy of a hedged request.
+type hedgeOutcome struct {
+	result *attemptResult
+	err    error
+	index  int
+}
+
+// hedge sends the request to the given backend and, while no response has
+// arrived, sends further copies to other backends after the hedging delay.
+// The first response wins and every other copy is cancelled.
+func (p *ProxyHandler) hedge(ctx context.Context, r *http.Request, route *Route, variant *splitVariant, upstreamPath string, backend *Backend, permit circuitPermit, body *requestBody, attempt int, tried *[]*Backend) (*attemptResult, error) {
+	policy := route.hedgingPolicy
+	outcomes := make(chan hedgeOutcome, policy.config.MaxRequests)
+	cancels := make([]context.CancelFunc, 0, policy.config.MaxRequests)
+	// launchTimes holds when each copy was sent, so latencies exclude the hedging delay
+	launchTimes := make([]time.Time, 0, policy.config.MaxRequests)
+
+	launch := func(backend *Backend, permit circuitPermit, hedged bool) {
+		hedgeCtx, cancel := context.WithCancel(ctx)
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		launchTimes = append(launchTimes, time.Now())
+
+		go func() {
+			result, err := p.attempt(hedgeCtx, r, route, upstreamPath, backend, permit, body, attempt, hedged)
+			outcomes <- hedgeOutcome{result: result, err: err, index: index}
+		}()
+	}
+
+	launch(backend, permit, false)
+	inFlight := 1
+
+	timer := time.NewTimer(policy.delay())
+	defer timer.Stop()
+
+	var lastErr error
+
+	for inFlight > 0 {
+		select {
+		case <-timer.C:
+			if len(cancels) >= policy.config.MaxRequests {
+				continue
+			}
+
+			next, nextPermit, err := p.pickBackend(route, variant, *tried)
+			if err != nil {
+				continue
+			}
+			if slices.Contains(*tried, next) || !p.retryBudget.Load().withdraw(time.Now()) {
+				route.recordOutcome(ctx, next, nextPermit, outcomeCancelled)
+				continue
+			}
+
+			*tried = append(*tried, next)
+			launch(next, nextPermit, true)
+			inFlight++
+			timer.Reset(policy.delay())
+
+		case outcome := <-outcomes:
+			inFlight--
+
+			if outcome.err != nil {
+				cancels[outcome.index]()
+				lastErr = outcome.err
+				continue
+			}
+
+			policy.latencies.record(time.Since(launchTimes[outcome.index]))
+
+			// the first response wins, cancel the copies still in flight
+			for index, cancel := range cancels {
+				if index != outcome.index {
+					cancel()
+				}
+			}
+			go discardHedges(outcomes, inFlight)
+
+			outcome.result.cancel = cancels[outcome.index]
+			return outcome.result, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// discardHedges releases the copies of a hedged request that lost the race.
+func discardHedges(outcomes <-chan hedgeOutcome, inFlight int) {
+	for ; inFlight > 0; inFlight-- {
+		if outcome := <-outcomes; outcome.result != nil {
+			outcome.result.close()
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_HedgesSlowBackend(t *testing.T) {
+	loserCancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			close(loserCancelled)
+		case <-time.After(5 * time.Second):
+			_, _ = w.Write([]byte("slow"))
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	proxyHandler := newTestProxyHandler(t, 10*time.Second)
+	routeConfig := newTestRouteConfig("/user", slow.URL, fast.URL)
+	routeConfig.Hedging = &config.Hedging{Delay: 20 * time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	startTime := time.Now()
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/profile", nil))
+
+	assert.Equal(t, "fast", rr.Body.String())
+	assert.Less(t, time.Since(startTime), time.Second)
+
+	select {
+	case <-loserCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("losing hedge was not cancelled")
+	}
+}
+
+func TestServeHTTP_HedgeLatencyExcludesDelay(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer slow.Close()
+
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	proxyHandler := newTestProxyHandler(t, 10*time.Second)
+	routeConfig := newTestRouteConfig("/user", slow.URL, fast.URL)
+	routeConfig.Hedging = &config.Hedging{Delay: 200 * time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/profile", nil))
+	assert.Equal(t, "fast", rr.Body.String())
+
+	// the sample is the latency of the winning copy, not the time since the first one was sent
+	latencies := proxyHandler.Routes()["/user"].hedgingPolicy.latencies
+	assert.Equal(t, 1, latencies.next)
+	assert.Less(t, latencies.samples[0], 200*time.Millisecond)
+}
+
+func TestServeHTTP_DoesNotHedgeWrites(t *testing.T) {
+	var hits atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+	})
+
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	proxyHandler := newTestProxyHandler(t, 10*time.Second)
+	routeConfig := newTestRouteConfig("/order", first.URL, second.URL)
+	routeConfig.Hedging = &config.Hedging{Delay: 10 * time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/order/create", nil))
+
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestHedgingPolicy_PercentileDelay(t *testing.T) {
+	policy := newHedgingPolicy(config.Hedging{Delay: time.Second, Percentile: 90})
+	assert.Equal(t, time.Second, policy.delay(), "fixed delay until enough samples are recorded")
+
+	for i := 1; i <= 100; i++ {
+		policy.latencies.record(time.Duration(i) * time.Millisecond)
+	}
+	assert.Equal(t, 90*time.Millisecond, policy.delay())
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// proxyMetrics holds the instruments the proxy reports to.
+type proxyMetrics struct {
+	healthyBackends     metric.Int64UpDownCounter
+	circuitBreakerState metric.Int64Gauge
+	configReloads       metric.Int64Counter
+	variantRequests     metric.Int64Counter
+	variantErrors       metric.Int64Counter
+	mirrorRequests      metric.Int64Counter
+	shadowMismatches    metric.Int64Counter
+	shadowComparisons   metric.Int64Counter
+	activeTunnels       metric.Int64UpDownCounter
+}
+
+// newProxyMetrics creates the proxy instruments, falling back to no-op
+// instruments when the telemetry provider fails to create one.
+func newProxyMetrics(telemetryProvider telemetry.TelemetryProvider) *proxyMetrics {
+	metrics := &proxyMetrics{
+		healthyBackends:     noop.Int64UpDownCounter{},
+		circuitBreakerState: noop.Int64Gauge{},
+		configReloads:       noop.Int64Counter{},
+		variantRequests:     noop.Int64Counter{},
+		variantErrors:       noop.Int64Counter{},
+		mirrorRequests:      noop.Int64Counter{},
+		shadowMismatches:    noop.Int64Counter{},
+		shadowComparisons:   noop.Int64Counter{},
+		activeTunnels:       noop.Int64UpDownCounter{},
+	}
+
+	if counter, err := telemetryProvider.MeterInt64UpDownCounter(telemetry.MetricHealthyBackends); err != nil {
+		telemetryProvider.LogErrorln("failed to create healthy backends counter:", err)
+	} else {
+		metrics.healthyBackends = counter
+	}
+
+	if gauge, err := telemetryProvider.MeterInt64Gauge(telemetry.MetricCircuitBreakerState); err != nil {
+		telemetryProvider.LogErrorln("failed to create circuit breaker state gauge:", err)
+	} else {
+		metrics.circuitBreakerState = gauge
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricConfigReloads); err != nil {
+		telemetryProvider.LogErrorln("failed to create config reloads counter:", err)
+	} else {
+		metrics.configReloads = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricVariantRequests); err != nil {
+		telemetryProvider.LogErrorln("failed to create variant requests counter:", err)
+	} else {
+		metrics.variantRequests = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricVariantErrors); err != nil {
+		telemetryProvider.LogErrorln("failed to create variant errors counter:", err)
+	} else {
+		metrics.variantErrors = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricMirrorRequests); err != nil {
+		telemetryProvider.LogErrorln("failed to create mirror requests counter:", err)
+	} else {
+		metrics.mirrorRequests = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricShadowMismatches); err != nil {
+		telemetryProvider.LogErrorln("failed to create shadow mismatches counter:", err)
+	} else {
+		metrics.shadowMismatches = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64Counter(telemetry.MetricShadowComparisons); err != nil {
+		telemetryProvider.LogErrorln("failed to create shadow comparisons counter:", err)
+	} else {
+		metrics.shadowComparisons = counter
+	}
+
+	if counter, err := telemetryProvider.MeterInt64UpDownCounter(telemetry.MetricWebSocketTunnels); err != nil {
+		telemetryProvider.LogErrorln("failed to create WebSocket tunnels counter:", err)
+	} else {
+		metrics.activeTunnels = counter
+	}
+
+	return metrics
+}
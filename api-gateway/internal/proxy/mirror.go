@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultMirrorTimeout       = 2 * time.Second
+	defaultMirrorMaxConcurrent = 100
+	defaultMirrorMaxBodyBytes  = 64 << 10
+
+	// shadowRequestHeader marks the copies sent to a mirror, so shadow backends can tell them apart
+	shadowRequestHeader = "X-Shadow-Request"
+)
+
+// Results of mirrored requests, as reported to the mirror requests counter.
+const (
+	mirrorSent    = "sent"
+	mirrorFailed  = "failed"
+	mirrorDropped = "dropped"
+)
+
+// mirrorPolicy copies a share of the requests of a route to a shadow
+// backend. The copies run in the background and never delay or change
+// the response to the client; shadow responses are discarded. Requests
+// with bodies larger than the configured maximum are not mirrored.
+type mirrorPolicy struct {
+	config config.Mirror
+	target *url.URL
+	// slots holds a token per mirrored request in flight
+	slots chan struct{}
+	// comparer is nil unless the mirror responses are compared
+	comparer *shadowComparer
+}
+
+func newMirrorPolicy(mirrorConfig config.Mirror) (*mirrorPolicy, error) {
+	target, err := url.ParseRequestURI(mirrorConfig.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if mirrorConfig.Timeout <= 0 {
+		mirrorConfig.Timeout = defaultMirrorTimeout
+	}
+	if mirrorConfig.MaxConcurrent <= 0 {
+		mirrorConfig.MaxConcurrent = defaultMirrorMaxConcurrent
+	}
+	if mirrorConfig.MaxBodyBytes <= 0 {
+		mirrorConfig.MaxBodyBytes = defaultMirrorMaxBodyBytes
+	}
+
+	policy := &mirrorPolicy{
+		config: mirrorConfig,
+		target: target,
+		slots:  make(chan struct{}, mirrorConfig.MaxConcurrent),
+	}
+	if mirrorConfig.Compare != nil {
+		policy.comparer = newShadowComparer(*mirrorConfig.Compare)
+	}
+
+	return policy, nil
+}
+
+// sample reports whether a request is picked for mirroring.
+func (m *mirrorPolicy) sample() bool {
+	return m != nil && m.config.Percentage > 0 && rand.Float64()*100 < m.config.Percentage
+}
+
+// mirror sends a copy of the request to the route's shadow backend and
+// discards the response. The copy is dropped when the mirror already has
+// as many requests in flight as it allows. Everything the copy needs from
+// the client request is taken before mirror returns, so the copy can
+// outlive the request. When the mirror compares responses, mirror returns
+// the comparison the response of the route's backend must be handed to.
+func (p *ProxyHandler) mirror(ctx context.Context, r *http.Request, route *Route, upstreamPath string, body *requestBody) *shadowComparison {
+	policy := route.mirror
+
+	select {
+	case policy.slots <- struct{}{}:
+	default:
+		p.recordMirror(route, mirrorDropped)
+		trace.SpanFromContext(ctx).AddEvent("mirror_dropped")
+		return nil
+	}
+
+	// the copy is not cancelled with the client request, only by its own timeout
+	mirrorCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), policy.config.Timeout)
+	mirrorCtx, span := p.Telemetry.TraceStart(mirrorCtx, "api_gateway_mirror", trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("gateway.backend", policy.target.String()))
+
+	release := func() {
+		span.End()
+		cancel()
+		<-policy.slots
+	}
+
+	mirrorRequest := r.WithContext(mirrorCtx)
+	mirrorRequest.Header = r.Header.Clone()
+	mirrorRequest.Header.Set(shadowRequestHeader, "true")
+	mirrorRequest.Body = body.reader()
+
+	proxyRequest, err := p.createProxyRequest(mirrorRequest, policy.target, upstreamPath)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		release()
+		p.recordMirror(route, mirrorFailed)
+		return nil
+	}
+
+	span.SetAttributes(clientRequestAttributes(proxyRequest, route)...)
+	otel.GetTextMapPropagator().Inject(mirrorCtx, propagation.HeaderCarrier(proxyRequest.Header))
+
+	var comparison *shadowComparison
+	var diff shadowDiff
+	if policy.comparer != nil {
+		comparison = newShadowComparison()
+		diff = shadowDiff{
+			Route:     route.Prefix,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RequestID: r.Header.Get(RequestIDHeader),
+			TraceID:   span.SpanContext().TraceID().String(),
+		}
+	}
+
+	go func() {
+		response, err := p.clientFor(route).Do(proxyRequest)
+		if err != nil {
+			err = upstreamError(span, err)
+			span.RecordError(err)
+			span.SetAttributes(errorTypeAttribute(0, err))
+			span.SetStatus(codes.Error, err.Error())
+			release()
+			p.recordMirror(route, mirrorFailed)
+			return
+		}
+
+		var shadow *responseSnapshot
+		if comparison != nil {
+			shadow = readSnapshot(response, policy.comparer.config.MaxBodyBytes)
+		} else {
+			_, _ = io.Copy(io.Discard, response.Body)
+		}
+		response.Body.Close()
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+		if response.StatusCode >= http.StatusBadRequest {
+			span.SetAttributes(errorTypeAttribute(response.StatusCode, nil))
+			span.SetStatus(codes.Error, response.Status)
+		}
+
+		// the slot and the span only cover the call to the mirror, not the wait for the primary response
+		release()
+		p.recordMirror(route, mirrorSent)
+
+		if comparison != nil {
+			p.compareShadow(route, comparison, shadow, diff, policy.config.Timeout)
+		}
+	}()
+
+	return comparison
+}
+
+func (p *ProxyHandler) recordMirror(route *Route, result string) {
+	p.metrics.mirrorRequests.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("route", route.Prefix),
+		attribute.String("result", result),
+	))
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// shadowRequest is a request as received by a shadow backend.
+type shadowRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func newShadowServer(t *testing.T, handler http.HandlerFunc) (*httptest.Server, <-chan shadowRequest) {
+	t.Helper()
+
+	received := make(chan shadowRequest, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- shadowRequest{method: r.Method, path: r.URL.Path, header: r.Header, body: string(body)}
+		if handler != nil {
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, received
+}
+
+func TestServeHTTP_Mirror(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Empty(t, r.Header.Get(shadowRequestHeader))
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	shadow, received := newShadowServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL, Percentage: 100}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/order/1", strings.NewReader(`{"item":"book"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{"item":"book"}`, rr.Body.String())
+
+	select {
+	case request := <-received:
+		assert.Equal(t, http.MethodPost, request.method)
+		assert.Equal(t, "/1", request.path)
+		assert.Equal(t, "true", request.header.Get(shadowRequestHeader))
+		assert.Equal(t, `{"item":"book"}`, request.body)
+	case <-time.After(time.Second):
+		t.Fatal("mirror did not receive the request")
+	}
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_mirror") != nil }, time.Second, 10*time.Millisecond)
+	span := telem.endedSpan("api_gateway_mirror")
+	assert.Equal(t, int64(http.StatusInternalServerError), spanAttributeMap(span)["http.response.status_code"].AsInt64())
+	assert.Equal(t, telem.endedSpan("api_gateway_request").SpanContext().SpanID(), span.Parent().SpanID())
+}
+
+func TestServeHTTP_MirrorDoesNotDelayResponses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	shadow, received := newShadowServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL, Percentage: 100, Timeout: 50 * time.Millisecond}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/order/1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	<-received
+	// the mirror times out and frees its slot
+	assert.Eventually(t, func() bool { return len(proxyHandler.Routes()["/order"].mirror.slots) == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestServeHTTP_MirrorLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	unblock := make(chan struct{})
+	shadow, received := newShadowServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	})
+	defer close(unblock)
+
+	reader := sdkmetric.NewManualReader()
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	proxyHandler.metrics.mirrorRequests, _ = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64Counter("mirror_requests")
+
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL, Percentage: 100, MaxConcurrent: 1, MaxBodyBytes: 8}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	for _, body := range []string{"first", "second", "too large for the mirror"} {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/order", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	assert.Equal(t, "first", (<-received).body)
+	assert.Len(t, received, 0)
+
+	var data metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(t.Context(), &data))
+	dropped := int64(0)
+	for _, point := range data.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints {
+		if result, _ := point.Attributes.Value(attribute.Key("result")); result.AsString() == mirrorDropped {
+			dropped += point.Value
+		}
+	}
+	assert.Equal(t, int64(1), dropped)
+}
+
+func TestServeHTTP_MirrorPercentage(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	shadow, received := newShadowServer(t, nil)
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	for i := 0; i < 10; i++ {
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/order", nil))
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, received, 0)
+
+	err := proxyHandler.ReplaceRoutes([]config.Route{{Prefix: "/order", Backends: routeConfig.Backends, Mirror: &config.Mirror{Url: shadow.URL, Percentage: 150}}})
+	assert.ErrorIs(t, err, config.ErrInvalidConfiguration)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultOutlierConsecutiveErrors  = 5
+	defaultOutlierBaseEjectionTime   = 30 * time.Second
+	defaultOutlierMaxEjectionTime    = 5 * time.Minute
+	defaultOutlierMaxEjectionPercent = 50
+)
+
+// outlierDetector watches the responses of a route's backends as they are
+// proxied and ejects backends that keep failing. Each further ejection of
+// the same backend lasts longer, up to the configured maximum, until the
+// backend goes the maximum ejection time without being ejected.
+type outlierDetector struct {
+	route     *Route
+	config    config.OutlierDetection
+	telemetry telemetry.TelemetryProvider
+
+	mu sync.Mutex
+}
+
+func newOutlierDetector(route *Route, outlierConfig config.OutlierDetection, telemetryProvider telemetry.TelemetryProvider) *outlierDetector {
+	if outlierConfig.ConsecutiveErrors <= 0 {
+		outlierConfig.ConsecutiveErrors = defaultOutlierConsecutiveErrors
+	}
+	if outlierConfig.BaseEjectionTime <= 0 {
+		outlierConfig.BaseEjectionTime = defaultOutlierBaseEjectionTime
+	}
+	if outlierConfig.MaxEjectionTime <= 0 {
+		outlierConfig.MaxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if outlierConfig.MaxEjectionPercent <= 0 {
+		outlierConfig.MaxEjectionPercent = defaultOutlierMaxEjectionPercent
+	}
+
+	return &outlierDetector{
+		route:     route,
+		config:    outlierConfig,
+		telemetry: telemetryProvider,
+	}
+}
+
+// record counts the outcome of a proxied request. A failure is a
+// connection error or a 5xx response from the backend.
+func (o *outlierDetector) record(ctx context.Context, backend *Backend, failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !failed {
+		backend.consecutiveErrors = 0
+		return
+	}
+
+	backend.consecutiveErrors++
+	if backend.consecutiveErrors < o.config.ConsecutiveErrors {
+		return
+	}
+
+	now := time.Now()
+	if backend.Ejected(now) {
+		return
+	}
+
+	if !o.canEject(now) {
+		o.telemetry.LogErrorf(
+			"backend %v of route %v crossed the outlier threshold but %v%% of the route is already ejected",
+			backend.Url.String(), o.route.Prefix, o.config.MaxEjectionPercent,
+		)
+		return
+	}
+
+	// a single success says little about a backend that was ejected before,
+	// only a quiet period after its last ejection resets the back-off
+	if now.Sub(time.Unix(0, backend.ejectedUntil.Load())) >= o.config.MaxEjectionTime {
+		backend.ejectionCount = 0
+	}
+
+	backend.consecutiveErrors = 0
+	backend.ejectionCount++
+
+	ejectionTime := o.config.BaseEjectionTime * time.Duration(backend.ejectionCount)
+	if ejectionTime > o.config.MaxEjectionTime {
+		ejectionTime = o.config.MaxEjectionTime
+	}
+	backend.ejectedUntil.Store(now.Add(ejectionTime).UnixNano())
+
+	trace.SpanFromContext(ctx).AddEvent("backend_ejected", trace.WithAttributes(
+		attribute.String("backend", backend.Url.String()),
+		attribute.String("ejection.duration", ejectionTime.String()),
+		attribute.Int("ejection.count", backend.ejectionCount),
+	))
+	o.telemetry.LogErrorf(
+		"backend %v of route %v ejected for %v after %v consecutive errors",
+		backend.Url.String(), o.route.Prefix, ejectionTime, o.config.ConsecutiveErrors,
+	)
+}
+
+// canEject reports whether ejecting one more backend keeps the route
+// within its maximum ejection percentage. Must be called with mu held.
+func (o *outlierDetector) canEject(now time.Time) bool {
+	ejected := 0
+	for _, backend := range o.route.Backends {
+		if backend.Ejected(now) {
+			ejected++
+		}
+	}
+
+	return (ejected+1)*100 <= o.config.MaxEjectionPercent*len(o.route.Backends)
+}
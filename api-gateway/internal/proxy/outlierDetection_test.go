@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOutlierRoute(t *testing.T, outlierConfig config.OutlierDetection, backendUrls ...string) *Route {
+	t.Helper()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	routeConfig := newTestRouteConfig("/api", backendUrls...)
+	routeConfig.OutlierDetection = &outlierConfig
+	if err := proxyHandler.AddRoute(routeConfig); err != nil {
+		t.Fatalf("failed to add route: %v", err)
+	}
+
+	return proxyHandler.Routes()["/api"]
+}
+
+func TestOutlierDetector_EjectsWithGrowingBackoff(t *testing.T) {
+	route := newTestOutlierRoute(t, config.OutlierDetection{
+		ConsecutiveErrors:  2,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionTime:    150 * time.Second,
+		MaxEjectionPercent: 100,
+	}, "http://a:8000", "http://b:8000")
+	backend := route.Backends[0]
+	ctx := context.Background()
+
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.False(t, backend.Ejected(time.Now()), "below threshold")
+
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.True(t, backend.Ejected(time.Now()))
+	assert.False(t, backend.Ejected(time.Now().Add(61*time.Second)), "first ejection lasts the base time")
+	assert.NotContains(t, route.availableBackends(), backend)
+
+	// still failing once it is back: the second ejection is twice as long, capped at the maximum
+	backend.ejectedUntil.Store(time.Now().UnixNano())
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.True(t, backend.Ejected(time.Now().Add(119*time.Second)))
+	assert.False(t, backend.Ejected(time.Now().Add(151*time.Second)))
+}
+
+func TestOutlierDetector_SuccessKeepsBackoff(t *testing.T) {
+	route := newTestOutlierRoute(t, config.OutlierDetection{
+		ConsecutiveErrors:  1,
+		BaseEjectionTime:   time.Minute,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 100,
+	}, "http://a:8000", "http://b:8000")
+	backend := route.Backends[0]
+	ctx := context.Background()
+
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.False(t, backend.Ejected(time.Now().Add(61*time.Second)))
+
+	// a single success after the ejection does not reset the back-off
+	backend.ejectedUntil.Store(time.Now().UnixNano())
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeSuccess)
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.True(t, backend.Ejected(time.Now().Add(119*time.Second)), "second ejection is twice as long")
+	assert.Equal(t, 2, backend.ejectionCount)
+
+	// going the maximum ejection time without being ejected does
+	backend.ejectedUntil.Store(time.Now().Add(-5 * time.Minute).UnixNano())
+	route.recordOutcome(ctx, backend, circuitPermit{}, outcomeFailure)
+	assert.False(t, backend.Ejected(time.Now().Add(61*time.Second)), "back to the base time")
+	assert.Equal(t, 1, backend.ejectionCount)
+}
+
+func TestOutlierDetector_RespectsMaxEjectionPercent(t *testing.T) {
+	route := newTestOutlierRoute(t, config.OutlierDetection{
+		ConsecutiveErrors:  1,
+		MaxEjectionPercent: 50,
+	}, "http://a:8000", "http://b:8000")
+	ctx := context.Background()
+
+	route.recordOutcome(ctx, route.Backends[0], circuitPermit{}, outcomeFailure)
+	route.recordOutcome(ctx, route.Backends[1], circuitPermit{}, outcomeFailure)
+
+	assert.True(t, route.Backends[0].Ejected(time.Now()))
+	assert.False(t, route.Backends[1].Ejected(time.Now()), "ejecting both would exceed 50%")
+	assert.Equal(t, []*Backend{route.Backends[1]}, route.availableBackends())
+}
+
+func TestServeHTTP_EjectsFailingBackend(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/api", failing.URL, "http://127.0.0.1:65534")
+	routeConfig.OutlierDetection = &config.OutlierDetection{ConsecutiveErrors: 1, MaxEjectionPercent: 100}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	for i := 0; i < 2; i++ {
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hello", nil))
+	}
+
+	for _, backend := range proxyHandler.Routes()["/api"].Backends {
+		assert.True(t, backend.Ejected(time.Now()), backend.Url.String())
+	}
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+// routePredicates are the conditions besides the path a request must meet to take a route.
+type routePredicates struct {
+	// methods is nil when the route takes any method
+	methods map[string]bool
+	headers []valuePredicate
+	query   []valuePredicate
+	cookies []string
+}
+
+// valuePredicate matches a named header or query parameter. The value must
+// equal value, or match regex as a whole; with neither set it only has to
+// be present.
+type valuePredicate struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+func newRoutePredicates(matchConfig config.RouteMatch) (*routePredicates, error) {
+	predicates := &routePredicates{cookies: matchConfig.Cookies}
+
+	if len(matchConfig.Methods) > 0 {
+		predicates.methods = make(map[string]bool, len(matchConfig.Methods)+1)
+		for _, method := range matchConfig.Methods {
+			predicates.methods[strings.ToUpper(method)] = true
+		}
+		// like net/http, a route for GET also answers HEAD
+		if predicates.methods[http.MethodGet] {
+			predicates.methods[http.MethodHead] = true
+		}
+	}
+
+	var err error
+
+	predicates.headers, err = newValuePredicates(matchConfig.Headers, http.CanonicalHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	predicates.query, err = newValuePredicates(matchConfig.Query, func(name string) string { return name })
+	if err != nil {
+		return nil, err
+	}
+
+	return predicates, nil
+}
+
+func newValuePredicates(matches []config.ValueMatch, canonicalName func(string) string) ([]valuePredicate, error) {
+	predicates := make([]valuePredicate, 0, len(matches))
+
+	for _, match := range matches {
+		predicate := valuePredicate{name: canonicalName(match.Name), value: match.Value}
+
+		if match.Regex != "" {
+			regex, err := regexp.Compile("^(?:" + match.Regex + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v: %w", ErrInvalidPredicate, match.Name, err)
+			}
+			predicate.regex = regex
+		}
+
+		predicates = append(predicates, predicate)
+	}
+
+	return predicates, nil
+}
+
+// count returns the number of conditions, which ranks routes that share a path.
+func (p *routePredicates) count() int {
+	if p == nil {
+		return 0
+	}
+
+	count := len(p.headers) + len(p.query) + len(p.cookies)
+	if p.methods != nil {
+		count++
+	}
+
+	return count
+}
+
+// allowsMethod reports whether the route takes requests with the method.
+func (p *routePredicates) allowsMethod(method string) bool {
+	return p == nil || p.methods == nil || p.methods[method]
+}
+
+// matchesRequest reports whether the request meets every condition but the method.
+func (p *routePredicates) matchesRequest(r *http.Request) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, predicate := range p.headers {
+		values, present := r.Header[predicate.name]
+		if !present || !slices.ContainsFunc(values, predicate.matches) {
+			return false
+		}
+	}
+
+	if len(p.query) > 0 {
+		query := r.URL.Query()
+		for _, predicate := range p.query {
+			values, present := query[predicate.name]
+			if !present || !slices.ContainsFunc(values, predicate.matches) {
+				return false
+			}
+		}
+	}
+
+	for _, name := range p.cookies {
+		if _, err := r.Cookie(name); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p valuePredicate) matches(value string) bool {
+	switch {
+	case p.regex != nil:
+		return p.regex.MatchString(value)
+	case p.value != "":
+		return value == p.value
+	default:
+		return true
+	}
+}
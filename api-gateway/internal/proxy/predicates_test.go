@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingTable_Predicates(t *testing.T) {
+	table := newTestRoutingTable(t,
+		config.Route{Name: "order", Prefix: "/order"},
+		config.Route{Name: "order v2", Prefix: "/order", Match: &config.RouteMatch{
+			Headers: []config.ValueMatch{{Name: "x-api-version", Value: "2"}},
+		}},
+		config.Route{Name: "order v3", Prefix: "/order", Match: &config.RouteMatch{
+			Headers: []config.ValueMatch{{Name: "X-Api-Version", Regex: `3(\.\d+)?`}},
+		}},
+		config.Route{Name: "order replicas", Prefix: "/order", Match: &config.RouteMatch{
+			Methods: []string{"get"},
+		}},
+		config.Route{Name: "order debug", Prefix: "/order", Match: &config.RouteMatch{
+			Query:   []config.ValueMatch{{Name: "debug", Value: "true"}},
+			Cookies: []string{"session"},
+		}},
+		config.Route{Name: "order beta", Prefix: "/order", Priority: 10, Match: &config.RouteMatch{
+			Cookies: []string{"beta"},
+		}},
+	)
+
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		header       http.Header
+		cookies      []string
+		expectedName string
+	}{
+		{"no conditions", http.MethodPost, "/order/1", nil, nil, "order"},
+		{"method", http.MethodGet, "/order/1", nil, nil, "order replicas"},
+		{"head follows get", http.MethodHead, "/order/1", nil, nil, "order replicas"},
+		{"header equality", http.MethodPost, "/order/1", http.Header{"X-Api-Version": {"2"}}, nil, "order v2"},
+		{"header regex", http.MethodPost, "/order/1", http.Header{"X-Api-Version": {"3.1"}}, nil, "order v3"},
+		{"header regex matches whole value", http.MethodPost, "/order/1", http.Header{"X-Api-Version": {"31"}}, nil, "order"},
+		{"query without cookie", http.MethodPost, "/order/1?debug=true", nil, nil, "order"},
+		{"query and cookie", http.MethodPost, "/order/1?debug=true", nil, []string{"session"}, "order debug"},
+		{"more conditions win", http.MethodGet, "/order/1?debug=true", nil, []string{"session"}, "order debug"},
+		{"priority wins", http.MethodGet, "/order/1?debug=true", http.Header{"X-Api-Version": {"2"}}, []string{"session", "beta"}, "order beta"},
+	}
+
+	for _, tc := range tests {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		for name, values := range tc.header {
+			r.Header[name] = values
+		}
+		for _, cookie := range tc.cookies {
+			r.AddCookie(&http.Cookie{Name: cookie, Value: "1"})
+		}
+
+		match := table.match(r)
+		if assert.NotNil(t, match.route, tc.name) {
+			assert.Equal(t, tc.expectedName, match.route.Name, tc.name)
+		}
+	}
+}
+
+func TestRoutingTable_PredicatesFallBackToShorterPaths(t *testing.T) {
+	table := newTestRoutingTable(t,
+		config.Route{Name: "orders", Prefix: "/order"},
+		config.Route{Name: "order reads", Prefix: "/order/:id", Match: &config.RouteMatch{Methods: []string{http.MethodGet}}},
+	)
+
+	assert.Equal(t, "order reads", table.match(httptest.NewRequest(http.MethodGet, "/order/1", nil)).route.Name)
+	assert.Equal(t, "orders", table.match(httptest.NewRequest(http.MethodDelete, "/order/1", nil)).route.Name)
+}
+
+func TestRoutingTable_PredicateConflicts(t *testing.T) {
+	routes := make(map[string]*Route)
+	for _, routeConfig := range []config.Route{
+		{Prefix: "/order", Backends: []config.Backend{{Url: "http://order:6002"}}},
+		{Prefix: "/order/", Backends: []config.Backend{{Url: "http://order:6002"}}},
+	} {
+		route, err := newRoute(routeConfig)
+		assert.NoError(t, err)
+		routes[routeConfig.Key()] = route
+	}
+
+	_, err := newRoutingTable(routes, 1)
+	assert.ErrorIs(t, err, ErrRouteConflict)
+}
+
+func TestServeHTTP_MethodNotAllowed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	reads := newTestRouteConfig("/user", backend.URL)
+	reads.Name = "user reads"
+	reads.Match = &config.RouteMatch{Methods: []string{http.MethodGet}}
+
+	writes := newTestRouteConfig("/user", backend.URL)
+	writes.Name = "user writes"
+	writes.Match = &config.RouteMatch{Methods: []string{http.MethodPost, http.MethodPut}}
+
+	v2 := newTestRouteConfig("/user", backend.URL)
+	v2.Name = "user v2"
+	v2.Match = &config.RouteMatch{Methods: []string{http.MethodDelete}, Headers: []config.ValueMatch{{Name: "X-Api-Version", Value: "2"}}}
+
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{reads, writes, v2}))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/user/1", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+	assert.Equal(t, "GET, HEAD, POST, PUT", rr.Header().Get("Allow"))
+	assert.Equal(t, problemContentType, rr.Header().Get("Content-Type"))
+
+	rr = httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/user/1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/order/1", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Empty(t, rr.Header().Get("Allow"))
+}
+
+func TestReplaceRoutes_InvalidPredicates(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	tests := []struct {
+		name  string
+		route config.Route
+	}{
+		{"missing name", config.Route{Prefix: "/user", Match: &config.RouteMatch{Methods: []string{http.MethodGet}}}},
+		{"value and regex", config.Route{Name: "user", Prefix: "/user", Match: &config.RouteMatch{Headers: []config.ValueMatch{{Name: "X-Api-Version", Value: "2", Regex: "2"}}}}},
+		{"invalid regex", config.Route{Name: "user", Prefix: "/user", Match: &config.RouteMatch{Query: []config.ValueMatch{{Name: "id", Regex: "("}}}}},
+	}
+
+	for _, tc := range tests {
+		tc.route.Backends = []config.Backend{{Url: "http://user:6001"}}
+		err := proxyHandler.ReplaceRoutes([]config.Route{tc.route})
+		assert.ErrorIs(t, err, config.ErrInvalidConfiguration, tc.name)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:api-gateway:problem:"
+
+	// RequestIDHeader carries the request ID to backends and back to the client.
+	RequestIDHeader = "X-Request-Id"
+)
+
+// problemTypes names the gateway errors in the type URI of their problem responses.
+var problemTypes = map[error]string{
+	ErrServiceNotFound:    "service-not-found",
+	ErrCreateProxyRequest: "create-proxy-request",
+	ErrBackendResponse:    "backend-response",
+	ErrNoHealthyBackend:   "no-healthy-backend",
+	ErrCircuitOpen:        "circuit-open",
+	ErrReadRequestBody:    "read-request-body",
+	ErrMethodNotAllowed:   "method-not-allowed",
+	ErrCompositeCall:      "composite-call",
+
+	// admin API
+	ErrRouteNotFound:               "route-not-found",
+	ErrRouteExists:                 "route-exists",
+	ErrVersionConflict:             "version-conflict",
+	config.ErrInvalidConfiguration: "invalid-configuration",
+}
+
+// Problem is an RFC 7807 problem details object describing a gateway generated error.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	TraceID   string `json:"traceId,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// newProblem describes err as a problem for the given request.
+func newProblem(r *http.Request, span trace.Span, err error, statusCode int) Problem {
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(statusCode),
+		Status:    statusCode,
+		Detail:    err.Error(),
+		Instance:  r.URL.Path,
+		RequestID: r.Header.Get(RequestIDHeader),
+	}
+
+	for sentinel, problemType := range problemTypes {
+		if errors.Is(err, sentinel) {
+			problem.Type = problemTypePrefix + problemType
+			break
+		}
+	}
+
+	if spanContext := span.SpanContext(); spanContext.HasTraceID() {
+		problem.TraceID = spanContext.TraceID().String()
+	}
+
+	return problem
+}
+
+// writeProblem sends the problem as application/problem+json.
+func writeProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+// errorTemplate renders gateway generated errors of a route in a custom format.
+type errorTemplate struct {
+	contentType string
+	execute     func(io.Writer, Problem) error
+}
+
+// newErrorTemplate parses an inline or file based error template. HTML
+// templates are escaped for HTML, every other content type is rendered as text.
+func newErrorTemplate(templateConfig config.ErrorTemplate) (*errorTemplate, error) {
+	source := templateConfig.Template
+	if templateConfig.File != "" {
+		content, err := os.ReadFile(templateConfig.File)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidErrorTemplate, err)
+		}
+		source = string(content)
+	}
+
+	if source == "" {
+		return nil, fmt.Errorf("%w: template or file is required", ErrInvalidErrorTemplate)
+	}
+
+	contentType := templateConfig.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	functions := map[string]any{"json": templateJSON}
+
+	if strings.Contains(contentType, "html") {
+		parsed, err := htmltemplate.New("error").Funcs(functions).Parse(source)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidErrorTemplate, err)
+		}
+		return &errorTemplate{contentType: contentType, execute: func(w io.Writer, problem Problem) error {
+			return parsed.Execute(w, problem)
+		}}, nil
+	}
+
+	parsed, err := texttemplate.New("error").Funcs(functions).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidErrorTemplate, err)
+	}
+	return &errorTemplate{contentType: contentType, execute: func(w io.Writer, problem Problem) error {
+		return parsed.Execute(w, problem)
+	}}, nil
+}
+
+// write renders the problem through the template, falling back to
+// problem+json when rendering fails.
+func (t *errorTemplate) write(w http.ResponseWriter, problem Problem) {
+	var body bytes.Buffer
+	if err := t.execute(&body, problem); err != nil {
+		writeProblem(w, problem)
+		return
+	}
+
+	w.Header().Set("Content-Type", t.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(problem.Status)
+	_, _ = body.WriteTo(w)
+}
+
+// templateJSON encodes a value as JSON for use inside templates.
+func templateJSON(value any) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// ensureRequestID makes sure the request carries a request ID, generating one when the client sent none.
+func ensureRequestID(r *http.Request) string {
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID != "" {
+		return requestID
+	}
+
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	requestID = hex.EncodeToString(id)
+	r.Header.Set(RequestIDHeader, requestID)
+
+	return requestID
+}
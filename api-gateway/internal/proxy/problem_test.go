@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_ProblemResponse(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	req.Header.Set(RequestIDHeader, "req-42")
+	rr := httptest.NewRecorder()
+
+	proxyHandler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "application/problem+json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "req-42", rr.Header().Get(RequestIDHeader))
+
+	var problem Problem
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+	assert.Equal(t, Problem{
+		Type:      "urn:api-gateway:problem:service-not-found",
+		Title:     "Not Found",
+		Status:    http.StatusNotFound,
+		Detail:    ErrServiceNotFound.Error(),
+		Instance:  "/unknown",
+		RequestID: "req-42",
+	}, problem)
+}
+
+func TestServeHTTP_GeneratesRequestID(t *testing.T) {
+	var forwarded string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(RequestIDHeader)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/api", backend.URL))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hello", nil))
+
+	assert.Len(t, forwarded, 32)
+	assert.Equal(t, forwarded, rr.Header().Get(RequestIDHeader))
+}
+
+func TestServeHTTP_ErrorTemplates(t *testing.T) {
+	htmlFile := filepath.Join(t.TempDir(), "error.html")
+	assert.NoError(t, os.WriteFile(htmlFile, []byte(`<h1>{{.Title}}</h1><p>{{.Detail}}</p>`), 0o600))
+
+	tests := []struct {
+		name                string
+		template            config.ErrorTemplate
+		expectedContentType string
+		expectedBody        string
+	}{
+		{
+			name: "inline json",
+			template: config.ErrorTemplate{
+				Template: `{"code":{{.Status}},"message":{{json .Detail}}}`,
+			},
+			expectedContentType: "application/json",
+			expectedBody:        `{"code":502,"message":"something went wrong in backend service"}`,
+		},
+		{
+			name: "html file is escaped",
+			template: config.ErrorTemplate{
+				ContentType: "text/html; charset=utf-8",
+				File:        htmlFile,
+			},
+			expectedContentType: "text/html; charset=utf-8",
+			expectedBody:        `<h1>Bad Gateway</h1><p>something went wrong in backend service</p>`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyHandler := newTestProxyHandler(t, 2*time.Second)
+			routeConfig := newTestRouteConfig("/fail", "http://127.0.0.1:65534")
+			routeConfig.ErrorTemplate = &tc.template
+			assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+			rr := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/fail/boom", nil))
+
+			assert.Equal(t, http.StatusBadGateway, rr.Code)
+			assert.Equal(t, tc.expectedContentType, rr.Header().Get("Content-Type"))
+			assert.Equal(t, tc.expectedBody, rr.Body.String())
+		})
+	}
+}
+
+func TestAddRoute_InvalidErrorTemplate(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	routeConfig := newTestRouteConfig("/api", "http://backend:8000")
+	routeConfig.ErrorTemplate = &config.ErrorTemplate{Template: "{{.Missing"}
+
+	assert.ErrorIs(t, proxyHandler.AddRoute(routeConfig), ErrInvalidErrorTemplate)
+}
@@ -1,142 +1,351 @@
 package proxy
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/brandoyts/api-gateway/api-gateway/config"
 	"github.com/brandoyts/api-gateway/internal/telemetry"
-	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProxyHandler struct {
 	Telemetry telemetry.TelemetryProvider
-	Routes    map[string]url.URL
 	Client    *http.Client
+	// GrpcClient sends the requests of gRPC routes, over HTTP/2 only
+	GrpcClient *http.Client
+	// RequestTimeout bounds each attempt from sending the request until the
+	// response has been read. Streamed responses are exempt once their headers arrive.
+	RequestTimeout time.Duration
+
+	// routes is swapped as a whole on every change, routesMu serializes the writers
+	routes   atomic.Pointer[routingTable]
+	routesMu sync.Mutex
+
+	metrics     *proxyMetrics
+	retryBudget atomic.Pointer[retryBudget]
 }
 
 func NewProxyHandler(telemetryProvider telemetry.TelemetryProvider, requestTimeout time.Duration) *ProxyHandler {
-	return &ProxyHandler{
-		Telemetry: telemetryProvider,
-		Routes:    make(map[string]url.URL),
-		Client: &http.Client{
-			Timeout: requestTimeout,
-		},
+	p := &ProxyHandler{
+		Telemetry:      telemetryProvider,
+		Client:         &http.Client{},
+		GrpcClient:     &http.Client{Transport: newGrpcTransport()},
+		RequestTimeout: requestTimeout,
+		metrics:        newProxyMetrics(telemetryProvider),
+	}
+	table, _ := newRoutingTable(nil, 0)
+	p.routes.Store(table)
+	p.retryBudget.Store(newRetryBudget(config.RetryBudget{}))
+
+	return p
+}
+
+// SetRetryBudget replaces the gateway-wide retry budget.
+func (p *ProxyHandler) SetRetryBudget(budgetConfig config.RetryBudget) {
+	p.retryBudget.Store(newRetryBudget(budgetConfig))
+}
+
+// Routes returns the current routes by key, which is the prefix for routes
+// of the default host, see config.Route.Key. The map must not be modified.
+func (p *ProxyHandler) Routes() map[string]*Route {
+	return p.routes.Load().routes
+}
+
+// AddRoute adds a route to the routing table, replacing any route with the same key.
+func (p *ProxyHandler) AddRoute(routeConfig config.Route) error {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	route, err := p.buildRoute(routeConfig)
+	if err != nil {
+		return err
+	}
+
+	routes := maps.Clone(p.Routes())
+	routes[routeConfig.Key()] = route
+
+	err = p.swapRoutes(routes)
+	if err != nil {
+		route.close()
+		return err
+	}
+
+	return nil
+}
+
+// buildRoute creates a route and starts its background work.
+func (p *ProxyHandler) buildRoute(routeConfig config.Route) (*Route, error) {
+	route, err := newRoute(routeConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if routeConfig.HealthCheck != nil {
+		route.healthChecker = newHealthChecker(route, *routeConfig.HealthCheck, p.Telemetry, p.metrics)
+		route.healthChecker.start()
+	}
+
+	if routeConfig.CircuitBreaker != nil {
+		for _, backend := range route.Backends {
+			backend.breaker = p.newCircuitBreaker(route, backend, *routeConfig.CircuitBreaker)
+		}
 	}
+
+	if routeConfig.OutlierDetection != nil {
+		route.outlierDetector = newOutlierDetector(route, *routeConfig.OutlierDetection, p.Telemetry)
+	}
+
+	return route, nil
 }
 
-func (p *ProxyHandler) AddRoute(prefix string, backendUrl string) error {
-	target, err := url.ParseRequestURI(backendUrl)
+// swapRoutes installs a new routing table and stops the background work of
+// the routes it drops. Requests already in flight keep using the old table.
+// Nothing changes when the routes conflict. Must be called with routesMu held.
+func (p *ProxyHandler) swapRoutes(routes map[string]*Route) error {
+	previous := p.routes.Load()
+
+	table, err := newRoutingTable(routes, previous.version+1)
 	if err != nil {
 		return err
 	}
+	p.routes.Store(table)
 
-	p.Routes[prefix] = *target
+	for key, route := range previous.routes {
+		if routes[key] != route {
+			route.close()
+		}
+	}
 
 	return nil
 }
 
+// Close stops the background work of all routes, such as health checks.
+func (p *ProxyHandler) Close() {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	for _, route := range p.Routes() {
+		route.close()
+	}
+}
+
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
-	ctx, span := p.Telemetry.TraceStart(r.Context(), "api_gateway_request")
+	ctx, span := p.Telemetry.TraceStart(r.Context(), "api_gateway_request", trace.WithSpanKind(trace.SpanKindServer))
 	defer span.End()
 
+	requestID := ensureRequestID(r)
+	w.Header().Set(RequestIDHeader, requestID)
+
 	// Add request attributes to the span
+	span.SetAttributes(serverRequestAttributes(r)...)
+
+	match := p.routes.Load().match(r)
+
+	if match.route == nil && len(match.allowedMethods) > 0 {
+		p.failMethodNotAllowed(w, r, span, match.allowedMethods)
+		return
+	}
+
+	if match.route == nil {
+		p.Telemetry.LogErrorln(ErrServiceNotFound, r.URL.Path)
+		p.failRequest(w, r, span, nil, ErrServiceNotFound, http.StatusNotFound)
+		return
+	}
+
+	matchedRoute := match.route
+	span.SetAttributes(semconv.HTTPRoute(matchedRoute.Prefix))
+	if matchedRoute.grpc && isGrpcWebRequest(r) {
+		var web *grpcWebResponseWriter
+		web, r = translateGrpcWeb(w, r)
+		w = web
+		defer web.finish()
+		span.SetAttributes(attribute.Bool("gateway.grpc_web", true))
+	}
+	if matchedRoute.grpc && isGrpcRequest(r) {
+		span.SetAttributes(grpcMethodAttributes(r.URL.Path)...)
+	}
+
+	upstreamPath := matchedRoute.upstreamPathFor(match)
 	span.SetAttributes(
-		attribute.String("http.method", r.Method),
-		attribute.String("http.url", r.URL.String()),
-		attribute.String("http.path", r.URL.Path),
+		attribute.String("gateway.path.original", r.URL.Path),
+		attribute.String("gateway.path.rewritten", upstreamPath),
 	)
 
-	var targetUrl *url.URL
-	var longestPrefix string
+	if matchedRoute.composite != nil {
+		p.serveComposite(ctx, w, r, span, matchedRoute, match, upstreamPath)
+		return
+	}
 
-	for prefix, backendUrl := range p.Routes {
-		if len(prefix) > len(longestPrefix) && strings.HasPrefix(r.URL.Path, prefix) {
-			longestPrefix = prefix
-			targetUrl = &backendUrl
-		}
+	variant := matchedRoute.split.choose(r)
+	if variant != nil {
+		span.SetAttributes(attribute.String("gateway.variant", variant.name))
 	}
 
-	if targetUrl == nil {
-		p.Telemetry.LogErrorln(ErrServiceNotFound, r.URL.Path)
-		span.RecordError(ErrServiceNotFound)
-		span.SetStatus(codes.Error, ErrServiceNotFound.Error())
-		span.SetAttributes(
-			attribute.String("http.response.status_code", string(rune(http.StatusNotFound))),
-		)
-		http.Error(w, ErrServiceNotFound.Error(), http.StatusNotFound)
+	// JSON requests to a transcoding route become calls of the gRPC method bound to their path
+	if matchedRoute.transcoder != nil && !isGrpcRequest(r) {
+		p.serveTranscoded(ctx, w, r, span, matchedRoute, variant)
 		return
 	}
 
-	proxyRequest, err := p.createProxyRequest(r, targetUrl, longestPrefix)
+	var result *attemptResult
+	var err error
+	if isWebSocketRequest(r) {
+		result, err = p.upgrade(ctx, r, matchedRoute, variant, upstreamPath)
+	} else {
+		result, err = p.forward(ctx, r, matchedRoute, variant, upstreamPath)
+	}
+	p.recordVariant(ctx, variant, result, err)
 	if err != nil {
-		p.Telemetry.LogErrorln(ErrCreateProxyRequest, err)
-		span.RecordError(ErrCreateProxyRequest)
-		span.SetStatus(codes.Error, ErrCreateProxyRequest.Error())
-		span.SetAttributes(
-			attribute.String("http.response.status_code", string(rune(http.StatusInternalServerError))),
-		)
-		http.Error(w, ErrCreateProxyRequest.Error(), http.StatusInternalServerError)
+		p.failForward(w, r, span, matchedRoute, err)
 		return
 	}
+	defer result.close()
 
-	//  inject trace context into outbound request headers
-	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(proxyRequest.Header))
+	proxyResponse := result.response
+	span.SetAttributes(attribute.Int("gateway.attempts", result.attempt))
 
-	// send request to backend
-	proxyResponse, err := p.Client.Do(proxyRequest)
-	if err != nil {
-		p.Telemetry.LogErrorln(ErrBackendResponse, proxyRequest.URL.String(), err)
-		span.RecordError(ErrBackendResponse)
-		span.SetStatus(codes.Error, ErrBackendResponse.Error())
-		span.SetAttributes(
-			attribute.String("http.response.status_code", string(rune(http.StatusBadGateway))),
-		)
-		http.Error(w, ErrBackendResponse.Error(), http.StatusBadGateway)
+	if proxyResponse.StatusCode == http.StatusSwitchingProtocols {
+		p.tunnel(w, span, matchedRoute, result)
+		return
+	}
+
+	// replace mapped backend errors with a gateway generated response
+	if mapping, mapped := matchedRoute.errorMappings[proxyResponse.StatusCode]; mapped {
+		p.Telemetry.LogErrorf("backend %v answered %v, replied with %v", result.backend.Url.String(), proxyResponse.StatusCode, mapping.ReplaceStatus)
+		p.failRequest(w, r, span, matchedRoute, errors.New(mapping.Message), mapping.ReplaceStatus)
 		return
 	}
-	defer proxyResponse.Body.Close()
 
-	// copy headers from backend response
-	for key, values := range proxyResponse.Header {
+	// copy headers from backend response, except those of the backend connection
+	responseHeader := proxyResponse.Header.Clone()
+	removeHopByHopHeaders(responseHeader)
+	for key, values := range responseHeader {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
 
-	if proxyResponse.StatusCode >= http.StatusBadRequest {
-		p.Telemetry.LogErrorln(ErrRouteNotExist, r.URL.Path)
-		span.RecordError(ErrRouteNotExist)
-		span.SetStatus(codes.Error, ErrRouteNotExist.Error())
-		span.SetAttributes(
-			attribute.String("http.response.status_code", string(rune(http.StatusNotFound))),
-		)
-		http.Error(w, ErrRouteNotExist.Error(), http.StatusNotFound)
-		return
+	span.SetAttributes(semconv.HTTPResponseStatusCode(proxyResponse.StatusCode))
+	if proxyResponse.StatusCode >= http.StatusInternalServerError {
+		span.SetAttributes(errorTypeAttribute(proxyResponse.StatusCode, nil))
+		span.SetStatus(codes.Error, proxyResponse.Status)
 	}
 
 	w.WriteHeader(proxyResponse.StatusCode)
-	io.Copy(w, proxyResponse.Body)
+
+	// streams are exempt from the request timeout once their headers arrived
+	if matchedRoute.streaming.detects(proxyResponse) && result.stopTimeout() {
+		p.stream(w, r, span, matchedRoute, result)
+	} else {
+		io.Copy(w, proxyResponse.Body)
+	}
+
+	// trailers, such as the grpc-status of gRPC responses, are known once the body has been read
+	for key, values := range proxyResponse.Trailer {
+		for _, value := range values {
+			w.Header().Add(http.TrailerPrefix+key, value)
+		}
+	}
+
+	if matchedRoute.grpc {
+		recordGrpcStatus(span, result.span, proxyResponse)
+	}
 
 	p.Telemetry.LogInfof(
 		"Proxy request: %v %v -> %v, status: %v, latency: %v",
 		r.Method,
 		r.URL.Path,
-		targetUrl.String(),
+		result.backend.Url.String(),
 		proxyResponse.StatusCode,
 		time.Since(startTime),
 	)
 }
 
-func (p *ProxyHandler) createProxyRequest(r *http.Request, target *url.URL, prefix string) (*http.Request, error) {
+// failForward answers a request the backends of the route could not serve.
+func (p *ProxyHandler) failForward(w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, err error) {
+	var circuitErr *circuitOpenError
+
+	switch {
+	case errors.As(err, &circuitErr):
+		p.failCircuitOpen(w, r, span, route, circuitErr.retryAfter)
+	case errors.Is(err, ErrNoHealthyBackend):
+		p.Telemetry.LogErrorln(ErrNoHealthyBackend, route.Prefix)
+		p.failRequest(w, r, span, route, ErrNoHealthyBackend, http.StatusServiceUnavailable)
+	case errors.Is(err, ErrReadRequestBody):
+		p.Telemetry.LogErrorln(err)
+		p.failRequest(w, r, span, route, ErrReadRequestBody, http.StatusBadRequest)
+	case errors.Is(err, ErrCreateProxyRequest):
+		p.Telemetry.LogErrorln(err)
+		p.failRequest(w, r, span, route, ErrCreateProxyRequest, http.StatusInternalServerError)
+	default:
+		p.Telemetry.LogErrorln(ErrBackendResponse, err)
+		p.failRequest(w, r, span, route, ErrBackendResponse, http.StatusBadGateway)
+	}
+}
+
+// failRequest records a gateway generated error on the span and answers
+// the client with a problem response, rendered through the error template
+// of the route when it has one. route is nil when no route matched.
+func (p *ProxyHandler) failRequest(w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, err error, statusCode int) {
+	span.RecordError(err)
+	span.SetAttributes(semconv.HTTPResponseStatusCode(statusCode))
+
+	// client errors are not failures of the gateway span
+	if statusCode >= http.StatusInternalServerError {
+		span.SetAttributes(errorTypeAttribute(statusCode, nil))
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	// gRPC clients only understand errors in grpc-status
+	if isGrpcRequest(r) {
+		code := grpcCodeForStatus(statusCode)
+		span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(code))
+		writeGrpcError(w, code, err.Error())
+		return
+	}
+
+	problem := newProblem(r, span, err, statusCode)
+	if route != nil && route.errorTemplate != nil {
+		route.errorTemplate.write(w, problem)
+		return
+	}
+	writeProblem(w, problem)
+}
+
+// failCircuitOpen answers 503 with a Retry-After header when the circuit breakers of a route reject the request.
+func (p *ProxyHandler) failCircuitOpen(w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, retryAfter time.Duration) {
+	p.Telemetry.LogErrorln(ErrCircuitOpen, route.Prefix)
+	w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	p.failRequest(w, r, span, route, ErrCircuitOpen, http.StatusServiceUnavailable)
+}
+
+// failMethodNotAllowed answers 405 with an Allow header when routes match the request in all but its method.
+func (p *ProxyHandler) failMethodNotAllowed(w http.ResponseWriter, r *http.Request, span trace.Span, allowedMethods map[string]bool) {
+	allow := slices.Sorted(maps.Keys(allowedMethods))
+
+	p.Telemetry.LogErrorln(ErrMethodNotAllowed, r.Method, r.URL.Path)
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	p.failRequest(w, r, span, nil, ErrMethodNotAllowed, http.StatusMethodNotAllowed)
+}
+
+// createProxyRequest builds the request to the backend at target for the
+// given upstream path, keeping the query string of r.
+func (p *ProxyHandler) createProxyRequest(r *http.Request, target *url.URL, upstreamPath string) (*http.Request, error) {
 	if r.URL == nil {
 		return nil, fmt.Errorf("request URL is nil")
 	}
@@ -144,14 +353,23 @@ func (p *ProxyHandler) createProxyRequest(r *http.Request, target *url.URL, pref
 	outUrl := *r.URL
 	outUrl.Scheme = target.Scheme
 	outUrl.Host = target.Host
-	outUrl.Path = strings.TrimPrefix(outUrl.Path, prefix)
+	// a rewrite can add query parameters, which go before those of the client
+	path, query, rewritesQuery := strings.Cut(upstreamPath, "?")
+	outUrl.Path = path
+	outUrl.RawPath = ""
+	if rewritesQuery {
+		outUrl.RawQuery = joinQuery(query, outUrl.RawQuery)
+	}
 
 	outRequest, err := http.NewRequestWithContext(r.Context(), r.Method, outUrl.String(), r.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	outRequest.Header = r.Header
+	outRequest.ContentLength = r.ContentLength
+	// headers that apply to the connection of the client are not forwarded
+	outRequest.Header = r.Header.Clone()
+	removeHopByHopHeaders(outRequest.Header)
 
 	outRequest.Header.Set("X-Forwarded-For", r.RemoteAddr)
 	outRequest.Header.Set("X-Forwarded-Host", r.Host)
@@ -160,3 +378,14 @@ func (p *ProxyHandler) createProxyRequest(r *http.Request, target *url.URL, pref
 
 	return outRequest, nil
 }
+
+func joinQuery(queries ...string) string {
+	nonEmpty := make([]string, 0, len(queries))
+	for _, query := range queries {
+		if query != "" {
+			nonEmpty = append(nonEmpty, query)
+		}
+	}
+
+	return strings.Join(nonEmpty, "&")
+}
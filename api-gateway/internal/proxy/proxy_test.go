@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"io"
 	"net"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/brandoyts/api-gateway/api-gateway/config"
 	"github.com/brandoyts/api-gateway/internal/telemetry"
 	"github.com/stretchr/testify/assert"
 )
@@ -26,6 +28,16 @@ func newTestProxyHandler(t *testing.T, timeout time.Duration) *ProxyHandler {
 	return NewProxyHandler(telem, timeout)
 }
 
+func newTestRouteConfig(prefix string, backendUrls ...string) config.Route {
+	routeConfig := config.Route{Prefix: prefix}
+
+	for _, backendUrl := range backendUrls {
+		routeConfig.Backends = append(routeConfig.Backends, config.Backend{Url: backendUrl})
+	}
+
+	return routeConfig
+}
+
 func TestAddRoute(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -46,20 +58,79 @@ func TestAddRoute(t *testing.T) {
 			t.Parallel()
 
 			proxyHandler := newTestProxyHandler(t, 10*time.Second)
-			err := proxyHandler.AddRoute(tc.prefix, tc.url)
+			err := proxyHandler.AddRoute(newTestRouteConfig(tc.prefix, tc.url))
 
 			if tc.expectToFail {
 				assert.Error(t, err)
 			} else {
 				assert.NoError(t, err)
-				storedURL, exists := proxyHandler.Routes[tc.prefix]
+				storedRoute, exists := proxyHandler.Routes()[tc.prefix]
 				assert.True(t, exists)
-				assert.Equal(t, tc.url, storedURL.String())
+				assert.Equal(t, tc.url, storedRoute.Backends[0].Url.String())
 			}
 		})
 	}
 }
 
+func TestAddRoute_MultipleBackends(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 10*time.Second)
+
+	err := proxyHandler.AddRoute(config.Route{
+		Prefix:       "/user",
+		LoadBalancer: LoadBalancerWeighted,
+		Backends: []config.Backend{
+			{Url: "http://user-1:6001", Weight: 3},
+			{Url: "http://user-2:6001"},
+		},
+	})
+	assert.NoError(t, err)
+
+	route := proxyHandler.Routes()["/user"]
+	assert.Len(t, route.Backends, 2)
+	assert.Equal(t, 3, route.Backends[0].Weight)
+	assert.Equal(t, 1, route.Backends[1].Weight, "missing weight defaults to 1")
+	assert.IsType(t, &weightedBalancer{}, route.Balancer)
+}
+
+func TestAddRoute_InvalidRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 10*time.Second)
+
+	err := proxyHandler.AddRoute(config.Route{Prefix: "/empty"})
+	assert.ErrorIs(t, err, ErrNoBackends)
+
+	err = proxyHandler.AddRoute(config.Route{
+		Prefix:       "/user",
+		LoadBalancer: "fastest",
+		Backends:     []config.Backend{{Url: "http://user:6001"}},
+	})
+	assert.ErrorIs(t, err, ErrUnknownLoadBalancer)
+}
+
+func TestServeHTTP_SpreadsAcrossBackends(t *testing.T) {
+	hits := make(map[string]int)
+	var backendUrls []string
+
+	for _, name := range []string{"a", "b"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		defer backend.Close()
+		backendUrls = append(backendUrls, backend.URL)
+	}
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/api", backendUrls...))
+
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hello", nil))
+		hits[rr.Body.String()]++
+	}
+
+	assert.Equal(t, map[string]int{"a": 2, "b": 2}, hits)
+}
+
 func TestServeHTTP_NoRouteFound(t *testing.T) {
 	proxyHandler := newTestProxyHandler(t, 5*time.Second)
 
@@ -81,16 +152,84 @@ func TestServeHTTP_BackendSuccess(t *testing.T) {
 	defer backend.Close()
 
 	proxyHandler := newTestProxyHandler(t, 5*time.Second)
-	_ = proxyHandler.AddRoute("/api", backend.URL)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/api", backend.URL))
 
 	req := httptest.NewRequest(http.MethodGet, "/api/hello", nil)
 	rr := httptest.NewRecorder()
 
 	proxyHandler.ServeHTTP(rr, req)
 
-	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, http.StatusTeapot, rr.Code)
 	assert.Equal(t, "ok", rr.Header().Get("X-Test"))
-	assert.Equal(t, "route not exists\n", rr.Body.String())
+	assert.Equal(t, "backend says hi", rr.Body.String())
+}
+
+func TestServeHTTP_BackendErrorsPassThrough(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"error":"email is required"}`))
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/user", backend.URL))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/user/profile", nil))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error":"email is required"}`, rr.Body.String())
+}
+
+func TestServeHTTP_ErrorMappings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal", "stack trace id")
+		switch r.URL.Path {
+		case "/crash":
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte("panic: nil map"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.ErrorMappings = []config.ErrorMapping{
+		{Status: http.StatusInternalServerError, ReplaceStatus: http.StatusBadGateway, Message: "order service failed"},
+		{Status: http.StatusNotFound},
+	}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	tests := []struct {
+		path             string
+		expectedCode     int
+		expectedDetail   string
+		expectedInternal string
+	}{
+		{"/order/crash", http.StatusBadGateway, "order service failed", ""},
+		{"/order/missing", http.StatusNotFound, "Not Found", ""},
+		{"/order/private", http.StatusUnauthorized, "", "stack trace id"},
+	}
+
+	for _, tc := range tests {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+		assert.Equal(t, tc.expectedCode, rr.Code, tc.path)
+		assert.Equal(t, tc.expectedInternal, rr.Header().Get("X-Internal"), tc.path)
+
+		if tc.expectedDetail != "" {
+			var problem Problem
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &problem))
+			assert.Equal(t, tc.expectedDetail, problem.Detail, tc.path)
+		}
+	}
 }
 
 func TestServeHTTP_BackendError(t *testing.T) {
@@ -98,7 +237,7 @@ func TestServeHTTP_BackendError(t *testing.T) {
 	badURL := "http://127.0.0.1:65534"
 
 	proxyHandler := newTestProxyHandler(t, 2*time.Second)
-	_ = proxyHandler.AddRoute("/fail", badURL)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/fail", badURL))
 
 	req := httptest.NewRequest(http.MethodGet, "/fail/boom", nil)
 	rr := httptest.NewRecorder()
@@ -116,18 +255,67 @@ func TestCreateProxyRequest_RewritesCorrectly(t *testing.T) {
 	body := io.NopCloser(bytes.NewBufferString("test-body"))
 	req := httptest.NewRequest(http.MethodPost, "/api/v1/resource", body)
 	req.RemoteAddr = net.JoinHostPort("127.0.0.1", "12345")
+	req.Header.Set("X-Custom", "value")
 
-	outReq, err := proxyHandler.createProxyRequest(req, target, "/api")
+	outReq, err := proxyHandler.createProxyRequest(req, target, "/v1/resource")
 	assert.NoError(t, err)
 
 	assert.Equal(t, "http://backend:9000/v1/resource", outReq.URL.String())
 	assert.Equal(t, req.Method, outReq.Method)
 
-	assert.Equal(t, req.Header, outReq.Header)
+	assert.Equal(t, "value", outReq.Header.Get("X-Custom"))
+	// the headers of the client request are left as they are
+	assert.Empty(t, req.Header.Get("X-Forwarded-For"))
 	assert.Equal(t, "127.0.0.1:12345", outReq.Header.Get("X-Forwarded-For"))
 	assert.Equal(t, req.Host, outReq.Header.Get("X-Forwarded-Host"))
 }
 
+func TestCreateProxyRequest_RemovesHopByHopHeaders(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	target, _ := url.Parse("http://backend:9000")
+
+	req := httptest.NewRequest(http.MethodGet, "/api", nil)
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Authorization", "Basic c2VjcmV0")
+	req.Header.Set("Te", "gzip")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("X-End-To-End", "1")
+
+	outReq, err := proxyHandler.createProxyRequest(req, target, "/api")
+	assert.NoError(t, err)
+
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authorization", "Te", "X-Client-Hop"} {
+		assert.Empty(t, outReq.Header.Values(name), name)
+	}
+	assert.Equal(t, "1", outReq.Header.Get("X-End-To-End"))
+	assert.Equal(t, "timeout=5", req.Header.Get("Keep-Alive"))
+}
+
+func TestServeHTTP_RemovesHopByHopResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("X-End-To-End", "1")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/api", backend.URL)))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "X-Backend-Hop"} {
+		assert.Empty(t, rr.Header().Values(name), name)
+	}
+	assert.Equal(t, "1", rr.Header().Get("X-End-To-End"))
+}
+
 func TestCreateProxyRequest_InvalidURL(t *testing.T) {
 	proxyHandler := newTestProxyHandler(t, 5*time.Second)
 
@@ -137,7 +325,7 @@ func TestCreateProxyRequest_InvalidURL(t *testing.T) {
 	}
 
 	target, _ := url.Parse("http://backend:9000")
-	_, err := proxyHandler.createProxyRequest(badReq, target, "/api")
+	_, err := proxyHandler.createProxyRequest(badReq, target, "/")
 
 	assert.Error(t, err)
 }
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ReplaceRoutes atomically replaces the whole routing table. Either every
+// route is built and installed, or the current table is left untouched.
+// Routes whose configuration did not change keep running as they are.
+func (p *ProxyHandler) ReplaceRoutes(routeConfigs []config.Route) error {
+	err := config.ValidateRoutes(routeConfigs)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.changeRoutes(nil, func(configs map[string]config.Route) error {
+		clear(configs)
+		for _, routeConfig := range routeConfigs {
+			configs[routeConfig.Key()] = routeConfig
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Reload reads the configuration file at path, validates it and swaps in
+// its routes and retry budget. Settings such as the listen address need a
+// restart to change. The outcome is logged and counted.
+func (p *ProxyHandler) Reload(path string) error {
+	err := p.reload(path)
+
+	result := "success"
+	if err != nil {
+		result = "failure"
+		p.Telemetry.LogErrorf("failed to reload gateway configuration from %v: %v", path, err)
+	} else {
+		p.Telemetry.LogInfof("reloaded gateway configuration from %v", path)
+	}
+
+	p.metrics.configReloads.Add(context.Background(), 1, metric.WithAttributes(attribute.String("result", result)))
+
+	return err
+}
+
+func (p *ProxyHandler) reload(path string) error {
+	gatewayConfiguration, err := config.LoadGatewayConfiguration(path)
+	if err != nil {
+		return err
+	}
+
+	err = p.ReplaceRoutes(gatewayConfiguration.AllRoutes())
+	if err != nil {
+		return err
+	}
+
+	retryBudget := config.RetryBudget{}
+	if gatewayConfiguration.RetryBudget != nil {
+		retryBudget = *gatewayConfiguration.RetryBudget
+	}
+	p.SetRetryBudget(retryBudget)
+
+	return nil
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "gatewayConfig.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	return path
+}
+
+func TestReload_SwapsRoutes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("order"))
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/user", "http://127.0.0.1:65534"))
+
+	path := writeTestConfig(t, `
+listenAddress: ":8080"
+routes:
+  - name: order
+    prefix: /order
+    backends:
+      - url: `+backend.URL+`
+`)
+
+	assert.NoError(t, proxyHandler.Reload(path))
+
+	routes := proxyHandler.Routes()
+	assert.Len(t, routes, 1)
+	assert.Contains(t, routes, "/order")
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/order/1", nil))
+	assert.Equal(t, "order", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/user/1", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestReload_InvalidConfigKeepsRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/user", "http://user:6001"))
+	before := proxyHandler.Routes()
+
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing backends", "listenAddress: \":8080\"\nroutes:\n  - prefix: /order\n"},
+		{"unknown load balancer", "listenAddress: \":8080\"\nroutes:\n  - prefix: /order\n    loadBalancer: fastest\n    backends:\n      - url: http://order:6002\n"},
+		{"unparsable yaml", "routes: [\n"},
+	}
+
+	for _, tc := range tests {
+		err := proxyHandler.Reload(writeTestConfig(t, tc.content))
+		assert.Error(t, err, tc.name)
+		assert.Equal(t, before, proxyHandler.Routes(), tc.name)
+	}
+
+	assert.ErrorIs(t, proxyHandler.Reload(filepath.Join(t.TempDir(), "missing.yml")), os.ErrNotExist)
+}
+
+func TestReplaceRoutes_ClosesDroppedRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	routeConfig := newTestRouteConfig("/user", "http://127.0.0.1:65534")
+	routeConfig.HealthCheck = &config.HealthCheck{Interval: time.Hour}
+	_ = proxyHandler.AddRoute(routeConfig)
+	dropped := proxyHandler.Routes()["/user"]
+
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{newTestRouteConfig("/order", "http://order:6002")}))
+
+	stopped := make(chan struct{})
+	go func() {
+		dropped.healthChecker.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("health checker of the dropped route is still running")
+	}
+}
+
+func TestReplaceRoutes_ConcurrentRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	_ = proxyHandler.AddRoute(newTestRouteConfig("/api", backend.URL))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				rr := httptest.NewRecorder()
+				proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/ping", nil))
+				assert.Equal(t, http.StatusNoContent, rr.Code)
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{newTestRouteConfig("/api", backend.URL)}))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,283 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+// Network error kinds a retry policy can retry on.
+const (
+	RetryOnConnectFailure = "connectFailure"
+	RetryOnReset          = "reset"
+	RetryOnTimeout        = "timeout"
+)
+
+const (
+	defaultRetryMaxAttempts  = 3
+	defaultRetryBaseBackoff  = 25 * time.Millisecond
+	defaultRetryMaxBackoff   = 250 * time.Millisecond
+	defaultRetryMaxBodyBytes = 64 << 10
+
+	defaultRetryBudgetRatio               = 0.2
+	defaultRetryBudgetMinRetriesPerSecond = 10
+	defaultRetryBudgetWindow              = 10 * time.Second
+)
+
+var (
+	defaultRetryMethods     = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+	defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	defaultRetryOn          = []string{RetryOnConnectFailure, RetryOnReset}
+)
+
+// retryPolicy decides whether a failed attempt of a route is sent again.
+type retryPolicy struct {
+	config config.RetryPolicy
+}
+
+func newRetryPolicy(retryConfig config.RetryPolicy) *retryPolicy {
+	if retryConfig.MaxAttempts <= 0 {
+		retryConfig.MaxAttempts = defaultRetryMaxAttempts
+	}
+	if len(retryConfig.Methods) == 0 {
+		retryConfig.Methods = defaultRetryMethods
+	}
+	if len(retryConfig.StatusCodes) == 0 {
+		retryConfig.StatusCodes = defaultRetryStatusCodes
+	}
+	if len(retryConfig.RetryOn) == 0 {
+		retryConfig.RetryOn = defaultRetryOn
+	}
+	if retryConfig.BaseBackoff <= 0 {
+		retryConfig.BaseBackoff = defaultRetryBaseBackoff
+	}
+	if retryConfig.MaxBackoff <= 0 {
+		retryConfig.MaxBackoff = defaultRetryMaxBackoff
+	}
+	if retryConfig.MaxBodyBytes <= 0 {
+		retryConfig.MaxBodyBytes = defaultRetryMaxBodyBytes
+	}
+
+	methods := make([]string, 0, len(retryConfig.Methods))
+	for _, method := range retryConfig.Methods {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	retryConfig.Methods = methods
+
+	return &retryPolicy{config: retryConfig}
+}
+
+// maxAttempts returns how many times a request may be sent.
+func (rp *retryPolicy) maxAttempts(method string) int {
+	if rp == nil || !slices.Contains(rp.config.Methods, method) {
+		return 1
+	}
+
+	return rp.config.MaxAttempts
+}
+
+// maxBodyBytes returns the largest request body buffered for replay.
+func (rp *retryPolicy) maxBodyBytes() int64 {
+	if rp == nil {
+		return defaultRetryMaxBodyBytes
+	}
+
+	return rp.config.MaxBodyBytes
+}
+
+// retryableStatus reports whether a backend response status is worth another attempt.
+func (rp *retryPolicy) retryableStatus(statusCode int) bool {
+	return slices.Contains(rp.config.StatusCodes, statusCode)
+}
+
+// retryableError reports whether a transport error is one of the configured kinds.
+func (rp *retryPolicy) retryableError(err error) bool {
+	kind := networkErrorKind(err)
+	return kind != "" && slices.Contains(rp.config.RetryOn, kind)
+}
+
+// backoff returns the delay before the given retry, using exponential
+// backoff with full jitter.
+func (rp *retryPolicy) backoff(retry int) time.Duration {
+	ceiling := rp.config.BaseBackoff << (retry - 1)
+	if ceiling <= 0 || ceiling > rp.config.MaxBackoff {
+		ceiling = rp.config.MaxBackoff
+	}
+
+	return rand.N(ceiling + 1)
+}
+
+// networkErrorKind classifies a transport error into one of the retryOn kinds.
+func networkErrorKind(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return RetryOnConnectFailure
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return RetryOnConnectFailure
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return RetryOnReset
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return RetryOnTimeout
+	}
+
+	return ""
+}
+
+// sleepContext waits for the given duration or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// requestBody holds a request body so that it can be sent more than once.
+// Bodies larger than the buffer limit are streamed and cannot be replayed.
+type requestBody struct {
+	buffered   []byte
+	rest       io.ReadCloser
+	replayable bool
+}
+
+// bufferRequestBody reads up to maxBytes of the request body into memory.
+func bufferRequestBody(r *http.Request, maxBytes int64) (*requestBody, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return &requestBody{replayable: true}, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(buffered)) > maxBytes {
+		return &requestBody{buffered: buffered, rest: r.Body}, nil
+	}
+
+	return &requestBody{buffered: buffered, replayable: true}, nil
+}
+
+// reader returns a fresh reader over the body.
+func (b *requestBody) reader() io.ReadCloser {
+	if b.rest != nil {
+		if len(b.buffered) == 0 {
+			return b.rest
+		}
+
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(b.buffered), b.rest), b.rest}
+	}
+
+	if b.buffered == nil {
+		return http.NoBody
+	}
+
+	return io.NopCloser(bytes.NewReader(b.buffered))
+}
+
+// retryBudget limits retries across the whole gateway to a ratio of the
+// requests seen in a sliding window, plus a small fixed allowance, so that
+// a failing backend cannot trigger a retry storm.
+type retryBudget struct {
+	config config.RetryBudget
+
+	mu       sync.Mutex
+	buckets  []retryBudgetBucket
+	interval time.Duration
+}
+
+type retryBudgetBucket struct {
+	start    time.Time
+	requests int
+	retries  int
+}
+
+const retryBudgetBuckets = 10
+
+func newRetryBudget(budgetConfig config.RetryBudget) *retryBudget {
+	if budgetConfig.Ratio <= 0 {
+		budgetConfig.Ratio = defaultRetryBudgetRatio
+	}
+	if budgetConfig.MinRetriesPerSecond <= 0 {
+		budgetConfig.MinRetriesPerSecond = defaultRetryBudgetMinRetriesPerSecond
+	}
+	if budgetConfig.Window <= 0 {
+		budgetConfig.Window = defaultRetryBudgetWindow
+	}
+
+	return &retryBudget{
+		config:  budgetConfig,
+		buckets: make([]retryBudgetBucket, retryBudgetBuckets),
+		// windows under retryBudgetBuckets nanoseconds still get buckets of a nanosecond
+		interval: max(budgetConfig.Window/retryBudgetBuckets, time.Nanosecond),
+	}
+}
+
+// recordRequest counts an incoming request towards the budget.
+func (b *retryBudget) recordRequest(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bucket(now).requests++
+}
+
+// withdraw reports whether a retry fits in the budget, and counts it if so.
+func (b *retryBudget) withdraw(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := b.bucket(now)
+
+	requests, retries := 0, 0
+	for _, bucket := range b.buckets {
+		if now.Sub(bucket.start) < b.config.Window {
+			requests += bucket.requests
+			retries += bucket.retries
+		}
+	}
+
+	allowance := b.config.Ratio*float64(requests) + float64(b.config.MinRetriesPerSecond)*b.config.Window.Seconds()
+	if float64(retries+1) > allowance {
+		return false
+	}
+
+	current.retries++
+	return true
+}
+
+// bucket returns the bucket for the given time, resetting it if it is stale. Must be called with mu held.
+func (b *retryBudget) bucket(now time.Time) *retryBudgetBucket {
+	start := now.Truncate(b.interval)
+	bucket := &b.buckets[int(start.UnixNano()/int64(b.interval))%len(b.buckets)]
+
+	if !bucket.start.Equal(start) {
+		*bucket = retryBudgetBucket{start: start}
+	}
+
+	return bucket
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeHTTP_RetriesOnAnotherBackendWithReplayedBody(t *testing.T) {
+	var failingHits atomic.Int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		_, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte("got " + string(body)))
+	}))
+	defer healthy.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/api", failing.URL, healthy.URL)
+	routeConfig.Retry = &config.RetryPolicy{MaxAttempts: 2, BaseBackoff: time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/api/profile", strings.NewReader("payload")))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "got payload", rr.Body.String())
+	assert.Equal(t, int32(1), failingHits.Load())
+}
+
+func TestServeHTTP_RetriesConnectFailures(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer healthy.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/api", "http://127.0.0.1:65534", healthy.URL)
+	routeConfig.Retry = &config.RetryPolicy{BaseBackoff: time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/profile", nil))
+		assert.Equal(t, "ok", rr.Body.String())
+	}
+}
+
+func TestServeHTTP_DoesNotRetryNonIdempotentMethods(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/api", backend.URL)
+	routeConfig.Retry = &config.RetryPolicy{MaxAttempts: 3, BaseBackoff: time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/api/create", strings.NewReader("order")))
+	assert.Equal(t, int32(1), hits.Load())
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/create", nil))
+	assert.Equal(t, int32(4), hits.Load())
+}
+
+func TestServeHTTP_DoesNotRetryOversizedBodies(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write(body)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/api", backend.URL)
+	routeConfig.Retry = &config.RetryPolicy{MaxBodyBytes: 4, BaseBackoff: time.Millisecond}
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/api/profile", strings.NewReader("too large")))
+	assert.Equal(t, int32(1), hits.Load())
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := newRetryPolicy(config.RetryPolicy{BaseBackoff: 10 * time.Millisecond, MaxBackoff: 35 * time.Millisecond})
+
+	for i := 0; i < 50; i++ {
+		assert.LessOrEqual(t, policy.backoff(1), 10*time.Millisecond)
+		assert.LessOrEqual(t, policy.backoff(2), 20*time.Millisecond)
+		assert.LessOrEqual(t, policy.backoff(5), 35*time.Millisecond)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	budget := newRetryBudget(config.RetryBudget{Ratio: 0.5, MinRetriesPerSecond: 1, Window: time.Second})
+	now := time.Now()
+
+	// the fixed allowance is one retry per second of window
+	assert.True(t, budget.withdraw(now))
+	assert.False(t, budget.withdraw(now))
+
+	for i := 0; i < 4; i++ {
+		budget.recordRequest(now)
+	}
+	assert.True(t, budget.withdraw(now))
+	assert.True(t, budget.withdraw(now))
+	assert.False(t, budget.withdraw(now))
+
+	// retries leave the budget once the window has passed
+	assert.True(t, budget.withdraw(now.Add(2*time.Second)))
+}
+
+func TestRetryBudget_TinyWindow(t *testing.T) {
+	budget := newRetryBudget(config.RetryBudget{Ratio: 1, Window: 5 * time.Nanosecond})
+	now := time.Now()
+
+	assert.NotPanics(t, func() {
+		budget.recordRequest(now)
+		assert.True(t, budget.withdraw(now))
+	})
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+// pathRewrite turns the request path into the path sent to the backends of
+// a route. Without a prefix replacement or regex the part of the path
+// matched by the route is stripped.
+type pathRewrite struct {
+	replacePrefix *pathTemplate
+	regex         *regexp.Regexp
+	replacement   string
+	basePath      string
+}
+
+func newPathRewrite(rewriteConfig config.PathRewrite, pattern routePattern) (*pathRewrite, error) {
+	rewrite := &pathRewrite{
+		replacement: rewriteConfig.Replacement,
+		basePath:    strings.TrimSuffix(rewriteConfig.BasePath, "/"),
+	}
+
+	if rewriteConfig.ReplacePrefix != "" {
+		template, err := parsePathTemplate(rewriteConfig.ReplacePrefix, pattern)
+		if err != nil {
+			return nil, err
+		}
+		rewrite.replacePrefix = template
+	}
+
+	if rewriteConfig.Regex != "" {
+		// anchored, so the replacement describes the whole upstream path
+		regex, err := regexp.Compile("^(?:" + rewriteConfig.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidRewrite, err)
+		}
+		rewrite.regex = regex
+	}
+
+	if rewrite.basePath != "" && !strings.HasPrefix(rewrite.basePath, "/") {
+		return nil, fmt.Errorf("%w: base path %q must start with /", ErrInvalidRewrite, rewriteConfig.BasePath)
+	}
+
+	return rewrite, nil
+}
+
+// upstreamPathFor returns the path, and possibly a query, to request from
+// the backend. A matching regex rewrites the whole path. Otherwise the
+// matched part of the path is stripped, or replaced with the replace prefix
+// when there is one; exact and wildcard routes have nothing left below the
+// match. The base path is prepended last.
+func (r *Route) upstreamPathFor(match *routeMatch) string {
+	// the path of a gRPC call names the method, so it is never stripped
+	if r.grpc {
+		return match.path
+	}
+
+	rewrite := r.rewrite
+	if rewrite == nil {
+		return match.rest
+	}
+
+	var path string
+
+	switch {
+	case rewrite.regex != nil && rewrite.regex.MatchString(match.path):
+		path = rewrite.regex.ReplaceAllString(match.path, rewrite.replacement)
+	case rewrite.replacePrefix != nil:
+		path = rewrite.replacePrefix.expand(match.params)
+		if r.pattern.kind() == matchPrefix {
+			path += match.rest
+		}
+	default:
+		path = match.rest
+	}
+
+	if rewrite.basePath != "" {
+		if path != "" && !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "?") {
+			path = "/" + path
+		}
+		path = rewrite.basePath + path
+	}
+
+	return path
+}
+
+// pathTemplate is an upstream path with {name} placeholders that are
+// replaced with the parameters captured by the route pattern.
+type pathTemplate struct {
+	// literals surround the placeholders, so there is one more literal than params
+	literals []string
+	params   []int
+}
+
+func parsePathTemplate(template string, pattern routePattern) (*pathTemplate, error) {
+	parsed := &pathTemplate{}
+
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			parsed.literals = append(parsed.literals, template)
+			return parsed, nil
+		}
+
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("%w: unclosed placeholder in upstream path %q", ErrInvalidRewrite, template)
+		}
+		end += start
+
+		name := template[start+1 : end]
+		index := -1
+		for i, paramName := range pattern.paramNames {
+			if paramName == name {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("%w: upstream path uses unknown parameter %q", ErrInvalidRewrite, name)
+		}
+
+		parsed.literals = append(parsed.literals, template[:start])
+		parsed.params = append(parsed.params, index)
+		template = template[end+1:]
+	}
+}
+
+func (t *pathTemplate) expand(params []string) string {
+	var path strings.Builder
+
+	for i, literal := range t.literals {
+		path.WriteString(literal)
+		if i < len(t.params) {
+			path.WriteString(params[t.params[i]])
+		}
+	}
+
+	return path.String()
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamPathFor(t *testing.T) {
+	table := newTestRoutingTable(t,
+		config.Route{Prefix: "/v2/users/:id", Rewrite: &config.PathRewrite{ReplacePrefix: "/accounts/{id}"}},
+		config.Route{Prefix: "/assets/*file", Rewrite: &config.PathRewrite{ReplacePrefix: "/static/{file}"}},
+		config.Route{Prefix: "/orders/:id", Exact: true, Rewrite: &config.PathRewrite{ReplacePrefix: "/order/{id}"}},
+		config.Route{Prefix: "/user"},
+		config.Route{Prefix: "/v1/user", Rewrite: &config.PathRewrite{ReplacePrefix: "/legacy"}},
+		config.Route{Prefix: "/legacy", Rewrite: &config.PathRewrite{Regex: `/legacy/users/(\d+)`, Replacement: "/profile?id=$1"}},
+		config.Route{Prefix: "/v3", Rewrite: &config.PathRewrite{Regex: `/v3/(?P<kind>\w+)/(?P<id>\d+)`, Replacement: "/${kind}s/${id}", BasePath: "/api/"}},
+		config.Route{Prefix: "/billing", Rewrite: &config.PathRewrite{BasePath: "/internal/billing"}},
+	)
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/v2/users/42", "/accounts/42"},
+		{"/v2/users/42/avatar", "/accounts/42/avatar"},
+		{"/assets/img/logo.png", "/static/img/logo.png"},
+		{"/orders/7", "/order/7"},
+		{"/user/profile", "/profile"},
+		{"/v1/user/profile", "/legacy/profile"},
+		{"/legacy/users/42", "/profile?id=42"},
+		{"/legacy/users", "/users"},
+		{"/legacy/users/abc", "/users/abc"},
+		{"/legacy/users/42/", "/users/42/"},
+		{"/v3/order/9", "/api/orders/9"},
+		{"/v3/order/x", "/api/order/x"},
+		{"/billing/invoices", "/internal/billing/invoices"},
+		{"/billing", "/internal/billing"},
+	}
+
+	for _, tc := range tests {
+		match := table.match(newMatchRequest("", tc.path))
+		if assert.NotNil(t, match.route, tc.path) {
+			assert.Equal(t, tc.expected, match.route.upstreamPathFor(match), tc.path)
+		}
+	}
+}
+
+func TestNewPathRewrite_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		rewrite config.PathRewrite
+	}{
+		{"unknown parameter", config.PathRewrite{ReplacePrefix: "/accounts/{userId}"}},
+		{"unclosed placeholder", config.PathRewrite{ReplacePrefix: "/accounts/{id"}},
+		{"invalid regex", config.PathRewrite{Regex: "/users/(\\d+", Replacement: "/profile"}},
+		{"relative base path", config.PathRewrite{BasePath: "internal"}},
+	}
+
+	for _, tc := range tests {
+		rewrite := tc.rewrite
+		_, err := newRoute(config.Route{Prefix: "/users/:id", Rewrite: &rewrite, Backends: []config.Backend{{Url: "http://user:6001"}}})
+		assert.ErrorIs(t, err, ErrInvalidRewrite, tc.name)
+	}
+}
+
+func TestServeHTTP_RegexRewriteKeepsQuery(t *testing.T) {
+	var receivedPath, receivedQuery string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		receivedQuery = r.URL.RawQuery
+	}))
+	defer backend.Close()
+
+	telemetryProvider := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telemetryProvider, 5*time.Second)
+
+	routeConfig := newTestRouteConfig("/v2", backend.URL)
+	routeConfig.Rewrite = &config.PathRewrite{Regex: `/v2/users/(\d+)`, Replacement: "/profile?id=$1"}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v2/users/42?fields=name", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/profile", receivedPath)
+	assert.Equal(t, "id=42&fields=name", receivedQuery)
+
+	attributes := spanAttributeMap(telemetryProvider.endedSpan("api_gateway_request"))
+	assert.Equal(t, "/v2/users/42", attributes["gateway.path.original"].AsString())
+	assert.Equal(t, "/profile?id=42", attributes["gateway.path.rewritten"].AsString())
+}
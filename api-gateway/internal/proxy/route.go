@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+// Backend is a single upstream target of a route.
+type Backend struct {
+	Url    *url.URL
+	Weight int
+
+	activeConnections atomic.Int64
+	healthy           atomic.Bool
+	ejectedUntil      atomic.Int64
+	breaker           *circuitBreaker
+	// variant is the split variant the backend belongs to, if any
+	variant *splitVariant
+
+	// probe counters, owned by the route's health checker
+	consecutiveProbeSuccesses int
+	consecutiveProbeFailures  int
+
+	// passive failure counters, guarded by the route's outlier detector
+	consecutiveErrors int
+	ejectionCount     int
+}
+
+// ActiveConnections returns the number of requests currently in flight to the backend.
+func (b *Backend) ActiveConnections() int64 {
+	return b.activeConnections.Load()
+}
+
+// Healthy reports whether the backend is passing its health checks.
+// Backends of routes without health checks are always healthy.
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+// Ejected reports whether outlier detection has taken the backend out of rotation at the given time.
+func (b *Backend) Ejected(now time.Time) bool {
+	return now.UnixNano() < b.ejectedUntil.Load()
+}
+
+// attemptOutcome classifies the result of a proxied request for outlier detection and circuit breaking.
+type attemptOutcome int
+
+const (
+	outcomeSuccess attemptOutcome = iota
+	outcomeFailure
+	// outcomeCancelled is a request abandoned by the client, which says nothing about the backend.
+	outcomeCancelled
+)
+
+// Route is a prefix served by a pool of backends.
+type Route struct {
+	Name     string
+	Prefix   string
+	Backends []*Backend
+	Balancer Balancer
+
+	healthChecker   *healthChecker
+	outlierDetector *outlierDetector
+	retryPolicy     *retryPolicy
+	hedgingPolicy   *hedgingPolicy
+	errorMappings   map[int]config.ErrorMapping
+	errorTemplate   *errorTemplate
+	pattern         routePattern
+	predicates      *routePredicates
+	priority        int
+	rewrite         *pathRewrite
+	split           *trafficSplit
+	mirror          *mirrorPolicy
+	composite       *compositeRoute
+	streaming       *streamingPolicy
+	// grpc routes keep the request path and relay every response as a stream
+	grpc bool
+	// transcoder is nil unless the gRPC route also takes JSON requests
+	transcoder *grpcTranscoder
+	// client is nil unless the route has upstream TLS settings, see ProxyHandler.clientFor
+	client *http.Client
+
+	// routeConfig is the configuration the route was built from
+	routeConfig config.Route
+}
+
+// availableBackends returns the backends that can currently take traffic.
+func (r *Route) availableBackends() []*Backend {
+	available := make([]*Backend, 0, len(r.Backends))
+	now := time.Now()
+
+	for _, backend := range r.Backends {
+		if backend.Healthy() && !backend.Ejected(now) && (backend.breaker == nil || backend.breaker.available(now)) {
+			available = append(available, backend)
+		}
+	}
+
+	return available
+}
+
+// circuitRetryAfter returns how long until one of the route's open circuits
+// lets requests through again. It returns false when no backend is held
+// back by its circuit breaker alone.
+func (r *Route) circuitRetryAfter(now time.Time) (time.Duration, bool) {
+	var retryAfter time.Duration
+	found := false
+
+	for _, backend := range r.Backends {
+		if backend.breaker == nil || !backend.Healthy() || backend.Ejected(now) {
+			continue
+		}
+
+		wait := backend.breaker.retryAfter(now)
+		if !found || wait < retryAfter {
+			retryAfter = wait
+			found = true
+		}
+	}
+
+	return retryAfter, found
+}
+
+// recordOutcome feeds the result of a proxied request to the route's
+// outlier detection and to the backend's circuit breaker, under the permit
+// the breaker let the request through with.
+func (r *Route) recordOutcome(ctx context.Context, backend *Backend, permit circuitPermit, outcome attemptOutcome) {
+	if r.outlierDetector != nil && outcome != outcomeCancelled {
+		r.outlierDetector.record(ctx, backend, outcome == outcomeFailure)
+	}
+
+	if backend.breaker != nil {
+		if outcome == outcomeCancelled {
+			backend.breaker.release(permit)
+		} else {
+			backend.breaker.record(time.Now(), permit, outcome == outcomeFailure)
+		}
+	}
+}
+
+// close stops the background work of the route.
+func (r *Route) close() {
+	if r.healthChecker != nil {
+		r.healthChecker.stop()
+	}
+	if r.mirror != nil && r.mirror.comparer != nil {
+		r.mirror.comparer.close()
+	}
+	if r.client != nil {
+		r.client.CloseIdleConnections()
+	}
+}
+
+// newRoute builds a route from its configuration.
+func newRoute(cfg config.Route) (*Route, error) {
+	backendConfigs := cfg.AllBackends()
+	if len(backendConfigs) == 0 && cfg.Composite == nil {
+		return nil, ErrNoBackends
+	}
+
+	balancer, err := NewBalancer(cfg.LoadBalancer)
+	if err != nil {
+		return nil, err
+	}
+
+	route := &Route{
+		Name:     cfg.Name,
+		Prefix:   cfg.Prefix,
+		Backends: make([]*Backend, 0, len(backendConfigs)),
+		Balancer: balancer,
+
+		routeConfig: cfg,
+	}
+
+	route.pattern, err = parseRoutePattern(cfg.Prefix, cfg.Exact)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Match != nil {
+		route.predicates, err = newRoutePredicates(*cfg.Match)
+		if err != nil {
+			return nil, err
+		}
+	}
+	route.priority = cfg.Priority
+
+	if cfg.Rewrite != nil {
+		route.rewrite, err = newPathRewrite(*cfg.Rewrite, route.pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Retry != nil {
+		route.retryPolicy = newRetryPolicy(*cfg.Retry)
+	}
+
+	if len(cfg.ErrorMappings) > 0 {
+		route.errorMappings = make(map[int]config.ErrorMapping, len(cfg.ErrorMappings))
+		for _, mapping := range cfg.ErrorMappings {
+			if mapping.ReplaceStatus == 0 {
+				mapping.ReplaceStatus = mapping.Status
+			}
+			if mapping.Message == "" {
+				mapping.Message = http.StatusText(mapping.ReplaceStatus)
+			}
+			route.errorMappings[mapping.Status] = mapping
+		}
+	}
+
+	if cfg.ErrorTemplate != nil {
+		route.errorTemplate, err = newErrorTemplate(*cfg.ErrorTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Hedging != nil {
+		route.hedgingPolicy = newHedgingPolicy(*cfg.Hedging)
+	}
+
+	if cfg.Composite != nil {
+		route.composite, err = newCompositeRoute(*cfg.Composite, route.pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	route.streaming = newStreamingPolicy(cfg.Streaming)
+	if cfg.Protocol == config.ProtocolGrpc {
+		route.grpc = true
+		route.streaming.always = true
+	}
+	if cfg.Transcoding != nil {
+		route.transcoder, err = newGrpcTranscoder(*cfg.Transcoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UpstreamTLS != nil {
+		route.client, err = newUpstreamClient(*cfg.UpstreamTLS, route.grpc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Mirror != nil {
+		route.mirror, err = newMirrorPolicy(*cfg.Mirror)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the backends of every variant share the route's health checks,
+	// breakers and outlier detection
+	var variants []*splitVariant
+	if cfg.Split != nil {
+		route.split = newTrafficSplit(*cfg.Split, cfg.Prefix)
+		for i, variantConfig := range cfg.Split.Variants {
+			for range variantConfig.Backends {
+				variants = append(variants, route.split.variants[i])
+			}
+		}
+	}
+
+	for i, backendCfg := range backendConfigs {
+		target, err := url.ParseRequestURI(backendCfg.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		weight := backendCfg.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		backend := &Backend{
+			Url:    target,
+			Weight: weight,
+		}
+		backend.healthy.Store(true)
+		if variants != nil {
+			backend.variant = variants[i]
+		}
+
+		route.Backends = append(route.Backends, backend)
+	}
+
+	return route, nil
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Route patterns are matched segment by segment, so /user matches /user
+// and /user/profile but not /username. A segment is either literal, a
+// :name parameter matching any single non-empty segment, or, as the last
+// segment only, a *name wildcard matching the rest of the path. Prefix
+// routes match any path below their pattern, exact routes only the
+// pattern itself.
+
+// Match kinds, ranked so that at the same depth an exact match beats a
+// wildcard, which beats a prefix.
+const (
+	matchPrefix = iota
+	matchWildcard
+	matchExact
+	matchKinds
+)
+
+// routePattern is the parsed path pattern of a route.
+type routePattern struct {
+	segments []string
+	exact    bool
+	// paramNames holds the parameter names in path order, the wildcard last
+	paramNames []string
+	wildcard   bool
+}
+
+func parseRoutePattern(pattern string, exact bool) (routePattern, error) {
+	parsed := routePattern{exact: exact}
+
+	if !strings.HasPrefix(pattern, "/") {
+		return parsed, fmt.Errorf("%w: %q must start with /", ErrInvalidRoutePattern, pattern)
+	}
+
+	pattern = pattern[1:]
+	if !exact {
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if pattern == "" && !exact {
+		return parsed, nil
+	}
+
+	parsed.segments = strings.Split(pattern, "/")
+
+	for i, segment := range parsed.segments {
+		switch {
+		case strings.HasPrefix(segment, ":"):
+			if len(segment) == 1 {
+				return parsed, fmt.Errorf("%w: parameter without a name in %q", ErrInvalidRoutePattern, "/"+pattern)
+			}
+			parsed.paramNames = append(parsed.paramNames, segment[1:])
+		case strings.HasPrefix(segment, "*"):
+			if len(segment) == 1 {
+				return parsed, fmt.Errorf("%w: wildcard without a name in %q", ErrInvalidRoutePattern, "/"+pattern)
+			}
+			if i != len(parsed.segments)-1 {
+				return parsed, fmt.Errorf("%w: wildcard must be the last segment of %q", ErrInvalidRoutePattern, "/"+pattern)
+			}
+			parsed.paramNames = append(parsed.paramNames, segment[1:])
+			parsed.wildcard = true
+			parsed.segments = parsed.segments[:i]
+		}
+	}
+
+	return parsed, nil
+}
+
+// kind returns how the pattern matches paths.
+func (p routePattern) kind() int {
+	switch {
+	case p.wildcard:
+		return matchWildcard
+	case p.exact:
+		return matchExact
+	default:
+		return matchPrefix
+	}
+}
+
+// routeNode is a node of the radix tree over path segments. Lookups walk
+// one node per path segment, so their cost depends on the depth of the
+// path and not on the number of routes.
+type routeNode struct {
+	static map[string]*routeNode
+	param  *routeNode
+	// routes holds per match kind the routes in the order they are tried
+	routes [matchKinds][]*Route
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{static: make(map[string]*routeNode)}
+}
+
+// insert adds a route below the node. Routes with the same pattern are
+// tried by priority, then by their number of match conditions, then by
+// key. Two routes whose patterns differ at most in parameter names
+// conflict unless one of them has match conditions.
+func (n *routeNode) insert(route *Route) error {
+	node := n
+
+	for _, segment := range route.pattern.segments {
+		if strings.HasPrefix(segment, ":") {
+			if node.param == nil {
+				node.param = newRouteNode()
+			}
+			node = node.param
+			continue
+		}
+
+		child, exists := node.static[segment]
+		if !exists {
+			child = newRouteNode()
+			node.static[segment] = child
+		}
+		node = child
+	}
+
+	kind := route.pattern.kind()
+	for _, existing := range node.routes[kind] {
+		if existing.predicates == nil && route.predicates == nil {
+			return fmt.Errorf("%w: %v and %v", ErrRouteConflict, existing.routeConfig.Key(), route.routeConfig.Key())
+		}
+	}
+
+	node.routes[kind] = append(node.routes[kind], route)
+	slices.SortStableFunc(node.routes[kind], compareRoutePrecedence)
+
+	return nil
+}
+
+func compareRoutePrecedence(a, b *Route) int {
+	if a.priority != b.priority {
+		return cmp.Compare(b.priority, a.priority)
+	}
+	if a.predicates.count() != b.predicates.count() {
+		return cmp.Compare(b.predicates.count(), a.predicates.count())
+	}
+
+	return strings.Compare(a.routeConfig.Key(), b.routeConfig.Key())
+}
+
+// routeMatch is the route chosen for a request.
+type routeMatch struct {
+	route   *Route
+	request *http.Request
+	// path is the request path the route matched
+	path string
+	// params holds the captured parameter values in the order of route.pattern.paramNames
+	params []string
+	// rest is the part of the path below the matched pattern, or below the
+	// segment the wildcard starts at
+	rest string
+	rank int
+
+	// allowedMethods collects the methods of routes that matched the request in all but the method
+	allowedMethods map[string]bool
+}
+
+// param returns the value captured for the named parameter.
+func (m *routeMatch) param(name string) string {
+	for i, paramName := range m.route.pattern.paramNames {
+		if paramName == name {
+			return m.params[i]
+		}
+	}
+
+	return ""
+}
+
+// offer keeps the first of routes the request meets the conditions of,
+// when it ranks higher than the current best match. Deeper matches rank
+// higher, ties go to the routes offered first, which are the ones with
+// more literal segments.
+func (m *routeMatch) offer(routes []*Route, depth int, params []string, rest string) {
+	if len(routes) == 0 {
+		return
+	}
+
+	rank := depth*matchKinds + routes[0].pattern.kind()
+	if m.route != nil && rank <= m.rank {
+		return
+	}
+
+	for _, route := range routes {
+		if !route.predicates.matchesRequest(m.request) {
+			continue
+		}
+
+		if !route.predicates.allowsMethod(m.request.Method) {
+			if m.allowedMethods == nil {
+				m.allowedMethods = make(map[string]bool)
+			}
+			for method := range route.predicates.methods {
+				m.allowedMethods[method] = true
+			}
+			continue
+		}
+
+		m.accept(route, rank, params, rest)
+		return
+	}
+}
+
+func (m *routeMatch) accept(route *Route, rank int, params []string, rest string) {
+	m.route = route
+	m.params = append(m.params[:0], params...)
+	m.rest = rest
+	m.rank = rank
+}
+
+// search matches path, the unmatched part of the request path, against the node and its children.
+func (n *routeNode) search(path string, depth int, params []string, match *routeMatch) {
+	match.offer(n.routes[matchPrefix], depth, params, path)
+	if routes := n.routes[matchWildcard]; len(routes) > 0 {
+		match.offer(routes, depth, append(params, strings.TrimPrefix(path, "/")), path)
+	}
+	if path == "" {
+		match.offer(n.routes[matchExact], depth, params, path)
+		return
+	}
+
+	segment, next := path[1:], ""
+	if i := strings.IndexByte(segment, '/'); i >= 0 {
+		segment, next = segment[:i], segment[i:]
+	}
+
+	if child, exists := n.static[segment]; exists {
+		child.search(next, depth+1, params, match)
+	}
+	if n.param != nil && segment != "" {
+		n.param.search(next, depth+1, append(params, segment), match)
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRoutingTable(t testing.TB, routeConfigs ...config.Route) *routingTable {
+	t.Helper()
+
+	routes := make(map[string]*Route, len(routeConfigs))
+	for _, routeConfig := range routeConfigs {
+		if len(routeConfig.Backends) == 0 {
+			routeConfig.Backends = []config.Backend{{Url: "http://backend:8080"}}
+		}
+
+		route, err := newRoute(routeConfig)
+		if err != nil {
+			t.Fatalf("failed to create route %v: %v", routeConfig.Prefix, err)
+		}
+		routes[routeConfig.Key()] = route
+	}
+
+	table, err := newRoutingTable(routes, 1)
+	if err != nil {
+		t.Fatalf("failed to create routing table: %v", err)
+	}
+
+	return table
+}
+
+func newMatchRequest(host, path string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if host != "" {
+		r.Host = host
+	}
+
+	return r
+}
+
+func TestRoutingTable_Match(t *testing.T) {
+	table := newTestRoutingTable(t,
+		config.Route{Prefix: "/user"},
+		config.Route{Prefix: "/user/settings"},
+		config.Route{Prefix: "/users/:id"},
+		config.Route{Prefix: "/users/me", Exact: true},
+		config.Route{Prefix: "/users/:id/orders/:orderId", Exact: true},
+		config.Route{Prefix: "/static/*file"},
+		config.Route{Prefix: "/health", Exact: true},
+	)
+
+	tests := []struct {
+		path            string
+		expectedPattern string
+		expectedRest    string
+		expectedParams  []string
+	}{
+		{"/user", "/user", "", nil},
+		{"/user/profile", "/user", "/profile", nil},
+		{"/user/", "/user", "/", nil},
+		{"/username", "", "", nil},
+		{"/user/settings/email", "/user/settings", "/email", nil},
+		{"/users/42", "/users/:id", "", []string{"42"}},
+		{"/users/42/friends", "/users/:id", "/friends", []string{"42"}},
+		{"/users/me", "/users/me", "", nil},
+		{"/users/me/friends", "/users/:id", "/friends", []string{"me"}},
+		{"/users/42/orders/7", "/users/:id/orders/:orderId", "", []string{"42", "7"}},
+		{"/users/42/orders/7/items", "/users/:id", "/orders/7/items", []string{"42"}},
+		{"/users", "", "", nil},
+		{"/static", "/static/*file", "", []string{""}},
+		{"/static/css/site.css", "/static/*file", "/css/site.css", []string{"css/site.css"}},
+		{"/health", "/health", "", nil},
+		{"/health/deep", "", "", nil},
+		{"/", "", "", nil},
+	}
+
+	for _, tc := range tests {
+		match := table.match(newMatchRequest("", tc.path))
+
+		if tc.expectedPattern == "" {
+			assert.Nil(t, match.route, tc.path)
+			continue
+		}
+
+		if assert.NotNil(t, match.route, tc.path) {
+			assert.Equal(t, tc.expectedPattern, match.route.Prefix, tc.path)
+			assert.Equal(t, tc.expectedRest, match.rest, tc.path)
+			assert.Equal(t, len(tc.expectedParams), len(match.params), tc.path)
+			for i, value := range tc.expectedParams {
+				assert.Equal(t, value, match.params[i], tc.path)
+			}
+		}
+	}
+}
+
+func TestRoutingTable_RootPrefix(t *testing.T) {
+	table := newTestRoutingTable(t, config.Route{Prefix: "/"}, config.Route{Prefix: "/order"})
+
+	assert.Equal(t, "/", table.match(newMatchRequest("", "/anything/else")).route.Prefix)
+	assert.Equal(t, "/anything/else", table.match(newMatchRequest("", "/anything/else")).rest)
+	assert.Equal(t, "/order", table.match(newMatchRequest("", "/order/1")).route.Prefix)
+}
+
+func TestRoutingTable_Conflicts(t *testing.T) {
+	routes := make(map[string]*Route)
+	for _, prefix := range []string{"/users/:id", "/users/:userId"} {
+		route, err := newRoute(config.Route{Prefix: prefix, Backends: []config.Backend{{Url: "http://user:6001"}}})
+		assert.NoError(t, err)
+		routes[prefix] = route
+	}
+
+	_, err := newRoutingTable(routes, 1)
+	assert.ErrorIs(t, err, ErrRouteConflict)
+}
+
+func TestParseRoutePattern_Invalid(t *testing.T) {
+	for _, pattern := range []string{"user", "/users/:", "/static/*", "/static/*file/more"} {
+		_, err := parseRoutePattern(pattern, false)
+		assert.ErrorIs(t, err, ErrInvalidRoutePattern, pattern)
+	}
+}
+
+func TestServeHTTP_PathParameters(t *testing.T) {
+	var receivedPath, receivedQuery string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receivedPath = r.URL.Path
+		receivedQuery = r.URL.RawQuery
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestRouteConfig("/v2/users/:id", backend.URL)
+	routeConfig.Rewrite = &config.PathRewrite{ReplacePrefix: "/profile/{id}"}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/user", backend.URL)))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v2/users/42?fields=name", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/profile/42", receivedPath)
+	assert.Equal(t, "fields=name", receivedQuery)
+
+	rr = httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/username", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// BenchmarkRoutingTable_Match shows that lookups cost the same whether the
+// table holds ten routes or ten thousand.
+func BenchmarkRoutingTable_Match(b *testing.B) {
+	for _, size := range []int{10, 100, 1000, 10000} {
+		routeConfigs := make([]config.Route, 0, size)
+		for i := 0; i < size; i++ {
+			routeConfigs = append(routeConfigs, config.Route{Prefix: fmt.Sprintf("/service-%d/users/:id", i)})
+		}
+		table := newTestRoutingTable(b, routeConfigs...)
+		request := newMatchRequest("", fmt.Sprintf("/service-%d/users/42/orders", size/2))
+
+		b.Run(fmt.Sprintf("routes=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if table.match(request).route == nil {
+					b.Fatal("no route matched")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+)
+
+// routingTable is an immutable set of routes. A request loads the current
+// table once, so a reload never changes the routes of a request in flight.
+// Every change installs a new table with the next version.
+//
+// Each virtual host has its own tree of routes. A request is routed by
+// the tree of its exact host if there is one, else by the tree of the
+// longest matching wildcard host, else by the tree of the default host.
+type routingTable struct {
+	// routes holds every route by its key, see config.Route.Key
+	routes map[string]*Route
+
+	defaultHost *routeNode
+	// hosts holds the trees of exact hosts by name
+	hosts map[string]*routeNode
+	// wildcardHosts holds the trees of *.example.com hosts by suffix, such as .example.com
+	wildcardHosts map[string]*routeNode
+
+	version uint64
+}
+
+func newRoutingTable(routes map[string]*Route, version uint64) (*routingTable, error) {
+	if routes == nil {
+		routes = make(map[string]*Route)
+	}
+
+	table := &routingTable{
+		routes:        routes,
+		defaultHost:   newRouteNode(),
+		hosts:         make(map[string]*routeNode),
+		wildcardHosts: make(map[string]*routeNode),
+		version:       version,
+	}
+
+	// insert in a fixed order so conflicts are reported the same way every time
+	for _, key := range sortedKeys(routes) {
+		route := routes[key]
+
+		if len(route.routeConfig.Hosts) == 0 {
+			err := table.defaultHost.insert(route)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, host := range route.routeConfig.Hosts {
+			err := table.hostTree(strings.ToLower(host)).insert(route)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return table, nil
+}
+
+// hostTree returns the tree of a host pattern, creating it when needed.
+func (t *routingTable) hostTree(host string) *routeNode {
+	trees, name := t.hosts, host
+	if suffix, wildcard := strings.CutPrefix(host, "*"); wildcard {
+		trees, name = t.wildcardHosts, suffix
+	}
+
+	tree, exists := trees[name]
+	if !exists {
+		tree = newRouteNode()
+		trees[name] = tree
+	}
+
+	return tree
+}
+
+// treeFor returns the tree that routes requests for host.
+func (t *routingTable) treeFor(host string) *routeNode {
+	host = normalizeHost(host)
+
+	if tree, exists := t.hosts[host]; exists {
+		return tree
+	}
+
+	// try .b.example.com, then .example.com, then .com for a.b.example.com
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		if tree, exists := t.wildcardHosts[host[i:]]; exists {
+			return tree
+		}
+
+		next := strings.IndexByte(host[i+1:], '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+
+	return t.defaultHost
+}
+
+// match finds the most specific route for the request. The route of the
+// result is nil when no route matches; allowedMethods is then set when
+// some routes would have matched with another method.
+func (t *routingTable) match(r *http.Request) *routeMatch {
+	match := &routeMatch{request: r, path: r.URL.Path}
+	t.treeFor(r.Host).search(r.URL.Path, 0, nil, match)
+
+	return match
+}
+
+// normalizeHost strips the port and trailing dot from a Host header and lowercases it.
+func normalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// configs returns the configuration of every route by key.
+func (t *routingTable) configs() map[string]config.Route {
+	configs := make(map[string]config.Route, len(t.routes))
+	for key, route := range t.routes {
+		configs[key] = route.routeConfig
+	}
+
+	return configs
+}
+
+// RoutingTableVersion returns the version of the current routing table.
+func (p *ProxyHandler) RoutingTableVersion() uint64 {
+	return p.routes.Load().version
+}
+
+// changeRoutes lets change edit the route configurations by key, then
+// validates the result and installs it as the next version of the routing
+// table. Only routes whose configuration changed are rebuilt, the others
+// keep their health and breaker state. When expectedVersion is not nil the
+// change is rejected with ErrVersionConflict unless the table is still at
+// that version. It returns the version of the installed table.
+func (p *ProxyHandler) changeRoutes(expectedVersion *uint64, change func(configs map[string]config.Route) error) (uint64, error) {
+	p.routesMu.Lock()
+	defer p.routesMu.Unlock()
+
+	current := p.routes.Load()
+	if expectedVersion != nil && *expectedVersion != current.version {
+		return 0, fmt.Errorf("%w: expected version %d, current version %d", ErrVersionConflict, *expectedVersion, current.version)
+	}
+
+	configs := current.configs()
+	err := change(configs)
+	if err != nil {
+		return 0, err
+	}
+
+	err = config.ValidateRoutes(routeConfigList(configs))
+	if err != nil {
+		return 0, err
+	}
+
+	routes := maps.Clone(current.routes)
+	var built []*Route
+
+	for key := range routes {
+		if _, kept := configs[key]; !kept {
+			delete(routes, key)
+		}
+	}
+
+	for key, routeConfig := range configs {
+		if existing, exists := routes[key]; exists && reflect.DeepEqual(existing.routeConfig, routeConfig) {
+			continue
+		}
+
+		route, err := p.buildRoute(routeConfig)
+		if err != nil {
+			for _, route := range built {
+				route.close()
+			}
+			return 0, fmt.Errorf("%w: route %v: %w", config.ErrInvalidConfiguration, key, err)
+		}
+
+		built = append(built, route)
+		routes[key] = route
+	}
+
+	err = p.swapRoutes(routes)
+	if err != nil {
+		for _, route := range built {
+			route.close()
+		}
+		return 0, fmt.Errorf("%w: %w", config.ErrInvalidConfiguration, err)
+	}
+
+	return current.version + 1, nil
+}
+
+func routeConfigList(configs map[string]config.Route) []config.Route {
+	list := make([]config.Route, 0, len(configs))
+	for _, routeConfig := range configs {
+		list = append(list, routeConfig)
+	}
+
+	return list
+}
@@ -0,0 +1,447 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	defaultShadowCompareMaxBodyBytes = 1 << 20
+	defaultShadowDiffPercentage      = 100
+
+	// maxShadowDifferences caps the differences reported for one comparison
+	maxShadowDifferences = 50
+)
+
+// Parts of a response a shadow comparison reports mismatches for.
+const (
+	shadowPartStatus  = "status"
+	shadowPartHeaders = "headers"
+	shadowPartBody    = "body"
+)
+
+// shadowComparer compares the responses of a mirror with the responses of
+// the route's backends: the status, the configured headers and the body,
+// as JSON without the ignored paths when both bodies are JSON. Ignore paths
+// are dot separated, with * matching any key or array index, such as
+// meta.generatedAt or items.*.id. A percentage (0-100, default 100) of the
+// mismatches is written to the diff file as JSON lines. Bodies larger than
+// the configured maximum are not compared.
+type shadowComparer struct {
+	config      config.ShadowCompare
+	headers     []string
+	ignorePaths [][]string
+	diffs       *diffWriter
+
+	// done is closed with the route, which abandons the comparisons still waiting
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newShadowComparer(compareConfig config.ShadowCompare) *shadowComparer {
+	if compareConfig.MaxBodyBytes <= 0 {
+		compareConfig.MaxBodyBytes = defaultShadowCompareMaxBodyBytes
+	}
+	if compareConfig.DiffPercentage <= 0 {
+		compareConfig.DiffPercentage = defaultShadowDiffPercentage
+	}
+
+	comparer := &shadowComparer{config: compareConfig, done: make(chan struct{})}
+
+	for _, header := range compareConfig.Headers {
+		comparer.headers = append(comparer.headers, http.CanonicalHeaderKey(header))
+	}
+
+	for _, path := range compareConfig.IgnorePaths {
+		path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+		comparer.ignorePaths = append(comparer.ignorePaths, strings.Split(path, "."))
+	}
+
+	if compareConfig.DiffFile != "" {
+		comparer.diffs = &diffWriter{path: compareConfig.DiffFile}
+	}
+
+	return comparer
+}
+
+// close abandons pending comparisons and closes the diff file.
+func (c *shadowComparer) close() {
+	c.closeOnce.Do(func() { close(c.done) })
+	if c.diffs != nil {
+		c.diffs.close()
+	}
+}
+
+// responseSnapshot is what a comparison needs of a response.
+type responseSnapshot struct {
+	status int
+	header http.Header
+	body   []byte
+	// complete is false when the body was larger than the comparison limit or not read to the end
+	complete bool
+}
+
+// shadowComparison connects the response of the route's backend with the
+// copy of the request that is in flight to the mirror. It receives
+// exactly one snapshot, which is nil when the request got no response.
+type shadowComparison struct {
+	primary chan *responseSnapshot
+	once    sync.Once
+}
+
+func newShadowComparison() *shadowComparison {
+	return &shadowComparison{primary: make(chan *responseSnapshot, 1)}
+}
+
+func (c *shadowComparison) deliver(snapshot *responseSnapshot) {
+	c.once.Do(func() { c.primary <- snapshot })
+}
+
+// abandon tells the comparison that there is no response to compare with.
+func (c *shadowComparison) abandon() {
+	c.deliver(nil)
+}
+
+// capture makes the comparison receive the response once its body is closed,
+// with as much of the body as the client read, up to maxBytes.
+func (c *shadowComparison) capture(response *http.Response, maxBytes int64) {
+	response.Body = &capturingBody{
+		ReadCloser: response.Body,
+		comparison: c,
+		maxBytes:   maxBytes,
+		snapshot:   &responseSnapshot{status: response.StatusCode, header: response.Header.Clone()},
+	}
+}
+
+// capturingBody keeps a copy of the body it relays for a shadow comparison.
+type capturingBody struct {
+	io.ReadCloser
+	comparison *shadowComparison
+	maxBytes   int64
+	buffer     bytes.Buffer
+	truncated  bool
+	eof        bool
+	snapshot   *responseSnapshot
+}
+
+func (b *capturingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	if room := b.maxBytes - int64(b.buffer.Len()); int64(n) > room {
+		b.buffer.Write(p[:max(room, 0)])
+		b.truncated = true
+	} else {
+		b.buffer.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+
+	return n, err
+}
+
+func (b *capturingBody) Close() error {
+	b.snapshot.body = b.buffer.Bytes()
+	b.snapshot.complete = b.eof && !b.truncated
+	b.comparison.deliver(b.snapshot)
+
+	return b.ReadCloser.Close()
+}
+
+// readSnapshot reads the response of the mirror for a comparison and discards what is left of its body.
+func readSnapshot(response *http.Response, maxBytes int64) *responseSnapshot {
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBytes+1))
+	snapshot := &responseSnapshot{
+		status:   response.StatusCode,
+		header:   response.Header,
+		body:     body,
+		complete: err == nil && int64(len(body)) <= maxBytes,
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+
+	return snapshot
+}
+
+// shadowDifference is a value that differs between the two responses.
+type shadowDifference struct {
+	// Field is status, header.<name>, body, or body.<path> for JSON bodies
+	Field   string `json:"field"`
+	Primary any    `json:"primary,omitempty"`
+	Shadow  any    `json:"shadow,omitempty"`
+}
+
+// compare returns the differences between the response of the route's
+// backend and the response of the mirror.
+func (c *shadowComparer) compare(primary, shadow *responseSnapshot) []shadowDifference {
+	var differences []shadowDifference
+
+	if primary.status != shadow.status {
+		differences = append(differences, shadowDifference{Field: shadowPartStatus, Primary: primary.status, Shadow: shadow.status})
+	}
+
+	for _, header := range c.headers {
+		primaryValue := strings.Join(primary.header.Values(header), ", ")
+		shadowValue := strings.Join(shadow.header.Values(header), ", ")
+		if primaryValue != shadowValue {
+			differences = append(differences, shadowDifference{Field: "header." + header, Primary: primaryValue, Shadow: shadowValue})
+		}
+	}
+
+	// partial bodies cannot be compared
+	if !primary.complete || !shadow.complete {
+		return differences
+	}
+
+	primaryJSON, primaryIsJSON := decodeJSON(primary.body)
+	shadowJSON, shadowIsJSON := decodeJSON(shadow.body)
+
+	if primaryIsJSON && shadowIsJSON {
+		for _, path := range c.ignorePaths {
+			primaryJSON = removeJSONPath(primaryJSON, path)
+			shadowJSON = removeJSONPath(shadowJSON, path)
+		}
+		diffJSON(shadowPartBody, primaryJSON, shadowJSON, &differences)
+	} else if !bytes.Equal(primary.body, shadow.body) {
+		differences = append(differences, shadowDifference{Field: shadowPartBody})
+	}
+
+	return differences
+}
+
+func decodeJSON(body []byte) (any, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+
+	return value, true
+}
+
+// removeJSONPath removes the values at path from a decoded JSON value.
+func removeJSONPath(value any, path []string) any {
+	if len(path) == 0 {
+		return value
+	}
+
+	segment, rest := path[0], path[1:]
+
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, child := range typed {
+			if segment != "*" && segment != key {
+				continue
+			}
+			if len(rest) == 0 {
+				delete(typed, key)
+			} else {
+				typed[key] = removeJSONPath(child, rest)
+			}
+		}
+	case []any:
+		kept := typed[:0]
+		for i, child := range typed {
+			if segment != "*" && segment != strconv.Itoa(i) {
+				kept = append(kept, child)
+				continue
+			}
+			if len(rest) > 0 {
+				kept = append(kept, removeJSONPath(child, rest))
+			}
+		}
+		return kept
+	}
+
+	return value
+}
+
+// diffJSON appends the paths at which two decoded JSON values differ.
+func diffJSON(path string, primary, shadow any, differences *[]shadowDifference) {
+	if len(*differences) >= maxShadowDifferences {
+		return
+	}
+
+	switch primaryTyped := primary.(type) {
+	case map[string]any:
+		if shadowTyped, ok := shadow.(map[string]any); ok {
+			keys := make([]string, 0, len(primaryTyped)+len(shadowTyped))
+			for key := range primaryTyped {
+				keys = append(keys, key)
+			}
+			for key := range shadowTyped {
+				if _, shared := primaryTyped[key]; !shared {
+					keys = append(keys, key)
+				}
+			}
+			slices.Sort(keys)
+
+			for _, key := range keys {
+				diffJSON(path+"."+key, primaryTyped[key], shadowTyped[key], differences)
+			}
+			return
+		}
+	case []any:
+		if shadowTyped, ok := shadow.([]any); ok {
+			for i := range max(len(primaryTyped), len(shadowTyped)) {
+				var primaryItem, shadowItem any
+				if i < len(primaryTyped) {
+					primaryItem = primaryTyped[i]
+				}
+				if i < len(shadowTyped) {
+					shadowItem = shadowTyped[i]
+				}
+				diffJSON(path+"."+strconv.Itoa(i), primaryItem, shadowItem, differences)
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(primary, shadow) {
+		*differences = append(*differences, shadowDifference{Field: path, Primary: primary, Shadow: shadow})
+	}
+}
+
+// shadowDiff is a line of the diff file.
+type shadowDiff struct {
+	Time        time.Time          `json:"time"`
+	Route       string             `json:"route"`
+	Method      string             `json:"method"`
+	Path        string             `json:"path"`
+	RequestID   string             `json:"requestId,omitempty"`
+	TraceID     string             `json:"traceId,omitempty"`
+	Differences []shadowDifference `json:"differences"`
+}
+
+// Results of shadow comparisons, as reported to the shadow comparisons counter.
+const (
+	shadowMatch    = "match"
+	shadowMismatch = "mismatch"
+	shadowSkipped  = "skipped"
+)
+
+// compareShadow compares the response of the mirror with the response of
+// the route's backend once it has been relayed, counts the mismatching
+// parts and writes a sample of the mismatches to the diff file. It waits
+// for the response of the route's backend for at most wait, as long
+// responses such as streams would otherwise hold the comparison forever.
+// Comparisons without a response to compare with are counted as skipped.
+func (p *ProxyHandler) compareShadow(route *Route, comparison *shadowComparison, shadow *responseSnapshot, diff shadowDiff, wait time.Duration) bool {
+	comparer := route.mirror.comparer
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var primary *responseSnapshot
+	select {
+	case primary = <-comparison.primary:
+	case <-timer.C:
+	case <-comparer.done:
+	}
+	if primary == nil {
+		p.recordShadowComparison(route, shadowSkipped)
+		return false
+	}
+
+	diff.Differences = comparer.compare(primary, shadow)
+	if len(diff.Differences) == 0 {
+		p.recordShadowComparison(route, shadowMatch)
+		return false
+	}
+	p.recordShadowComparison(route, shadowMismatch)
+
+	parts := make(map[string]bool)
+	for _, difference := range diff.Differences {
+		part, _, _ := strings.Cut(difference.Field, ".")
+		if part == "header" {
+			part = shadowPartHeaders
+		}
+		parts[part] = true
+	}
+	for part := range parts {
+		p.metrics.shadowMismatches.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("route", route.Prefix),
+			attribute.String("part", part),
+		))
+	}
+
+	if comparer.diffs != nil && rand.Float64()*100 < comparer.config.DiffPercentage {
+		diff.Time = time.Now()
+		if err := comparer.diffs.write(diff); err != nil {
+			p.Telemetry.LogErrorln("failed to write shadow diff:", err)
+		}
+	}
+
+	return true
+}
+
+// diffWriter appends shadow diffs to a JSON lines file, which it opens on the first write.
+type diffWriter struct {
+	path string
+
+	mu     sync.Mutex
+	file   *os.File
+	closed bool
+}
+
+func (w *diffWriter) write(diff shadowDiff) error {
+	line, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+
+	if w.file == nil {
+		w.file, err = os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	// one write per line, so lines of routes sharing the file do not interleave
+	_, err = w.file.Write(append(line, '\n'))
+
+	return err
+}
+
+func (w *diffWriter) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	if w.file != nil {
+		w.file.Close()
+	}
+}
+
+func (p *ProxyHandler) recordShadowComparison(route *Route, result string) {
+	p.metrics.shadowComparisons.Add(context.Background(), 1, metric.WithAttributes(
+		attribute.String("route", route.Prefix),
+		attribute.String("result", result),
+	))
+}
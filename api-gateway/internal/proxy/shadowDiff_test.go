@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func newTestSnapshot(status int, body string, header ...string) *responseSnapshot {
+	snapshot := &responseSnapshot{status: status, header: http.Header{}, body: []byte(body), complete: true}
+	for i := 0; i+1 < len(header); i += 2 {
+		snapshot.header.Add(header[i], header[i+1])
+	}
+
+	return snapshot
+}
+
+func differenceFields(differences []shadowDifference) []string {
+	fields := make([]string, 0, len(differences))
+	for _, difference := range differences {
+		fields = append(fields, difference.Field)
+	}
+
+	return fields
+}
+
+// shadowComparisonResults returns the sum of the shadow comparisons counter by result.
+func shadowComparisonResults(t *testing.T, reader *sdkmetric.ManualReader) map[string]int64 {
+	t.Helper()
+
+	var data metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(t.Context(), &data))
+
+	results := make(map[string]int64)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				result, _ := point.Attributes.Value(attribute.Key("result"))
+				results[result.AsString()] += point.Value
+			}
+		}
+	}
+
+	return results
+}
+
+func TestShadowComparer_Compare(t *testing.T) {
+	comparer := newShadowComparer(config.ShadowCompare{
+		Headers:     []string{"content-type"},
+		IgnorePaths: []string{"meta.generatedAt", "items.*.id", "$.traceId"},
+	})
+
+	tests := []struct {
+		name           string
+		primary        *responseSnapshot
+		shadow         *responseSnapshot
+		expectedFields []string
+	}{
+		{
+			"equal",
+			newTestSnapshot(200, `{"a":1,"b":[1,2]}`),
+			newTestSnapshot(200, `{"b":[1,2],"a":1}`),
+			[]string{},
+		},
+		{
+			"status and header",
+			newTestSnapshot(200, `{}`, "Content-Type", "application/json"),
+			newTestSnapshot(500, `{}`, "Content-Type", "text/plain", "X-Other", "1"),
+			[]string{"status", "header.Content-Type"},
+		},
+		{
+			"ignored paths",
+			newTestSnapshot(200, `{"traceId":"a","meta":{"generatedAt":1,"count":2},"items":[{"id":1,"name":"x"}]}`),
+			newTestSnapshot(200, `{"traceId":"b","meta":{"generatedAt":2,"count":2},"items":[{"id":2,"name":"x"}]}`),
+			[]string{},
+		},
+		{
+			"nested differences",
+			newTestSnapshot(200, `{"meta":{"count":2},"items":[{"name":"x"},{"name":"y"}]}`),
+			newTestSnapshot(200, `{"meta":{"count":3,"page":1},"items":[{"name":"x"}]}`),
+			[]string{"body.items.1", "body.meta.count", "body.meta.page"},
+		},
+		{
+			"numbers keep their precision",
+			newTestSnapshot(200, `{"id":9007199254740993}`),
+			newTestSnapshot(200, `{"id":9007199254740992}`),
+			[]string{"body.id"},
+		},
+		{
+			"plain bodies",
+			newTestSnapshot(200, "hello"),
+			newTestSnapshot(200, "hello!"),
+			[]string{"body"},
+		},
+		{
+			"partial bodies are not compared",
+			&responseSnapshot{status: 200, header: http.Header{}, body: []byte(`{"a":1}`)},
+			newTestSnapshot(200, `{"a":2}`),
+			[]string{},
+		},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.expectedFields, differenceFields(comparer.compare(tc.primary, tc.shadow)), tc.name)
+	}
+}
+
+func TestServeHTTP_ShadowDiff(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":1,"total":10,"generatedAt":"now"}`))
+	}))
+	defer backend.Close()
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"id":1,"total":12,"generatedAt":"later"}`))
+	}))
+	defer shadow.Close()
+
+	reader := sdkmetric.NewManualReader()
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	proxyHandler.metrics.shadowMismatches, _ = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64Counter("shadow_mismatches")
+	comparisons := sdkmetric.NewManualReader()
+	proxyHandler.metrics.shadowComparisons, _ = sdkmetric.NewMeterProvider(sdkmetric.WithReader(comparisons)).Meter("test").Int64Counter("shadow_comparisons")
+	defer proxyHandler.Close()
+
+	diffFile := filepath.Join(t.TempDir(), "diffs.jsonl")
+	routeConfig := newTestRouteConfig("/order", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL, Percentage: 100, Compare: &config.ShadowCompare{
+		Headers:     []string{"Content-Type"},
+		IgnorePaths: []string{"generatedAt"},
+		DiffFile:    diffFile,
+	}}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/order/1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"id":1,"total":10,"generatedAt":"now"}`, rr.Body.String())
+
+	var diff shadowDiff
+	assert.Eventually(t, func() bool {
+		file, err := os.Open(diffFile)
+		if err != nil {
+			return false
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		return scanner.Scan() && json.Unmarshal(scanner.Bytes(), &diff) == nil
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Equal(t, "/order", diff.Route)
+	assert.Equal(t, "/order/1", diff.Path)
+	assert.Equal(t, rr.Header().Get(RequestIDHeader), diff.RequestID)
+	if assert.Len(t, diff.Differences, 1) {
+		assert.Equal(t, "body.total", diff.Differences[0].Field)
+		assert.Equal(t, 10.0, diff.Differences[0].Primary)
+		assert.Equal(t, 12.0, diff.Differences[0].Shadow)
+	}
+
+	var data metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(t.Context(), &data))
+	if assert.Len(t, data.ScopeMetrics, 1) {
+		points := data.ScopeMetrics[0].Metrics[0].Data.(metricdata.Sum[int64]).DataPoints
+		if assert.Len(t, points, 1) {
+			part, _ := points[0].Attributes.Value(attribute.Key("part"))
+			assert.Equal(t, "body", part.AsString())
+			assert.Equal(t, int64(1), points[0].Value)
+		}
+	}
+	assert.Equal(t, map[string]int64{shadowMismatch: 1}, shadowComparisonResults(t, comparisons))
+}
+
+func TestServeHTTP_ShadowDiffSlowPrimary(t *testing.T) {
+	finish := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("first chunk "))
+		w.(http.Flusher).Flush()
+		<-finish
+		_, _ = w.Write([]byte("last chunk"))
+	}))
+	defer backend.Close()
+
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("shadow"))
+	}))
+	defer shadow.Close()
+
+	comparisons := sdkmetric.NewManualReader()
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	proxyHandler.metrics.shadowComparisons, _ = sdkmetric.NewMeterProvider(sdkmetric.WithReader(comparisons)).Meter("test").Int64Counter("shadow_comparisons")
+	defer proxyHandler.Close()
+
+	routeConfig := newTestRouteConfig("/download", backend.URL)
+	routeConfig.Mirror = &config.Mirror{Url: shadow.URL, Percentage: 100, MaxConcurrent: 1, Timeout: 200 * time.Millisecond, Compare: &config.ShadowCompare{}}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/download")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	chunk := make([]byte, len("first chunk "))
+	_, err = io.ReadFull(response.Body, chunk)
+	assert.NoError(t, err)
+
+	// the mirror slot comes back once the shadow answered, while the primary response is still open
+	slots := proxyHandler.Routes()["/download"].mirror.slots
+	assert.Eventually(t, func() bool { return len(slots) == 0 }, time.Second, 10*time.Millisecond)
+
+	// a primary response still open after the mirror timeout is not compared, but counted as skipped
+	assert.Eventually(t, func() bool {
+		return shadowComparisonResults(t, comparisons)[shadowSkipped] == 1
+	}, time.Second, 10*time.Millisecond)
+
+	close(finish)
+	rest, err := io.ReadAll(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "last chunk", string(rest))
+
+	// the primary response arriving after the timeout changes nothing
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, map[string]int64{shadowSkipped: 1}, shadowComparisonResults(t, comparisons))
+}
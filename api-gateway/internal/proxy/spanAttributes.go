@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// knownMethods are the HTTP methods recorded as is, any other method is recorded as _OTHER.
+var knownMethods = map[string]bool{
+	http.MethodConnect: true,
+	http.MethodDelete:  true,
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodPatch:   true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodTrace:   true,
+}
+
+// methodAttributes returns http.request.method, falling back to _OTHER
+// with the original method for methods outside the known set.
+func methodAttributes(method string) []attribute.KeyValue {
+	if knownMethods[method] {
+		return []attribute.KeyValue{semconv.HTTPRequestMethodKey.String(method)}
+	}
+
+	return []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String("_OTHER"),
+		semconv.HTTPRequestMethodOriginal(method),
+	}
+}
+
+// serverRequestAttributes describes an incoming request following the HTTP server semantic conventions.
+func serverRequestAttributes(r *http.Request) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	attributes := append(methodAttributes(r.Method),
+		semconv.URLScheme(scheme),
+		semconv.URLPath(r.URL.Path),
+		semconv.NetworkProtocolVersion(protocolVersion(r)),
+	)
+
+	if r.URL.RawQuery != "" {
+		attributes = append(attributes, semconv.URLQuery(r.URL.RawQuery))
+	}
+
+	if host, port := splitHostPort(r.Host); host != "" {
+		attributes = append(attributes, semconv.ServerAddress(host))
+		if port > 0 {
+			attributes = append(attributes, semconv.ServerPort(port))
+		}
+	}
+
+	if userAgent := r.UserAgent(); userAgent != "" {
+		attributes = append(attributes, semconv.UserAgentOriginal(userAgent))
+	}
+
+	peerAddress, peerPort := splitHostPort(r.RemoteAddr)
+	if peerAddress != "" {
+		attributes = append(attributes, semconv.NetworkPeerAddress(peerAddress))
+	}
+
+	// the client is the first hop of X-Forwarded-For when the request went through another proxy
+	if forwardedFor := r.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		client, _, _ := strings.Cut(forwardedFor, ",")
+		attributes = append(attributes, semconv.ClientAddress(strings.TrimSpace(client)))
+	} else if peerAddress != "" {
+		attributes = append(attributes, semconv.ClientAddress(peerAddress))
+		if peerPort > 0 {
+			attributes = append(attributes, semconv.ClientPort(peerPort))
+		}
+	}
+
+	return attributes
+}
+
+// clientRequestAttributes describes an outbound request to a backend following the HTTP client semantic conventions.
+func clientRequestAttributes(r *http.Request, route *Route) []attribute.KeyValue {
+	attributes := append(methodAttributes(r.Method),
+		semconv.URLFull(r.URL.String()),
+	)
+
+	if host, port := splitHostPort(r.URL.Host); host != "" {
+		attributes = append(attributes, semconv.ServerAddress(host))
+		if port == 0 {
+			port = defaultPort(r.URL.Scheme)
+		}
+		attributes = append(attributes, semconv.ServerPort(port))
+	}
+
+	if route.Name != "" {
+		attributes = append(attributes, semconv.PeerService(route.Name))
+	}
+
+	return attributes
+}
+
+// errorTypeAttribute returns error.type for a failed request: the status
+// code for 5xx responses, or the kind of the transport error.
+func errorTypeAttribute(statusCode int, err error) attribute.KeyValue {
+	if err == nil {
+		return semconv.ErrorTypeKey.String(strconv.Itoa(statusCode))
+	}
+
+	var tlsErr *upstreamTLSError
+	if errors.As(err, &tlsErr) {
+		return semconv.ErrorTypeKey.String("tls_" + tlsErr.reason)
+	}
+
+	if kind := networkErrorKind(err); kind != "" {
+		return semconv.ErrorTypeKey.String(kind)
+	}
+
+	return semconv.ErrorTypeOther
+}
+
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMajor == 2 {
+		return "2"
+	}
+
+	return strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+}
+
+func splitHostPort(hostPort string) (string, int) {
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return hostPort, 0
+	}
+
+	port, _ := strconv.Atoi(portString)
+	return host, port
+}
+
+func defaultPort(scheme string) int {
+	if scheme == "https" {
+		return 443
+	}
+
+	return 80
+}
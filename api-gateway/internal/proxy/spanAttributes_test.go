@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordingTelemetry is a no-op telemetry provider that keeps the spans it starts.
+type recordingTelemetry struct {
+	*telemetry.NoopTelemetry
+	tracer   trace.Tracer
+	recorder *tracetest.SpanRecorder
+}
+
+func newRecordingTelemetry(t *testing.T) *recordingTelemetry {
+	t.Helper()
+
+	noop, err := telemetry.NewNoopTelemetry(telemetry.TelemetryConfiguration{})
+	if err != nil {
+		t.Fatalf("failed to create noop telemetry: %v", err)
+	}
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	return &recordingTelemetry{
+		NoopTelemetry: noop,
+		tracer:        provider.Tracer("test"),
+		recorder:      recorder,
+	}
+}
+
+func (t *recordingTelemetry) TraceStart(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// endedSpan returns the ended span with the given name.
+func (t *recordingTelemetry) endedSpan(name string) sdktrace.ReadOnlySpan {
+	for _, span := range t.recorder.Ended() {
+		if span.Name() == name {
+			return span
+		}
+	}
+
+	return nil
+}
+
+func spanAttributeMap(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+
+	return attributes
+}
+
+func TestServeHTTP_SemanticConventions(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	routeConfig := newTestRouteConfig("/user", backend.URL)
+	routeConfig.Name = "User Service"
+	_ = proxyHandler.AddRoute(routeConfig)
+
+	req := httptest.NewRequest(http.MethodPost, "http://gateway.local:8000/user/profile?id=7", nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.RemoteAddr = "10.0.0.7:51234"
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	serverSpan := telem.endedSpan("api_gateway_request")
+	assert.Equal(t, trace.SpanKindServer, serverSpan.SpanKind())
+
+	server := spanAttributeMap(serverSpan)
+	assert.Equal(t, "POST", server["http.request.method"].AsString())
+	assert.Equal(t, int64(http.StatusCreated), server["http.response.status_code"].AsInt64())
+	assert.Equal(t, "/user", server["http.route"].AsString())
+	assert.Equal(t, "gateway.local", server["server.address"].AsString())
+	assert.Equal(t, int64(8000), server["server.port"].AsInt64())
+	assert.Equal(t, "/user/profile", server["url.path"].AsString())
+	assert.Equal(t, "id=7", server["url.query"].AsString())
+	assert.Equal(t, "test-agent", server["user_agent.original"].AsString())
+	assert.Equal(t, "10.0.0.7", server["client.address"].AsString())
+	assert.Equal(t, int64(51234), server["client.port"].AsInt64())
+
+	clientSpan := telem.endedSpan("api_gateway_attempt")
+	assert.Equal(t, trace.SpanKindClient, clientSpan.SpanKind())
+	assert.Equal(t, serverSpan.SpanContext().SpanID(), clientSpan.Parent().SpanID())
+
+	client := spanAttributeMap(clientSpan)
+	assert.Equal(t, "User Service", client["peer.service"].AsString())
+	assert.Equal(t, "POST", client["http.request.method"].AsString())
+	assert.Equal(t, int64(http.StatusCreated), client["http.response.status_code"].AsInt64())
+	assert.Equal(t, backend.URL+"/profile?id=7", client["url.full"].AsString())
+	assert.Equal(t, "127.0.0.1", client["server.address"].AsString())
+}
+
+func TestServeHTTP_NotFoundIsNotASpanError(t *testing.T) {
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+
+	proxyHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PURGE", "/unknown", nil))
+
+	span := telem.endedSpan("api_gateway_request")
+	attributes := spanAttributeMap(span)
+	assert.Equal(t, int64(http.StatusNotFound), attributes["http.response.status_code"].AsInt64())
+	assert.Equal(t, "_OTHER", attributes["http.request.method"].AsString())
+	assert.Equal(t, "PURGE", attributes["http.request.method_original"].AsString())
+	assert.NotEqual(t, codes.Error, span.Status().Code)
+}
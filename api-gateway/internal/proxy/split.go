@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// trafficSplit divides the requests of a route between groups of backends,
+// such as a stable release and a canary.
+type trafficSplit struct {
+	variants    []*splitVariant
+	totalWeight int
+
+	stickyHeader string
+	stickyCookie string
+}
+
+// splitVariant is a group of backends that takes a weighted share of the traffic.
+type splitVariant struct {
+	name   string
+	weight int
+	// attributes identify the variant in the variant metrics
+	attributes metric.MeasurementOption
+}
+
+func newTrafficSplit(splitConfig config.TrafficSplit, prefix string) *trafficSplit {
+	split := &trafficSplit{
+		variants:     make([]*splitVariant, 0, len(splitConfig.Variants)),
+		stickyHeader: http.CanonicalHeaderKey(splitConfig.StickyHeader),
+		stickyCookie: splitConfig.StickyCookie,
+	}
+
+	for _, variantConfig := range splitConfig.Variants {
+		split.variants = append(split.variants, &splitVariant{
+			name:   variantConfig.Name,
+			weight: max(variantConfig.Weight, 0),
+			attributes: metric.WithAttributes(
+				attribute.String("route", prefix),
+				attribute.String("variant", variantConfig.Name),
+			),
+		})
+		split.totalWeight += max(variantConfig.Weight, 0)
+	}
+
+	return split
+}
+
+// choose picks the variant of a request. Requests with the same sticky
+// header or cookie value land on the same variant for as long as the
+// weights stay the same, the others are spread at random by weight. It
+// returns nil for routes without a split.
+func (s *trafficSplit) choose(r *http.Request) *splitVariant {
+	if s == nil || s.totalWeight <= 0 {
+		return nil
+	}
+
+	var point int
+	if key := s.stickyKey(r); key != "" {
+		hash := fnv.New32a()
+		_, _ = hash.Write([]byte(key))
+		point = int(hash.Sum32() % uint32(s.totalWeight))
+	} else {
+		point = rand.IntN(s.totalWeight)
+	}
+
+	for _, variant := range s.variants {
+		if point < variant.weight {
+			return variant
+		}
+		point -= variant.weight
+	}
+
+	return s.variants[len(s.variants)-1]
+}
+
+// stickyKey returns the value that pins the request to a variant, if any.
+func (s *trafficSplit) stickyKey(r *http.Request) string {
+	if s.stickyHeader != "" {
+		return r.Header.Get(s.stickyHeader)
+	}
+
+	if s.stickyCookie != "" {
+		if cookie, err := r.Cookie(s.stickyCookie); err == nil {
+			return cookie.Value
+		}
+	}
+
+	return ""
+}
+
+// recordVariant counts a request and, when it failed, an error against
+// the variant that served it. That is the chosen variant, unless none of
+// its backends was available and the request fell back to another one.
+func (p *ProxyHandler) recordVariant(ctx context.Context, variant *splitVariant, result *attemptResult, err error) {
+	if variant == nil {
+		return
+	}
+	if result != nil && result.backend.variant != nil {
+		variant = result.backend.variant
+	}
+
+	p.metrics.variantRequests.Add(ctx, 1, variant.attributes)
+
+	if err != nil || result.response.StatusCode >= http.StatusInternalServerError {
+		p.metrics.variantErrors.Add(ctx, 1, variant.attributes)
+	}
+}
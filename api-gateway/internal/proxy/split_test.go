@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func newTestSplitRoute(prefix string, stableWeight, canaryWeight int, stableUrl, canaryUrl string) config.Route {
+	return config.Route{
+		Prefix: prefix,
+		Split: &config.TrafficSplit{
+			StickyHeader: "X-User-Id",
+			Variants: []config.SplitVariant{
+				{Name: "stable", Weight: stableWeight, Backends: []config.Backend{{Url: stableUrl}}},
+				{Name: "canary", Weight: canaryWeight, Backends: []config.Backend{{Url: canaryUrl}}},
+			},
+		},
+	}
+}
+
+// variantCounts returns the sum of a counter by variant.
+func variantCounts(t *testing.T, reader *sdkmetric.ManualReader, name string) map[string]int64 {
+	t.Helper()
+
+	var data metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.Background(), &data))
+
+	counts := make(map[string]int64)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				variant, _ := point.Attributes.Value(attribute.Key("variant"))
+				counts[variant.AsString()] += point.Value
+			}
+		}
+	}
+
+	return counts
+}
+
+func TestTrafficSplit_Choose(t *testing.T) {
+	route, err := newRoute(newTestSplitRoute("/checkout", 90, 10, "http://stable:8080", "http://canary:8080"))
+	assert.NoError(t, err)
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		counts[route.split.choose(httptest.NewRequest(http.MethodGet, "/checkout", nil)).name]++
+	}
+	assert.InDelta(t, 9000, counts["stable"], 300)
+	assert.InDelta(t, 1000, counts["canary"], 300)
+
+	// the same sticky value always lands on the same variant
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/checkout", nil)
+		r.Header.Set("X-User-Id", fmt.Sprint("user-", i))
+		first := route.split.choose(r)
+		for j := 0; j < 5; j++ {
+			assert.Same(t, first, route.split.choose(r))
+		}
+	}
+
+	cookieRoute := newTestSplitRoute("/checkout", 50, 50, "http://stable:8080", "http://canary:8080")
+	cookieRoute.Split.StickyHeader = ""
+	cookieRoute.Split.StickyCookie = "session"
+	route, err = newRoute(cookieRoute)
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/checkout", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "abc"})
+	first := route.split.choose(r)
+	for j := 0; j < 5; j++ {
+		assert.Same(t, first, route.split.choose(r))
+	}
+}
+
+func TestServeHTTP_TrafficSplit(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Variant", "stable")
+	}))
+	defer stable.Close()
+
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Variant", "canary")
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer canary.Close()
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	proxyHandler.metrics.variantRequests, _ = meter.Int64Counter("variant_requests")
+	proxyHandler.metrics.variantErrors, _ = meter.Int64Counter("variant_errors")
+
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{newTestSplitRoute("/checkout", 50, 50, stable.URL, canary.URL)}))
+
+	served := make(map[string]int)
+	for i := 0; i < 50; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/checkout", nil)
+		r.Header.Set("X-User-Id", fmt.Sprint("user-", i))
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, r)
+		served[rr.Header().Get("X-Variant")]++
+	}
+
+	assert.Greater(t, served["stable"], 0)
+	assert.Greater(t, served["canary"], 0)
+	assert.Equal(t, map[string]int64{"stable": int64(served["stable"]), "canary": int64(served["canary"])}, variantCounts(t, reader, "variant_requests"))
+	assert.Equal(t, map[string]int64{"canary": int64(served["canary"])}, variantCounts(t, reader, "variant_errors"))
+
+	// a reload shifts the weights without restarting the gateway
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{newTestSplitRoute("/checkout", 0, 100, stable.URL, canary.URL)}))
+
+	for i := 0; i < 20; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/checkout", nil)
+		r.Header.Set("X-User-Id", fmt.Sprint("user-", i))
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, r)
+		assert.Equal(t, "canary", rr.Header().Get("X-Variant"))
+	}
+}
+
+func TestServeHTTP_TrafficSplitFallsBackToOtherVariants(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Variant", "stable")
+	}))
+	defer stable.Close()
+
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test")
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	proxyHandler.metrics.variantRequests, _ = meter.Int64Counter("variant_requests")
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{newTestSplitRoute("/checkout", 0, 100, stable.URL, "http://canary.invalid")}))
+
+	route := proxyHandler.Routes()["/checkout"]
+	for _, backend := range route.Backends {
+		if backend.variant.name == "canary" {
+			backend.healthy.Store(false)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/checkout", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "stable", rr.Header().Get("X-Variant"))
+	assert.Equal(t, map[string]int64{"stable": 1}, variantCounts(t, reader, "variant_requests"), "counted against the variant that served it")
+}
+
+func TestReplaceRoutes_InvalidSplits(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	backends := []config.Backend{{Url: "http://checkout:8080"}}
+
+	tests := []struct {
+		name  string
+		split config.TrafficSplit
+	}{
+		{"no variants", config.TrafficSplit{}},
+		{"zero weights", config.TrafficSplit{Variants: []config.SplitVariant{{Name: "stable", Backends: backends}}}},
+		{"missing name", config.TrafficSplit{Variants: []config.SplitVariant{{Weight: 1, Backends: backends}}}},
+		{"duplicate names", config.TrafficSplit{Variants: []config.SplitVariant{{Name: "a", Weight: 1, Backends: backends}, {Name: "a", Weight: 1, Backends: backends}}}},
+		{"variant without backends", config.TrafficSplit{Variants: []config.SplitVariant{{Name: "stable", Weight: 1}}}},
+		{"header and cookie", config.TrafficSplit{StickyHeader: "X-User-Id", StickyCookie: "session", Variants: []config.SplitVariant{{Name: "stable", Weight: 1, Backends: backends}}}},
+	}
+
+	for _, tc := range tests {
+		err := proxyHandler.ReplaceRoutes([]config.Route{{Prefix: "/checkout", Split: &tc.split}})
+		assert.ErrorIs(t, err, config.ErrInvalidConfiguration, tc.name)
+	}
+
+	err := proxyHandler.ReplaceRoutes([]config.Route{{Prefix: "/checkout", Backends: backends, Split: &config.TrafficSplit{
+		Variants: []config.SplitVariant{{Name: "stable", Weight: 1, Backends: backends}},
+	}}})
+	assert.ErrorIs(t, err, config.ErrInvalidConfiguration, "backends outside the variants")
+}
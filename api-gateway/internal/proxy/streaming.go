@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultStreamIdleTimeout = 5 * time.Minute
+
+// defaultStreamContentTypes are the content types of responses relayed as streams unless a route configures its own.
+var defaultStreamContentTypes = []string{"text/event-stream", "application/x-ndjson"}
+
+// Reasons a stream was closed for, as recorded on its span.
+const (
+	streamCompleted     = "completed"
+	streamIdleTimeout   = "idle_timeout"
+	streamClientClosed  = "client_closed"
+	streamBackendClosed = "backend_closed"
+)
+
+// streamingPolicy decides which responses of a route are streams and how
+// they are relayed. Responses with one of its content types, or every
+// response when always is set, are streams. Streams are written to the
+// client as they arrive, flushed after every read or at most every
+// flushInterval, and are not bound by the request timeout; instead they
+// are closed when the backend sends nothing for idleTimeout.
+type streamingPolicy struct {
+	always        bool
+	contentTypes  []string
+	flushInterval time.Duration
+	idleTimeout   time.Duration
+}
+
+// newStreamingPolicy builds the streaming policy of a route, streamingConfig may be nil.
+func newStreamingPolicy(streamingConfig *config.Streaming) *streamingPolicy {
+	policy := &streamingPolicy{
+		contentTypes: defaultStreamContentTypes,
+		idleTimeout:  defaultStreamIdleTimeout,
+	}
+	if streamingConfig == nil {
+		return policy
+	}
+
+	policy.always = streamingConfig.Always
+	policy.flushInterval = streamingConfig.FlushInterval
+	if len(streamingConfig.ContentTypes) > 0 {
+		policy.contentTypes = make([]string, 0, len(streamingConfig.ContentTypes))
+		for _, contentType := range streamingConfig.ContentTypes {
+			policy.contentTypes = append(policy.contentTypes, strings.ToLower(strings.TrimSpace(contentType)))
+		}
+	}
+	if streamingConfig.IdleTimeout > 0 {
+		policy.idleTimeout = streamingConfig.IdleTimeout
+	}
+
+	return policy
+}
+
+// detects reports whether a response is relayed as a stream.
+func (s *streamingPolicy) detects(response *http.Response) bool {
+	if s == nil {
+		return false
+	}
+	if s.always {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	for _, contentType := range s.contentTypes {
+		if mediaType == contentType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stream relays the body of a streamed response to the client as it
+// arrives. The response headers must already be written and the request
+// timeout of the attempt stopped; the stream instead ends when the backend
+// sends nothing for the idle timeout of the route.
+func (p *ProxyHandler) stream(w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, result *attemptResult) {
+	policy := route.streaming
+	controller := http.NewResponseController(w)
+
+	writer := &flushWriter{writer: w, controller: controller, interval: policy.flushInterval}
+	defer writer.close()
+
+	// send the headers right away, clients wait for them before the first event
+	writer.flushNow()
+
+	var idled atomic.Bool
+	idleTimer := time.AfterFunc(policy.idleTimeout, func() {
+		idled.Store(true)
+		result.abort(ErrStreamIdle)
+	})
+	defer idleTimer.Stop()
+
+	reader := &activityReader{
+		Reader: result.response.Body,
+		touch:  func() { idleTimer.Reset(policy.idleTimeout) },
+	}
+
+	written, err := io.Copy(writer, reader)
+
+	closeReason := streamCompleted
+	switch {
+	case idled.Load():
+		closeReason = streamIdleTimeout
+		span.AddEvent("stream_idle_timeout")
+		p.Telemetry.LogErrorf("stream of route %v idle for %v, closed", route.Prefix, policy.idleTimeout)
+	case writer.failed() || r.Context().Err() != nil:
+		closeReason = streamClientClosed
+	case err != nil:
+		closeReason = streamBackendClosed
+		span.RecordError(err)
+	}
+
+	span.SetAttributes(
+		attribute.Bool("gateway.stream", true),
+		attribute.String("gateway.stream.close_reason", closeReason),
+		attribute.Int64("gateway.stream.bytes", written),
+	)
+}
+
+// abort cancels the attempt of the result with cause.
+func (a *attemptResult) abort(cause error) {
+	if a.cancelAttempt != nil {
+		a.cancelAttempt(cause)
+	} else if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// flushWriter flushes what is written to the client, either after every
+// write or, with an interval, at most once per interval.
+type flushWriter struct {
+	mu         sync.Mutex
+	writer     io.Writer
+	controller *http.ResponseController
+	interval   time.Duration
+	timer      *time.Timer
+	pending    bool
+	closed     bool
+	err        error
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.err != nil {
+		return 0, f.err
+	}
+
+	n, err := f.writer.Write(b)
+	if err != nil {
+		f.err = err
+		return n, err
+	}
+
+	if f.interval <= 0 {
+		f.flushLocked()
+		return n, f.err
+	}
+
+	if !f.pending {
+		f.pending = true
+		if f.timer == nil {
+			f.timer = time.AfterFunc(f.interval, f.flushNow)
+		} else {
+			f.timer.Reset(f.interval)
+		}
+	}
+
+	return n, nil
+}
+
+// flushNow flushes everything written so far.
+func (f *flushWriter) flushNow() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.closed {
+		f.flushLocked()
+	}
+}
+
+func (f *flushWriter) flushLocked() {
+	f.pending = false
+	if f.err != nil {
+		return
+	}
+
+	if err := f.controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		f.err = err
+	}
+}
+
+// failed reports whether writing to the client failed.
+func (f *flushWriter) failed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err != nil
+}
+
+// close flushes what is still pending; the writer must not be used after
+// the handler returns, so no flush happens after close.
+func (f *flushWriter) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	if f.pending {
+		f.flushLocked()
+	}
+	f.closed = true
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamingPolicy_Detects(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      *config.Streaming
+		contentType string
+		expected    bool
+	}{
+		{"event stream", nil, "text/event-stream", true},
+		{"event stream with parameters", nil, "text/event-stream; charset=utf-8", true},
+		{"ndjson", nil, "application/x-ndjson", true},
+		{"json", nil, "application/json", false},
+		{"missing content type", nil, "", false},
+		{"configured content type", &config.Streaming{ContentTypes: []string{"Application/JSON-Seq"}}, "application/json-seq", true},
+		{"configured replaces defaults", &config.Streaming{ContentTypes: []string{"application/json-seq"}}, "text/event-stream", false},
+		{"always", &config.Streaming{Always: true}, "application/json", true},
+	}
+
+	for _, tc := range tests {
+		response := &http.Response{Header: http.Header{}}
+		response.Header.Set("Content-Type", tc.contentType)
+		assert.Equal(t, tc.expected, newStreamingPolicy(tc.config).detects(response), tc.name)
+	}
+}
+
+func TestServeHTTP_ServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+
+		// the rest of the stream comes after the request timeout
+		<-next
+		time.Sleep(150 * time.Millisecond)
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 100*time.Millisecond)
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/events", backend.URL)))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/events")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(response.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	close(next)
+
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_request") != nil }, time.Second, 10*time.Millisecond)
+	attributes := spanAttributeMap(telem.endedSpan("api_gateway_request"))
+	assert.True(t, attributes["gateway.stream"].AsBool())
+	assert.Equal(t, streamCompleted, attributes["gateway.stream.close_reason"].AsString())
+	assert.Equal(t, int64(27), attributes["gateway.stream.bytes"].AsInt64())
+}
+
+func TestServeHTTP_StreamIdleTimeout(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = io.WriteString(w, "{\"n\":1}\n")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	routeConfig := newTestRouteConfig("/feed", backend.URL)
+	routeConfig.Streaming = &config.Streaming{IdleTimeout: 100 * time.Millisecond}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	start := time.Now()
+	response, err := http.Get(gateway.URL + "/feed")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	assert.Equal(t, "{\"n\":1}\n", string(body))
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_request") != nil }, time.Second, 10*time.Millisecond)
+	span := telem.endedSpan("api_gateway_request")
+	assert.Equal(t, streamIdleTimeout, spanAttributeMap(span)["gateway.stream.close_reason"].AsString())
+	if assert.NotEmpty(t, span.Events()) {
+		assert.Equal(t, "stream_idle_timeout", span.Events()[len(span.Events())-1].Name)
+	}
+}
+
+func TestServeHTTP_RequestTimeoutCoversBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "partial")
+		w.(http.Flusher).Flush()
+
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 100*time.Millisecond)
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/slow", backend.URL)))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	start := time.Now()
+	response, err := http.Get(gateway.URL + "/slow")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	body, _ := io.ReadAll(response.Body)
+	assert.Equal(t, "partial", string(body))
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+// flushCounter counts the flushes of a response.
+type flushCounter struct {
+	*httptest.ResponseRecorder
+	flushes atomic.Int32
+}
+
+func (f *flushCounter) Flush() {
+	f.flushes.Add(1)
+}
+
+func TestFlushWriter(t *testing.T) {
+	immediate := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	writer := &flushWriter{writer: immediate, controller: http.NewResponseController(immediate)}
+	for range 3 {
+		_, err := writer.Write([]byte("event\n"))
+		assert.NoError(t, err)
+	}
+	writer.close()
+	assert.Equal(t, int32(3), immediate.flushes.Load())
+
+	batched := &flushCounter{ResponseRecorder: httptest.NewRecorder()}
+	writer = &flushWriter{writer: batched, controller: http.NewResponseController(batched), interval: 50 * time.Millisecond}
+	for range 3 {
+		_, err := writer.Write([]byte("event\n"))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(0), batched.flushes.Load())
+	assert.Eventually(t, func() bool { return batched.flushes.Load() == 1 }, time.Second, 10*time.Millisecond)
+
+	_, err := writer.Write([]byte("last\n"))
+	assert.NoError(t, err)
+	writer.close()
+	assert.Equal(t, int32(2), batched.flushes.Load())
+	assert.Equal(t, "event\nevent\nevent\nlast\n", batched.Body.String())
+}
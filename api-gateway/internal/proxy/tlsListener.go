@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"github.com/fsnotify/fsnotify"
+)
+
+// certificateReloadDelay lets the writes of a certificate and its key
+// settle, as they are usually replaced one after the other.
+const certificateReloadDelay = 200 * time.Millisecond
+
+// CertificateStore holds the certificates of a TLS listener and picks one
+// per handshake by the server name the client asks for. It reloads them
+// when their files change, keeping the current certificates when the new
+// ones cannot be loaded.
+type CertificateStore struct {
+	files        []config.Certificate
+	certificates atomic.Pointer[[]*tls.Certificate]
+	telemetry    telemetry.TelemetryProvider
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewCertificateStore loads the certificates and watches their files until Close.
+func NewCertificateStore(telemetryProvider telemetry.TelemetryProvider, certificates []config.Certificate) (*CertificateStore, error) {
+	s := &CertificateStore{
+		files:     certificates,
+		telemetry: telemetryProvider,
+		done:      make(chan struct{}),
+	}
+
+	err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	s.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// directories are watched rather than files, so certificates replaced by
+	// a rename or a symlink swap, as Kubernetes does with secrets, are seen too
+	for _, directory := range s.directories() {
+		if err := s.watcher.Add(directory); err != nil {
+			s.watcher.Close()
+			return nil, fmt.Errorf("failed to watch %v: %w", directory, err)
+		}
+	}
+
+	go s.watch()
+
+	return s, nil
+}
+
+func (s *CertificateStore) directories() []string {
+	var directories []string
+	seen := make(map[string]bool)
+
+	for _, file := range s.files {
+		for _, path := range []string{file.CertFile, file.KeyFile} {
+			directory := filepath.Dir(path)
+			if !seen[directory] {
+				seen[directory] = true
+				directories = append(directories, directory)
+			}
+		}
+	}
+
+	return directories
+}
+
+// Reload loads every certificate from its files and swaps them in together.
+func (s *CertificateStore) Reload() error {
+	certificates := make([]*tls.Certificate, 0, len(s.files))
+
+	for _, file := range s.files {
+		certificate, err := tls.LoadX509KeyPair(file.CertFile, file.KeyFile)
+		if err != nil {
+			return fmt.Errorf("%w %v: %w", ErrLoadCertificate, file.CertFile, err)
+		}
+		certificates = append(certificates, &certificate)
+	}
+
+	s.certificates.Store(&certificates)
+
+	return nil
+}
+
+func (s *CertificateStore) watch() {
+	defer close(s.done)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case _, ok := <-s.watcher.Events:
+			if !ok {
+				return
+			}
+			reload = time.After(certificateReloadDelay)
+		case err, ok := <-s.watcher.Errors:
+			if !ok {
+				return
+			}
+			s.telemetry.LogErrorf("failed to watch certificates: %v", err)
+		case <-reload:
+			reload = nil
+			if err := s.Reload(); err != nil {
+				s.telemetry.LogErrorf("failed to reload certificates, keeping the current ones: %v", err)
+			} else {
+				s.telemetry.LogInfof("reloaded %d certificates", len(s.files))
+			}
+		}
+	}
+}
+
+// GetCertificate returns the first certificate that is valid for the
+// server name of the client, or the first certificate when none is.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *s.certificates.Load()
+
+	for _, certificate := range certificates {
+		if hello.SupportsCertificate(certificate) == nil {
+			return certificate, nil
+		}
+	}
+
+	return certificates[0], nil
+}
+
+// Close stops watching the certificate files.
+func (s *CertificateStore) Close() error {
+	err := s.watcher.Close()
+	<-s.done
+
+	return err
+}
+
+// NewTLSConfig builds the TLS configuration of a listener, which takes its
+// certificates from store and offers HTTP/2 and HTTP/1.1. The minimum
+// version is TLS 1.2 unless the listener requires 1.3, and cipher suites,
+// named as in crypto/tls, limit the TLS 1.2 suites, as TLS 1.3 suites are
+// not configurable.
+func NewTLSConfig(listenerConfig config.TLSListener, store *CertificateStore) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+
+	switch listenerConfig.MinVersion {
+	case "", config.TLSVersion12:
+	case config.TLSVersion13:
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("%w: unknown minimum TLS version %q", ErrInvalidTLSPolicy, listenerConfig.MinVersion)
+	}
+
+	for _, name := range listenerConfig.CipherSuites {
+		id, ok := tls12CipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown or insecure TLS 1.2 cipher suite %q", ErrInvalidTLSPolicy, name)
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+
+	return tlsConfig, nil
+}
+
+// tls12CipherSuite looks up a secure cipher suite usable with TLS 1.2 by its name.
+func tls12CipherSuite(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name != name {
+			continue
+		}
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				return suite.ID, true
+			}
+		}
+	}
+
+	return 0, false
+}
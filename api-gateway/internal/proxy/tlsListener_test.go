@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/brandoyts/api-gateway/internal/telemetry"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self-signed certificate for dnsNames and its
+// key to dir, as name.crt and name.key.
+func writeTestCertificate(t *testing.T, dir string, name string, dnsNames ...string) config.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial number: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	privateKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	files := config.Certificate{
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	// the key goes first, so a watcher sees the pair complete once the certificate changes
+	writeTestFile(t, files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKey}))
+	writeTestFile(t, files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}))
+
+	return files
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("failed to write %v: %v", path, err)
+	}
+}
+
+func newTestCertificateStore(t *testing.T, certificates ...config.Certificate) *CertificateStore {
+	t.Helper()
+
+	telem, err := telemetry.NewNoopTelemetry(telemetry.TelemetryConfiguration{})
+	if err != nil {
+		t.Fatalf("failed to create noop telemetry: %v", err)
+	}
+
+	store, err := NewCertificateStore(telem, certificates)
+	if err != nil {
+		t.Fatalf("failed to create certificate store: %v", err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+
+	return store
+}
+
+// servedCertificate returns the certificate the store hands to a client asking for serverName.
+func servedCertificate(t *testing.T, store *CertificateStore, serverName string) *x509.Certificate {
+	t.Helper()
+
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:        serverName,
+		SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		SupportedVersions: []uint16{tls.VersionTLS13},
+	})
+	if err != nil {
+		t.Fatalf("failed to get certificate: %v", err)
+	}
+
+	return certificate.Leaf
+}
+
+func TestCertificateStore_SelectsBySNI(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestCertificateStore(t,
+		writeTestCertificate(t, dir, "api", "api.example.com"),
+		writeTestCertificate(t, dir, "wildcard", "*.internal.example.com"),
+	)
+
+	assert.Equal(t, []string{"api.example.com"}, servedCertificate(t, store, "api.example.com").DNSNames)
+	assert.Equal(t, []string{"*.internal.example.com"}, servedCertificate(t, store, "user.internal.example.com").DNSNames)
+	// unknown names and clients without SNI get the first certificate
+	assert.Equal(t, []string{"api.example.com"}, servedCertificate(t, store, "other.example.com").DNSNames)
+	assert.Equal(t, []string{"api.example.com"}, servedCertificate(t, store, "").DNSNames)
+}
+
+func TestCertificateStore_ServesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	store := newTestCertificateStore(t,
+		writeTestCertificate(t, dir, "api", "api.example.com"),
+		writeTestCertificate(t, dir, "admin", "admin.example.com"),
+	)
+
+	tlsConfig, err := NewTLSConfig(config.TLSListener{}, store)
+	assert.NoError(t, err)
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.ServerName))
+		}),
+		TLSConfig: tlsConfig,
+		Protocols: protocols,
+	}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: "admin.example.com", InsecureSkipVerify: true},
+		Protocols:       protocols,
+	}}
+	response, err := client.Get("https://" + listener.Addr().String() + "/")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer response.Body.Close()
+
+	assert.Equal(t, 2, response.ProtoMajor)
+	assert.Equal(t, []string{"admin.example.com"}, response.TLS.PeerCertificates[0].DNSNames)
+}
+
+func TestCertificateStore_ReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := writeTestCertificate(t, dir, "api", "api.example.com")
+	store := newTestCertificateStore(t, files)
+
+	first := servedCertificate(t, store, "api.example.com")
+
+	// a broken certificate keeps the current one in place
+	writeTestFile(t, files.CertFile, []byte("not a certificate"))
+	time.Sleep(3 * certificateReloadDelay)
+	assert.Equal(t, first.SerialNumber, servedCertificate(t, store, "api.example.com").SerialNumber)
+
+	writeTestCertificate(t, dir, "api", "api.example.com", "www.example.com")
+	assert.Eventually(t, func() bool {
+		return len(servedCertificate(t, store, "api.example.com").DNSNames) == 2
+	}, 5*time.Second, 20*time.Millisecond)
+}
+
+func TestNewCertificateStore_MissingFile(t *testing.T) {
+	telem, err := telemetry.NewNoopTelemetry(telemetry.TelemetryConfiguration{})
+	assert.NoError(t, err)
+
+	_, err = NewCertificateStore(telem, []config.Certificate{{
+		CertFile: filepath.Join(t.TempDir(), "missing.crt"),
+		KeyFile:  filepath.Join(t.TempDir(), "missing.key"),
+	}})
+
+	assert.ErrorIs(t, err, ErrLoadCertificate)
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	store := newTestCertificateStore(t, writeTestCertificate(t, t.TempDir(), "api", "api.example.com"))
+
+	tlsConfig, err := NewTLSConfig(config.TLSListener{}, store)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	assert.Nil(t, tlsConfig.CipherSuites)
+	assert.Equal(t, []string{"h2", "http/1.1"}, tlsConfig.NextProtos)
+
+	tlsConfig, err = NewTLSConfig(config.TLSListener{MinVersion: config.TLSVersion13}, store)
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	tlsConfig, err = NewTLSConfig(config.TLSListener{
+		CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+	}, store)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, tlsConfig.CipherSuites)
+
+	for _, name := range []string{"TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA", "TLS_UNKNOWN"} {
+		_, err = NewTLSConfig(config.TLSListener{CipherSuites: []string{name}}, store)
+		assert.ErrorIs(t, err, ErrInvalidTLSPolicy, name)
+	}
+}
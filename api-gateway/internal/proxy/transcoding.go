@@ -0,0 +1,668 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// maxTranscodedMessageBytes caps the JSON bodies and gRPC messages of
+// transcoded calls, at the default message size limit of gRPC.
+const maxTranscodedMessageBytes = 4 << 20
+
+// grpcTranscoder turns JSON requests into unary gRPC calls following the
+// google.api.http bindings of the methods in a descriptor set, a
+// FileDescriptorSet as written by protoc --include_imports
+// --descriptor_set_out. JSON fields use their lowerCamelCase names unless
+// proto names are configured, and fields with default values are left out
+// unless unpopulated fields are emitted.
+type grpcTranscoder struct {
+	bindings []*httpBinding
+	marshal  protojson.MarshalOptions
+}
+
+// httpBinding binds an HTTP method and path template to a gRPC method.
+type httpBinding struct {
+	method     protoreflect.MethodDescriptor
+	httpMethod string
+	template   *httpTemplate
+	// body is the request field the JSON body maps to, nil when it maps to the whole request or is not read
+	body []protoreflect.FieldDescriptor
+	// wholeBody is set when the body maps to the whole request
+	wholeBody bool
+	// responseBody is the response field sent as the JSON body, nil for the whole response
+	responseBody protoreflect.FieldDescriptor
+}
+
+// fullPath returns the /package.Service/Method path of the gRPC method.
+func (b *httpBinding) fullPath() string {
+	return "/" + string(b.method.Parent().FullName()) + "/" + string(b.method.Name())
+}
+
+func newGrpcTranscoder(transcodingConfig config.GrpcTranscoding) (*grpcTranscoder, error) {
+	data, err := os.ReadFile(transcodingConfig.DescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTranscoding, err)
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("%w: descriptor set %v: %w", ErrInvalidTranscoding, transcodingConfig.DescriptorSet, err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("%w: descriptor set %v: %w", ErrInvalidTranscoding, transcodingConfig.DescriptorSet, err)
+	}
+
+	transcoder := &grpcTranscoder{
+		marshal: protojson.MarshalOptions{
+			UseProtoNames:   transcodingConfig.UseProtoNames,
+			EmitUnpopulated: transcodingConfig.EmitUnpopulated,
+		},
+	}
+
+	var errs []error
+	files.RangeFiles(func(file protoreflect.FileDescriptor) bool {
+		for i := 0; i < file.Services().Len(); i++ {
+			methods := file.Services().Get(i).Methods()
+			for j := 0; j < methods.Len(); j++ {
+				method := methods.Get(j)
+				rule, _ := proto.GetExtension(method.Options(), annotations.E_Http).(*annotations.HttpRule)
+				// streaming methods have no JSON counterpart, they stay reachable over gRPC
+				if rule == nil || method.IsStreamingClient() || method.IsStreamingServer() {
+					continue
+				}
+
+				for _, httpRule := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+					binding, err := newHTTPBinding(method, httpRule)
+					if err != nil {
+						errs = append(errs, fmt.Errorf("%v: %w", method.FullName(), err))
+						continue
+					}
+					transcoder.bindings = append(transcoder.bindings, binding)
+				}
+			}
+		}
+		return true
+	})
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidTranscoding, errors.Join(errs...))
+	}
+	if len(transcoder.bindings) == 0 {
+		return nil, fmt.Errorf("%w: descriptor set %v has no methods with HTTP bindings", ErrInvalidTranscoding, transcodingConfig.DescriptorSet)
+	}
+
+	return transcoder, nil
+}
+
+func newHTTPBinding(method protoreflect.MethodDescriptor, rule *annotations.HttpRule) (*httpBinding, error) {
+	binding := &httpBinding{method: method}
+
+	var path string
+	switch pattern := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		binding.httpMethod, path = http.MethodGet, pattern.Get
+	case *annotations.HttpRule_Put:
+		binding.httpMethod, path = http.MethodPut, pattern.Put
+	case *annotations.HttpRule_Post:
+		binding.httpMethod, path = http.MethodPost, pattern.Post
+	case *annotations.HttpRule_Delete:
+		binding.httpMethod, path = http.MethodDelete, pattern.Delete
+	case *annotations.HttpRule_Patch:
+		binding.httpMethod, path = http.MethodPatch, pattern.Patch
+	case *annotations.HttpRule_Custom:
+		binding.httpMethod, path = strings.ToUpper(pattern.Custom.GetKind()), pattern.Custom.GetPath()
+	}
+	if binding.httpMethod == "" || path == "" {
+		return nil, errors.New("HTTP rule has no method or path")
+	}
+
+	template, err := parseHTTPTemplate(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, variable := range template.variables {
+		if _, err := resolveFieldPath(method.Input(), variable.fieldPath); err != nil {
+			return nil, fmt.Errorf("path %v: %w", path, err)
+		}
+	}
+	binding.template = template
+
+	switch body := rule.GetBody(); body {
+	case "":
+	case "*":
+		binding.wholeBody = true
+	default:
+		binding.body, err = resolveFieldPath(method.Input(), []string{body})
+		if err != nil {
+			return nil, fmt.Errorf("body: %w", err)
+		}
+	}
+
+	if responseBody := rule.GetResponseBody(); responseBody != "" {
+		fields, err := resolveFieldPath(method.Output(), []string{responseBody})
+		if err != nil {
+			return nil, fmt.Errorf("response body: %w", err)
+		}
+		binding.responseBody = fields[0]
+	}
+
+	return binding, nil
+}
+
+// resolveFieldPath resolves a path of field names, proto or JSON names, starting at message.
+func resolveFieldPath(message protoreflect.MessageDescriptor, fieldPath []string) ([]protoreflect.FieldDescriptor, error) {
+	fields := make([]protoreflect.FieldDescriptor, 0, len(fieldPath))
+
+	for i, name := range fieldPath {
+		if message == nil {
+			return nil, fmt.Errorf("field %v is not a message", strings.Join(fieldPath[:i], "."))
+		}
+
+		field := message.Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			field = message.Fields().ByJSONName(name)
+		}
+		if field == nil {
+			return nil, fmt.Errorf("%v has no field %v", message.FullName(), name)
+		}
+		fields = append(fields, field)
+
+		message = nil
+		if field.Message() != nil && !field.IsList() && !field.IsMap() {
+			message = field.Message()
+		}
+	}
+
+	return fields, nil
+}
+
+// match returns the binding for a request and the values of its path
+// variables. Without a binding, it returns the methods bound to the path.
+func (t *grpcTranscoder) match(r *http.Request) (*httpBinding, map[string]string, map[string]bool) {
+	allowed := make(map[string]bool)
+
+	for _, binding := range t.bindings {
+		values, ok := binding.template.match(r.URL.EscapedPath())
+		if !ok {
+			continue
+		}
+		if binding.httpMethod != r.Method {
+			allowed[binding.httpMethod] = true
+			continue
+		}
+
+		return binding, values, nil
+	}
+
+	return nil, nil, allowed
+}
+
+// serveTranscoded answers a JSON request by calling the gRPC method bound
+// to its path. Path variables, query parameters and the body make up the
+// request message; the response message, or its response body field, is
+// sent back as JSON. gRPC errors are answered as problems with the HTTP
+// status matching their code.
+func (p *ProxyHandler) serveTranscoded(ctx context.Context, w http.ResponseWriter, r *http.Request, span trace.Span, route *Route, variant *splitVariant) {
+	binding, values, allowed := route.transcoder.match(r)
+	if binding == nil {
+		if len(allowed) > 0 {
+			p.failMethodNotAllowed(w, r, span, allowed)
+			return
+		}
+		p.failRequest(w, r, span, route, ErrNoGrpcBinding, http.StatusNotFound)
+		return
+	}
+
+	fullPath := binding.fullPath()
+	span.SetAttributes(grpcMethodAttributes(fullPath)...)
+	span.SetAttributes(attribute.Bool("gateway.transcoded", true))
+
+	message, err := binding.requestMessage(r, values)
+	if err != nil {
+		p.Telemetry.LogErrorln(ErrTranscodeRequest, err)
+		p.failRequest(w, r, span, route, fmt.Errorf("%w: %w", ErrTranscodeRequest, err), http.StatusBadRequest)
+		return
+	}
+
+	grpcRequest := r.Clone(ctx)
+	grpcRequest.Method = http.MethodPost
+	grpcRequest.URL.Path = fullPath
+	grpcRequest.URL.RawPath = ""
+	grpcRequest.URL.RawQuery = ""
+	removeHopByHopHeaders(grpcRequest.Header)
+	grpcRequest.Header.Del("Content-Length")
+	grpcRequest.Header.Del("Accept-Encoding")
+	grpcRequest.Header.Set("Content-Type", "application/grpc+proto")
+	grpcRequest.Body = io.NopCloser(bytes.NewReader(message))
+	grpcRequest.ContentLength = int64(len(message))
+
+	result, err := p.forward(ctx, grpcRequest, route, variant, fullPath)
+	p.recordVariant(ctx, variant, result, err)
+	if err != nil {
+		p.failForward(w, r, span, route, err)
+		return
+	}
+	defer result.close()
+
+	body, err := binding.responseJSON(result.response, route.transcoder.marshal)
+	recordGrpcStatus(span, result.span, result.response)
+
+	var statusErr *grpcStatusError
+	switch {
+	case errors.As(err, &statusErr):
+		p.failRequest(w, r, span, route, errors.New(statusErr.message), httpStatusForGrpc(statusErr.code))
+		return
+	case err != nil:
+		p.Telemetry.LogErrorln(ErrTranscodeResponse, err)
+		p.failRequest(w, r, span, route, fmt.Errorf("%w: %w", ErrTranscodeResponse, err), http.StatusBadGateway)
+		return
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(http.StatusOK))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
+
+// requestMessage builds the framed gRPC request message from the request.
+func (b *httpBinding) requestMessage(r *http.Request, values map[string]string) ([]byte, error) {
+	input := b.method.Input()
+	message := dynamicpb.NewMessage(input)
+
+	if b.wholeBody || b.body != nil {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxTranscodedMessageBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxTranscodedMessageBytes {
+			return nil, fmt.Errorf("body is larger than %d bytes", maxTranscodedMessageBytes)
+		}
+
+		if len(bytes.TrimSpace(data)) > 0 {
+			if b.wholeBody {
+				err = protojson.Unmarshal(data, message)
+			} else {
+				err = mergeJSONField(message, b.body, data)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	bound := make(map[string]bool, len(values))
+	for _, variable := range b.template.variables {
+		fields, _ := resolveFieldPath(input, variable.fieldPath)
+		if err := mergeFieldValue(message, fields, values[variable.name()]); err != nil {
+			return nil, fmt.Errorf("path variable %v: %w", variable.name(), err)
+		}
+		bound[variable.name()] = true
+	}
+
+	// query parameters fill the fields the path and body leave, unknown ones are ignored
+	if !b.wholeBody {
+		for key, queryValues := range r.URL.Query() {
+			if bound[key] || (b.body != nil && strings.SplitN(key, ".", 2)[0] == string(b.body[0].Name())) {
+				continue
+			}
+			fields, err := resolveFieldPath(input, strings.Split(key, "."))
+			if err != nil {
+				continue
+			}
+			for _, value := range queryValues {
+				if err := mergeFieldValue(message, fields, value); err != nil {
+					return nil, fmt.Errorf("query parameter %v: %w", key, err)
+				}
+			}
+		}
+	}
+
+	encoded, err := proto.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > maxTranscodedMessageBytes {
+		return nil, fmt.Errorf("message is larger than %d bytes", maxTranscodedMessageBytes)
+	}
+
+	frame := make([]byte, 5, 5+len(encoded))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(encoded)))
+	return append(frame, encoded...), nil
+}
+
+// mergeJSONField merges a JSON value into the field at fields of message.
+func mergeJSONField(message *dynamicpb.Message, fields []protoreflect.FieldDescriptor, value json.RawMessage) error {
+	for i := len(fields) - 1; i >= 0; i-- {
+		name, _ := json.Marshal(string(fields[i].Name()))
+		value = json.RawMessage(`{` + string(name) + `:` + string(value) + `}`)
+	}
+
+	part := dynamicpb.NewMessage(message.Descriptor())
+	if err := protojson.Unmarshal(value, part); err != nil {
+		return err
+	}
+	proto.Merge(message, part)
+
+	return nil
+}
+
+// mergeFieldValue merges a path or query value into the field at fields of
+// message, appending to repeated fields. The value is given to protojson as
+// a string, which it accepts for numbers and well-known types as well.
+func mergeFieldValue(message *dynamicpb.Message, fields []protoreflect.FieldDescriptor, value string) error {
+	leaf := fields[len(fields)-1]
+
+	encoded, _ := json.Marshal(value)
+	switch leaf.Kind() {
+	case protoreflect.BoolKind:
+		if value == "true" || value == "false" {
+			encoded = []byte(value)
+		}
+	case protoreflect.EnumKind:
+		if _, err := strconv.ParseInt(value, 10, 32); err == nil {
+			encoded = []byte(value)
+		}
+	}
+	if leaf.IsList() {
+		encoded = []byte("[" + string(encoded) + "]")
+	}
+
+	return mergeJSONField(message, fields, encoded)
+}
+
+// grpcStatusError is a call that ended with a status other than OK.
+type grpcStatusError struct {
+	code    int
+	message string
+}
+
+func (e *grpcStatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %v", e.code, e.message)
+}
+
+// responseJSON reads the gRPC response of a unary call and returns it as JSON.
+func (b *httpBinding) responseJSON(response *http.Response, marshal protojson.MarshalOptions) ([]byte, error) {
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("backend answered %v", response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxTranscodedMessageBytes+6))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxTranscodedMessageBytes+5 {
+		return nil, fmt.Errorf("response is larger than %d bytes", maxTranscodedMessageBytes)
+	}
+
+	code, ok := grpcStatus(response)
+	if !ok {
+		return nil, errors.New("response has no grpc-status")
+	}
+	if code != grpcOK {
+		message := response.Trailer.Get("Grpc-Message")
+		if message == "" {
+			message = response.Header.Get("Grpc-Message")
+		}
+		if decoded, err := url.PathUnescape(message); err == nil {
+			message = decoded
+		}
+		return nil, &grpcStatusError{code: code, message: message}
+	}
+
+	if len(data) < 5 {
+		return nil, errors.New("response has no message")
+	}
+	if data[0] != 0 {
+		return nil, errors.New("response message is compressed")
+	}
+	length := binary.BigEndian.Uint32(data[1:5])
+	if uint64(len(data)-5) < uint64(length) {
+		return nil, errors.New("response message is truncated")
+	}
+
+	message := dynamicpb.NewMessage(b.method.Output())
+	if err := proto.Unmarshal(data[5:5+length], message); err != nil {
+		return nil, err
+	}
+
+	if b.responseBody == nil {
+		return marshal.Marshal(message)
+	}
+
+	// marshal the whole message to render the field the way protojson does and pick it out
+	encoded, err := marshal.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &object); err != nil {
+		return nil, err
+	}
+
+	key := b.responseBody.JSONName()
+	if marshal.UseProtoNames {
+		key = string(b.responseBody.Name())
+	}
+	if value, ok := object[key]; ok {
+		return value, nil
+	}
+
+	return []byte("null"), nil
+}
+
+// httpStatusForGrpc maps a gRPC status code to the HTTP status of a transcoded response.
+func httpStatusForGrpc(code int) int {
+	switch code {
+	case grpcOK:
+		return http.StatusOK
+	case grpcCanceled:
+		return 499
+	case grpcInvalidArgument, grpcFailedPrecondition, grpcOutOfRange:
+		return http.StatusBadRequest
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcNotFound:
+		return http.StatusNotFound
+	case grpcAlreadyExists, grpcAborted:
+		return http.StatusConflict
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnimplemented:
+		return http.StatusNotImplemented
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// templateSegmentKind is the kind of a segment of an HTTP rule path template.
+type templateSegmentKind int
+
+const (
+	segmentLiteral templateSegmentKind = iota
+	// segmentWildcard matches a single path segment
+	segmentWildcard
+	// segmentDeepWildcard matches any number of path segments
+	segmentDeepWildcard
+)
+
+type templateSegment struct {
+	kind    templateSegmentKind
+	literal string
+}
+
+// templateVariable binds the path segments from start up to end to a request field.
+type templateVariable struct {
+	fieldPath  []string
+	start, end int
+}
+
+func (v templateVariable) name() string {
+	return strings.Join(v.fieldPath, ".")
+}
+
+// httpTemplate is a parsed google.api.http path template, such as
+// /v1/{name=shelves/*/books/*} or /v1/users/{id}:activate.
+type httpTemplate struct {
+	segments  []templateSegment
+	variables []templateVariable
+	verb      string
+}
+
+func parseHTTPTemplate(template string) (*httpTemplate, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("path template %q must start with /", template)
+	}
+
+	parsed := &httpTemplate{}
+	rest := template[1:]
+
+	// a verb follows the last segment, outside of any variable
+	if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.ContainsAny(rest[i:], "/}") {
+		parsed.verb = rest[i+1:]
+		rest = rest[:i]
+	}
+
+	for rest != "" {
+		if strings.HasPrefix(rest, "{") {
+			end := strings.Index(rest, "}")
+			if end < 0 {
+				return nil, fmt.Errorf("path template %q has an unclosed variable", template)
+			}
+
+			fieldPath, pattern, hasPattern := strings.Cut(rest[1:end], "=")
+			if !hasPattern {
+				pattern = "*"
+			}
+
+			variable := templateVariable{fieldPath: strings.Split(fieldPath, "."), start: len(parsed.segments)}
+			for _, segment := range strings.Split(pattern, "/") {
+				parsed.segments = append(parsed.segments, newTemplateSegment(segment))
+			}
+			variable.end = len(parsed.segments)
+			parsed.variables = append(parsed.variables, variable)
+
+			rest = rest[end+1:]
+		} else {
+			segment, next, _ := strings.Cut(rest, "/")
+			if strings.ContainsAny(segment, "{}") {
+				return nil, fmt.Errorf("path template %q has a variable inside a segment", template)
+			}
+			parsed.segments = append(parsed.segments, newTemplateSegment(segment))
+			rest = next
+			continue
+		}
+
+		switch {
+		case rest == "":
+		case strings.HasPrefix(rest, "/"):
+			rest = rest[1:]
+		default:
+			return nil, fmt.Errorf("path template %q has a variable inside a segment", template)
+		}
+	}
+
+	for _, segment := range parsed.segments {
+		if segment.kind == segmentLiteral && segment.literal == "" {
+			return nil, fmt.Errorf("path template %q has an empty segment", template)
+		}
+	}
+
+	return parsed, nil
+}
+
+func newTemplateSegment(segment string) templateSegment {
+	switch segment {
+	case "*":
+		return templateSegment{kind: segmentWildcard}
+	case "**":
+		return templateSegment{kind: segmentDeepWildcard}
+	default:
+		return templateSegment{kind: segmentLiteral, literal: segment}
+	}
+}
+
+// match matches an escaped request path and returns the unescaped values of the variables.
+func (t *httpTemplate) match(path string) (map[string]string, bool) {
+	path = strings.TrimPrefix(path, "/")
+	if t.verb != "" {
+		var found bool
+		path, found = strings.CutSuffix(path, ":"+t.verb)
+		if !found {
+			return nil, false
+		}
+	}
+
+	parts := strings.Split(path, "/")
+	// bounds[i] is the index of the first path segment matched by template segment i
+	bounds := make([]int, len(t.segments)+1)
+	if !t.matchFrom(parts, 0, 0, bounds) {
+		return nil, false
+	}
+
+	values := make(map[string]string, len(t.variables))
+	for _, variable := range t.variables {
+		matched := parts[bounds[variable.start]:bounds[variable.end]]
+		unescaped := make([]string, len(matched))
+		for i, part := range matched {
+			value, err := url.PathUnescape(part)
+			if err != nil {
+				return nil, false
+			}
+			unescaped[i] = value
+		}
+		values[variable.name()] = strings.Join(unescaped, "/")
+	}
+
+	return values, true
+}
+
+func (t *httpTemplate) matchFrom(parts []string, segment, part int, bounds []int) bool {
+	bounds[segment] = part
+	if segment == len(t.segments) {
+		return part == len(parts)
+	}
+
+	switch current := t.segments[segment]; current.kind {
+	case segmentDeepWildcard:
+		for end := len(parts); end >= part; end-- {
+			if t.matchFrom(parts, segment+1, end, bounds) {
+				return true
+			}
+		}
+		return false
+	case segmentWildcard:
+		return part < len(parts) && parts[part] != "" && t.matchFrom(parts, segment+1, part+1, bounds)
+	default:
+		return part < len(parts) && parts[part] == current.literal && t.matchFrom(parts, segment+1, part+1, bounds)
+	}
+}
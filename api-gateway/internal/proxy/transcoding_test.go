@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// newTestUserService describes user.v1.UserService, as protoc would for:
+//
+//	message GetUserRequest { string id = 1; bool verbose = 2; repeated string fields = 3; }
+//	message User { string id = 1; string display_name = 2; int64 age = 3; }
+//	message UpdateUserRequest { string id = 1; User user = 2; }
+//	service UserService {
+//	  rpc GetUser(GetUserRequest) returns (User) { option (google.api.http) = { get: "/v1/users/{id}" }; }
+//	  rpc UpdateUser(UpdateUserRequest) returns (User) { option (google.api.http) = { patch: "/v1/users/{id}" body: "user" response_body: "display_name" }; }
+//	  rpc WatchUsers(GetUserRequest) returns (stream User) { option (google.api.http) = { get: "/v1/users:watch" }; }
+//	}
+func newTestUserService() *descriptorpb.FileDescriptorProto {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label, typeName string) *descriptorpb.FieldDescriptorProto {
+		field := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   kind.Enum(),
+			Label:  label.Enum(),
+		}
+		if typeName != "" {
+			field.TypeName = proto.String(typeName)
+		}
+		return field
+	}
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	method := func(name, input, output string, rule *annotations.HttpRule, streaming bool) *descriptorpb.MethodDescriptorProto {
+		options := &descriptorpb.MethodOptions{}
+		proto.SetExtension(options, annotations.E_Http, rule)
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(input),
+			OutputType:      proto.String(output),
+			Options:         options,
+			ServerStreaming: proto.Bool(streaming),
+		}
+	}
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("user/v1/user.proto"),
+		Package: proto.String("user.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("GetUserRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("verbose", 2, descriptorpb.FieldDescriptorProto_TYPE_BOOL, optional, ""),
+					field("fields", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated, ""),
+				},
+			},
+			{
+				Name: proto.String("User"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("display_name", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("age", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional, ""),
+				},
+			},
+			{
+				Name: proto.String("UpdateUserRequest"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, optional, ""),
+					field("user", 2, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, optional, ".user.v1.User"),
+				},
+			},
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("UserService"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("GetUser", ".user.v1.GetUserRequest", ".user.v1.User",
+					&annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/users/{id}"}}, false),
+				method("UpdateUser", ".user.v1.UpdateUserRequest", ".user.v1.User",
+					&annotations.HttpRule{Pattern: &annotations.HttpRule_Patch{Patch: "/v1/users/{id}"}, Body: "user", ResponseBody: "display_name"}, false),
+				method("WatchUsers", ".user.v1.GetUserRequest", ".user.v1.User",
+					&annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: "/v1/users:watch"}}, true),
+			},
+		}},
+	}
+}
+
+// writeTestDescriptorSet writes the descriptor set of the test user service and returns its path.
+func writeTestDescriptorSet(t *testing.T) string {
+	t.Helper()
+
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{newTestUserService()}})
+	if err != nil {
+		t.Fatalf("failed to marshal descriptor set: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "user.pb")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write descriptor set: %v", err)
+	}
+
+	return path
+}
+
+func newTestUserFile(t *testing.T) protoreflect.FileDescriptor {
+	t.Helper()
+
+	file, err := protodesc.NewFile(newTestUserService(), nil)
+	if err != nil {
+		t.Fatalf("failed to build file descriptor: %v", err)
+	}
+
+	return file
+}
+
+func TestParseHTTPTemplate(t *testing.T) {
+	tests := []struct {
+		template       string
+		path           string
+		expectedValues map[string]string
+		expectedMatch  bool
+	}{
+		{"/v1/users/{id}", "/v1/users/42", map[string]string{"id": "42"}, true},
+		{"/v1/users/{id}", "/v1/users/42/orders", nil, false},
+		{"/v1/users/{id}", "/v1/users/a%2Fb", map[string]string{"id": "a/b"}, true},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", map[string]string{"name": "shelves/1/books/2"}, true},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books", nil, false},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c", map[string]string{"path": "a/b/c"}, true},
+		{"/v1/users/{user.id}:activate", "/v1/users/7:activate", map[string]string{"user.id": "7"}, true},
+		{"/v1/users/{user.id}:activate", "/v1/users/7", nil, false},
+		{"/v1/*/items", "/v1/anything/items", map[string]string{}, true},
+	}
+
+	for _, tc := range tests {
+		template, err := parseHTTPTemplate(tc.template)
+		if !assert.NoError(t, err, tc.template) {
+			continue
+		}
+
+		values, ok := template.match(tc.path)
+		assert.Equal(t, tc.expectedMatch, ok, "%v %v", tc.template, tc.path)
+		if tc.expectedMatch {
+			assert.Equal(t, tc.expectedValues, values, "%v %v", tc.template, tc.path)
+		}
+	}
+
+	for _, invalid := range []string{"v1/users", "/v1/users/{id", "/v1/users/x{id}", "/v1//users"} {
+		_, err := parseHTTPTemplate(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// newTranscodingBackend answers the user service methods from the gRPC messages it receives.
+func newTranscodingBackend(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	messages := newTestUserFile(t).Messages()
+	getUserRequest := messages.ByName("GetUserRequest")
+	updateUserRequest := messages.ByName("UpdateUserRequest")
+	user := messages.ByName("User")
+
+	return newH2CServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/grpc+proto", r.Header.Get("Content-Type"))
+		frame, err := readGrpcFrame(r.Body)
+		assert.NoError(t, err)
+
+		response := dynamicpb.NewMessage(user)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+		switch r.URL.Path {
+		case "/user.v1.UserService/GetUser":
+			request := dynamicpb.NewMessage(getUserRequest)
+			assert.NoError(t, proto.Unmarshal([]byte(frame), request))
+
+			id := request.Get(getUserRequest.Fields().ByName("id")).String()
+			if id == "missing" {
+				w.Header().Set("Grpc-Status", "5")
+				w.Header().Set("Grpc-Message", "user missing not found")
+				return
+			}
+
+			fields := request.Get(getUserRequest.Fields().ByName("fields")).List()
+			name := "user " + id
+			if request.Get(getUserRequest.Fields().ByName("verbose")).Bool() {
+				name += " verbose"
+			}
+			for i := 0; i < fields.Len(); i++ {
+				name += " " + fields.Get(i).String()
+			}
+			response.Set(user.Fields().ByName("id"), protoreflect.ValueOfString(id))
+			response.Set(user.Fields().ByName("display_name"), protoreflect.ValueOfString(name))
+			response.Set(user.Fields().ByName("age"), protoreflect.ValueOfInt64(30))
+		case "/user.v1.UserService/UpdateUser":
+			request := dynamicpb.NewMessage(updateUserRequest)
+			assert.NoError(t, proto.Unmarshal([]byte(frame), request))
+
+			update := request.Get(updateUserRequest.Fields().ByName("user")).Message()
+			response.Set(user.Fields().ByName("id"), request.Get(updateUserRequest.Fields().ByName("id")))
+			response.Set(user.Fields().ByName("display_name"), update.Get(user.Fields().ByName("display_name")))
+		default:
+			w.Header().Set("Grpc-Status", "12")
+			return
+		}
+
+		encoded, err := proto.Marshal(response)
+		assert.NoError(t, err)
+		_, _ = w.Write(grpcFrame(string(encoded)))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+}
+
+func TestServeHTTP_Transcoding(t *testing.T) {
+	backend := newTranscodingBackend(t)
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	routeConfig := newTestGrpcRoute("/v1/users", backend.URL)
+	routeConfig.Transcoding = &config.GrpcTranscoding{DescriptorSet: writeTestDescriptorSet(t)}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	t.Run("path and query parameters", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/users/42?verbose=true&fields=a&fields=b&unknown=1", nil))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"id":"42","displayName":"user 42 verbose a b","age":"30"}`, rr.Body.String())
+
+		span := telem.endedSpan("api_gateway_request")
+		if assert.NotNil(t, span) {
+			attributes := spanAttributeMap(span)
+			assert.Equal(t, "user.v1.UserService", attributes["rpc.service"].AsString())
+			assert.Equal(t, "GetUser", attributes["rpc.method"].AsString())
+			assert.True(t, attributes["gateway.transcoded"].AsBool())
+		}
+	})
+
+	t.Run("body field and response body", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/v1/users/7", strings.NewReader(`{"displayName":"Ada"}`)))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, `"Ada"`, rr.Body.String())
+	})
+
+	t.Run("gRPC errors", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/users/missing", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+		assert.Contains(t, rr.Body.String(), "user missing not found")
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodPatch, "/v1/users/7", strings.NewReader(`{"age":"old"}`)))
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+
+	t.Run("method not allowed", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/v1/users/7", nil))
+
+		assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
+		assert.Equal(t, "GET, PATCH", rr.Header().Get("Allow"))
+	})
+
+	t.Run("streaming methods are not bound", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/users:watch", nil))
+
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+}
+
+func TestServeHTTP_TranscodingRouteTakesGrpc(t *testing.T) {
+	backend := newTranscodingBackend(t)
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestGrpcRoute("/user.v1.UserService", backend.URL)
+	routeConfig.Transcoding = &config.GrpcTranscoding{DescriptorSet: writeTestDescriptorSet(t), UseProtoNames: true, EmitUnpopulated: true}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	// native calls pass through a transcoding route unchanged
+	gateway := newH2CServer(t, proxyHandler)
+	request := newGrpcRequest(t, gateway.URL+"/user.v1.UserService/Unknown", bytes.NewReader(grpcFrame("")))
+	request.Header.Set("Content-Type", "application/grpc+proto")
+	response, err := newH2CClient().Do(request)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _ = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	assert.Equal(t, "12", response.Trailer.Get("Grpc-Status"))
+}
+
+func TestNewGrpcTranscoder_InvalidDescriptorSet(t *testing.T) {
+	_, err := newGrpcTranscoder(config.GrpcTranscoding{DescriptorSet: filepath.Join(t.TempDir(), "missing.pb")})
+	assert.ErrorIs(t, err, ErrInvalidTranscoding)
+
+	file := newTestUserService()
+	rule := proto.GetExtension(file.Service[0].Method[0].Options, annotations.E_Http).(*annotations.HttpRule)
+	rule.Pattern = &annotations.HttpRule_Get{Get: "/v1/users/{user_id}"}
+	data, _ := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	path := filepath.Join(t.TempDir(), "user.pb")
+	assert.NoError(t, os.WriteFile(path, data, 0o600))
+
+	_, err = newGrpcTranscoder(config.GrpcTranscoding{DescriptorSet: path})
+	assert.ErrorIs(t, err, ErrInvalidTranscoding)
+	assert.ErrorContains(t, err, "has no field user_id")
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newUpstreamClient returns a client that talks to the backends of a route
+// with its own TLS settings, over HTTP/2 only for gRPC routes.
+func newUpstreamClient(upstreamTLS config.UpstreamTLS, grpc bool) (*http.Client, error) {
+	tlsConfig, err := newUpstreamTLSConfig(upstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if grpc {
+		transport = newGrpcTransport()
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// newUpstreamTLSConfig builds the client TLS configuration of a route. A CA
+// file replaces the system roots with a PEM bundle, a certificate and key
+// are presented as the client certificate and a server name overrides the
+// name sent as SNI and verified against the backend certificate.
+// InsecureSkipVerify, meant for development only, accepts any certificate.
+func newUpstreamTLSConfig(upstreamTLS config.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         upstreamTLS.ServerName,
+		InsecureSkipVerify: upstreamTLS.InsecureSkipVerify,
+	}
+
+	if upstreamTLS.CAFile != "" {
+		bundle, err := os.ReadFile(upstreamTLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidUpstreamTLS, err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("%w: no certificates in CA bundle %v", ErrInvalidUpstreamTLS, upstreamTLS.CAFile)
+		}
+	}
+
+	if upstreamTLS.CertFile != "" || upstreamTLS.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(upstreamTLS.CertFile, upstreamTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidUpstreamTLS, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// upstreamTLSError is a failed TLS handshake with a backend. It matches
+// the error of its kind, such as ErrUpstreamUnknownAuthority, as well as
+// the error it was classified from.
+type upstreamTLSError struct {
+	// reason names the kind of failure on spans
+	reason string
+	kind   error
+	err    error
+}
+
+func (e *upstreamTLSError) Error() string { return e.kind.Error() + ": " + e.err.Error() }
+
+func (e *upstreamTLSError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// classifyUpstreamTLSError returns the TLS handshake failure behind a
+// transport error, or nil when the error is of another kind.
+func classifyUpstreamTLSError(err error) *upstreamTLSError {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		hostname         x509.HostnameError
+		invalid          x509.CertificateInvalidError
+		verification     *tls.CertificateVerificationError
+		recordHeader     tls.RecordHeaderError
+		opErr            *net.OpError
+	)
+
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return &upstreamTLSError{reason: "unknown_authority", kind: ErrUpstreamUnknownAuthority, err: err}
+	case errors.As(err, &hostname):
+		return &upstreamTLSError{reason: "hostname_mismatch", kind: ErrUpstreamHostnameMismatch, err: err}
+	case errors.As(err, &invalid), errors.As(err, &verification):
+		return &upstreamTLSError{reason: "invalid_certificate", kind: ErrUpstreamInvalidCertificate, err: err}
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		// an alert from the backend, usually about a missing or untrusted client certificate
+		return &upstreamTLSError{reason: "handshake_rejected", kind: ErrUpstreamHandshakeRejected, err: err}
+	case errors.As(err, &recordHeader), errors.Is(err, http.ErrSchemeMismatch):
+		// typically a backend that does not speak TLS
+		return &upstreamTLSError{reason: "handshake", kind: ErrUpstreamHandshake, err: err}
+	}
+
+	return nil
+}
+
+// upstreamError wraps TLS handshake failures of an upstream request in an
+// upstreamTLSError and records them as an event on span. Other errors are
+// returned as they are.
+func upstreamError(span trace.Span, err error) error {
+	tlsErr := classifyUpstreamTLSError(err)
+	if tlsErr == nil {
+		return err
+	}
+
+	span.AddEvent("upstream_tls_handshake_failed", trace.WithAttributes(attribute.String("gateway.tls.failure", tlsErr.reason)))
+
+	return tlsErr
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newMTLSBackend starts a TLS backend that requires a client certificate
+// issued for clientCertificate and answers with the name it was issued to.
+func newMTLSBackend(t *testing.T, clientCertificate config.Certificate) *httptest.Server {
+	t.Helper()
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(readTestFile(t, clientCertificate.CertFile))
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	t.Cleanup(backend.Close)
+
+	return backend
+}
+
+func readTestFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %v: %v", path, err)
+	}
+
+	return content
+}
+
+// writeBackendCA writes the certificate of a TLS test server as a CA bundle.
+func writeBackendCA(t *testing.T, backend *httptest.Server) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	writeTestFile(t, path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}))
+
+	return path
+}
+
+// upstreamTLSFailure returns the reason of the upstream_tls_handshake_failed event of a span, if any.
+func upstreamTLSFailure(span sdktrace.ReadOnlySpan) string {
+	for _, event := range span.Events() {
+		if event.Name != "upstream_tls_handshake_failed" {
+			continue
+		}
+		for _, kv := range event.Attributes {
+			if kv.Key == "gateway.tls.failure" {
+				return kv.Value.AsString()
+			}
+		}
+	}
+
+	return ""
+}
+
+func TestServeHTTP_UpstreamTLS(t *testing.T) {
+	client := writeTestCertificate(t, t.TempDir(), "client", "client.example.com")
+	backend := newMTLSBackend(t, client)
+	caFile := writeBackendCA(t, backend)
+
+	tests := []struct {
+		name           string
+		upstreamTLS    config.UpstreamTLS
+		expectedStatus int
+		expectedBody   string
+		expectedReason string
+	}{
+		{
+			name:           "trusted CA and client certificate",
+			upstreamTLS:    config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "client.example.com",
+		},
+		{
+			// the test server certificate is issued for example.com and 127.0.0.1
+			name:           "server name override",
+			upstreamTLS:    config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile, ServerName: "example.com"},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "client.example.com",
+		},
+		{
+			name:           "insecure skip verify",
+			upstreamTLS:    config.UpstreamTLS{CertFile: client.CertFile, KeyFile: client.KeyFile, InsecureSkipVerify: true},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "client.example.com",
+		},
+		{
+			name:           "system roots",
+			upstreamTLS:    config.UpstreamTLS{CertFile: client.CertFile, KeyFile: client.KeyFile},
+			expectedStatus: http.StatusBadGateway,
+			expectedReason: "unknown_authority",
+		},
+		{
+			name:           "server name mismatch",
+			upstreamTLS:    config.UpstreamTLS{CAFile: caFile, CertFile: client.CertFile, KeyFile: client.KeyFile, ServerName: "backend.test"},
+			expectedStatus: http.StatusBadGateway,
+			expectedReason: "hostname_mismatch",
+		},
+		{
+			name:           "missing client certificate",
+			upstreamTLS:    config.UpstreamTLS{CAFile: caFile},
+			expectedStatus: http.StatusBadGateway,
+			expectedReason: "handshake_rejected",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			telem := newRecordingTelemetry(t)
+			proxyHandler := NewProxyHandler(telem, 5*time.Second)
+			defer proxyHandler.Close()
+
+			routeConfig := newTestRouteConfig("/internal", backend.URL)
+			routeConfig.UpstreamTLS = &tt.upstreamTLS
+			assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+			rr := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/internal", nil))
+
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+			if tt.expectedBody != "" {
+				assert.Equal(t, tt.expectedBody, rr.Body.String())
+			}
+
+			attemptSpan := telem.endedSpan("api_gateway_attempt")
+			assert.Equal(t, tt.expectedReason, upstreamTLSFailure(attemptSpan))
+			if tt.expectedReason != "" {
+				assert.Equal(t, "tls_"+tt.expectedReason, spanAttributeMap(attemptSpan)["error.type"].AsString())
+			}
+		})
+	}
+}
+
+func TestClassifyUpstreamTLSError(t *testing.T) {
+	backend := httptest.NewTLSServer(http.NotFoundHandler())
+	defer backend.Close()
+	plaintext := httptest.NewServer(http.NotFoundHandler())
+	defer plaintext.Close()
+
+	client := &http.Client{Transport: &http.Transport{}}
+
+	_, err := client.Get(backend.URL)
+	tlsErr := classifyUpstreamTLSError(err)
+	if assert.NotNil(t, tlsErr) {
+		assert.ErrorIs(t, tlsErr, ErrUpstreamUnknownAuthority)
+		var unknownAuthority x509.UnknownAuthorityError
+		assert.ErrorAs(t, tlsErr, &unknownAuthority)
+	}
+
+	// a backend that does not speak TLS
+	_, err = client.Get("https://" + plaintext.Listener.Addr().String())
+	tlsErr = classifyUpstreamTLSError(err)
+	if assert.NotNil(t, tlsErr) {
+		assert.ErrorIs(t, tlsErr, ErrUpstreamHandshake)
+	}
+
+	_, err = client.Get(plaintext.URL)
+	assert.NoError(t, err)
+	plaintext.Close()
+	_, err = client.Get(plaintext.URL)
+	assert.Nil(t, classifyUpstreamTLSError(err))
+}
+
+func TestServeHTTP_UpstreamTLSGrpc(t *testing.T) {
+	client := writeTestCertificate(t, t.TempDir(), "client", "client.example.com")
+	backend := newMTLSBackend(t, client)
+	backend.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, 2, r.ProtoMajor)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	routeConfig := newTestGrpcRoute("/user.v1.UserService", backend.URL)
+	routeConfig.UpstreamTLS = &config.UpstreamTLS{CAFile: writeBackendCA(t, backend), CertFile: client.CertFile, KeyFile: client.KeyFile}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	gateway := newH2CServer(t, proxyHandler)
+
+	response, err := newH2CClient().Do(newGrpcRequest(t, gateway.URL+"/user.v1.UserService/GetUser", bytes.NewReader(grpcFrame("42"))))
+	if !assert.NoError(t, err) {
+		return
+	}
+	response.Body.Close()
+
+	assert.Equal(t, "0", response.Header.Get("Grpc-Status"))
+}
+
+func TestAddRoute_InvalidUpstreamTLS(t *testing.T) {
+	emptyBundle := filepath.Join(t.TempDir(), "empty.crt")
+	writeTestFile(t, emptyBundle, []byte("no certificates here"))
+
+	for _, upstreamTLS := range []config.UpstreamTLS{
+		{CAFile: filepath.Join(t.TempDir(), "missing.crt")},
+		{CAFile: emptyBundle},
+		{CertFile: emptyBundle, KeyFile: emptyBundle},
+	} {
+		proxyHandler := newTestProxyHandler(t, 5*time.Second)
+		routeConfig := newTestRouteConfig("/internal", "https://internal:8443")
+		routeConfig.UpstreamTLS = &upstreamTLS
+
+		assert.ErrorIs(t, proxyHandler.AddRoute(routeConfig), ErrInvalidUpstreamTLS)
+	}
+}
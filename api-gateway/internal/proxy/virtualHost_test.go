@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoutingTable_VirtualHosts(t *testing.T) {
+	table := newTestRoutingTable(t,
+		config.Route{Name: "default user", Prefix: "/user"},
+		config.Route{Name: "default order", Prefix: "/order"},
+		config.Route{Name: "api user", Prefix: "/user", Hosts: []string{"api.example.com", "API.example.org"}},
+		config.Route{Name: "internal user", Prefix: "/user", Hosts: []string{"*.internal.example.com"}},
+		config.Route{Name: "eu internal user", Prefix: "/user", Hosts: []string{"*.eu.internal.example.com"}},
+		config.Route{Name: "billing", Prefix: "/billing", Hosts: []string{"billing.internal.example.com"}},
+	)
+
+	tests := []struct {
+		host         string
+		path         string
+		expectedName string
+	}{
+		{"api.example.com", "/user/1", "api user"},
+		{"api.example.com:8000", "/user/1", "api user"},
+		{"API.EXAMPLE.COM.", "/user/1", "api user"},
+		{"api.example.org", "/user/1", "api user"},
+		{"api.example.com", "/order/1", ""},
+		{"a.internal.example.com", "/user/1", "internal user"},
+		{"a.b.internal.example.com", "/user/1", "internal user"},
+		{"a.eu.internal.example.com", "/user/1", "eu internal user"},
+		{"internal.example.com", "/user/1", "default user"},
+		{"billing.internal.example.com", "/billing/1", "billing"},
+		{"billing.internal.example.com", "/user/1", ""},
+		{"other.example.com", "/user/1", "default user"},
+		{"other.example.com", "/order/1", "default order"},
+		{"", "/order/1", "default order"},
+		{"[::1]:8000", "/user/1", "default user"},
+	}
+
+	for _, tc := range tests {
+		match := table.match(newMatchRequest(tc.host, tc.path))
+
+		if tc.expectedName == "" {
+			assert.Nil(t, match.route, tc.host+tc.path)
+			continue
+		}
+
+		if assert.NotNil(t, match.route, tc.host+tc.path) {
+			assert.Equal(t, tc.expectedName, match.route.Name, tc.host+tc.path)
+		}
+	}
+}
+
+func TestServeHTTP_VirtualHosts(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+	}
+	publicBackend, internalBackend := newBackend("public"), newBackend("internal")
+	defer publicBackend.Close()
+	defer internalBackend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.ReplaceRoutes([]config.Route{
+		newTestRouteConfig("/user", publicBackend.URL),
+		{Prefix: "/user", Hosts: []string{"*.internal.example.com"}, Backends: []config.Backend{{Url: internalBackend.URL}}},
+	}))
+
+	for host, expected := range map[string]string{"gateway.example.com": "public", "users.internal.example.com": "internal"} {
+		req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+		req.Host = host
+
+		rr := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(rr, req)
+		assert.Equal(t, expected, rr.Body.String(), host)
+	}
+}
+
+func TestReplaceRoutes_InvalidHosts(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+
+	for _, host := range []string{"", "api.*.example.com", "api.example.com:8000"} {
+		err := proxyHandler.ReplaceRoutes([]config.Route{
+			{Prefix: "/user", Hosts: []string{host}, Backends: []config.Backend{{Url: "http://user:6001"}}},
+		})
+		assert.ErrorIs(t, err, config.ErrInvalidConfiguration, host)
+	}
+}
+
+func TestAdmin_VirtualHostRoutes(t *testing.T) {
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	admin := NewAdminHandler(proxyHandler)
+
+	rr := serveAdmin(admin, http.MethodPut, "/routes/user?hosts=api.example.com", `{"backends":[{"url":"http://user:6001"}]}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Contains(t, proxyHandler.Routes(), "api.example.com/user")
+
+	rr = serveAdmin(admin, http.MethodGet, "/routes/user", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr = serveAdmin(admin, http.MethodDelete, "/routes/user?hosts=api.example.com", "")
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Empty(t, proxyHandler.Routes())
+}
@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const defaultWebSocketIdleTimeout = 5 * time.Minute
+
+// Reasons a WebSocket tunnel was closed for, as recorded on its span.
+const (
+	tunnelClientClosed  = "client_closed"
+	tunnelBackendClosed = "backend_closed"
+	tunnelIdleTimeout   = "idle_timeout"
+)
+
+// hopByHopHeaders are the headers that apply to a single connection and are not forwarded, see RFC 9110 section 7.6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers and the headers the Connection header names.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// isWebSocketRequest reports whether the request asks to upgrade the connection to a WebSocket.
+func isWebSocketRequest(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgrade sends the WebSocket handshake of the request to a backend of the
+// route. Upgrades are never retried or hedged. The span of the result lasts
+// until the result is closed, so after a successful handshake it covers the
+// whole tunnel.
+func (p *ProxyHandler) upgrade(ctx context.Context, r *http.Request, route *Route, variant *splitVariant, upstreamPath string) (*attemptResult, error) {
+	backend, permit, err := p.pickBackend(route, variant, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// the tunnel outlives the handshake, so only the handshake is bound by the request timeout
+	tunnelCtx, cancel := context.WithCancel(ctx)
+	tunnelCtx, span := p.Telemetry.TraceStart(tunnelCtx, "api_gateway_websocket", trace.WithSpanKind(trace.SpanKindClient))
+	span.SetAttributes(attribute.String("gateway.backend", backend.Url.String()))
+
+	fail := func(outcome attemptOutcome, err error) (*attemptResult, error) {
+		route.recordOutcome(ctx, backend, permit, outcome)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		cancel()
+		return nil, err
+	}
+
+	upgradeRequest := r.WithContext(tunnelCtx)
+	upgradeRequest.Header = r.Header.Clone()
+
+	proxyRequest, err := p.createProxyRequest(upgradeRequest, backend.Url, upstreamPath)
+	if err != nil {
+		return fail(outcomeCancelled, fmt.Errorf("%w: %w", ErrCreateProxyRequest, err))
+	}
+	// the upgrade is the one hop-by-hop exchange the backend must see
+	proxyRequest.Header.Set("Connection", "Upgrade")
+	proxyRequest.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+
+	span.SetAttributes(clientRequestAttributes(proxyRequest, route)...)
+	otel.GetTextMapPropagator().Inject(tunnelCtx, propagation.HeaderCarrier(proxyRequest.Header))
+
+	transport := p.clientFor(route).Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	var handshakeTimer *time.Timer
+	if p.RequestTimeout > 0 {
+		handshakeTimer = time.AfterFunc(p.RequestTimeout, cancel)
+	}
+
+	response, err := transport.RoundTrip(proxyRequest)
+	if handshakeTimer != nil && !handshakeTimer.Stop() && err == nil {
+		response.Body.Close()
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		err = upstreamError(span, err)
+		span.SetAttributes(errorTypeAttribute(0, err))
+		if r.Context().Err() != nil {
+			return fail(outcomeCancelled, err)
+		}
+		return fail(outcomeFailure, err)
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		if _, ok := response.Body.(io.ReadWriteCloser); !ok {
+			response.Body.Close()
+			return fail(outcomeFailure, errors.New("backend connection does not support upgrades"))
+		}
+	}
+
+	if response.StatusCode >= http.StatusBadRequest {
+		span.SetAttributes(errorTypeAttribute(response.StatusCode, nil))
+		span.SetStatus(codes.Error, response.Status)
+	}
+
+	if response.StatusCode >= http.StatusInternalServerError {
+		route.recordOutcome(ctx, backend, permit, outcomeFailure)
+	} else {
+		route.recordOutcome(ctx, backend, permit, outcomeSuccess)
+	}
+
+	backend.activeConnections.Add(1)
+
+	return &attemptResult{
+		response: response,
+		backend:  backend,
+		span:     span,
+		attempt:  1,
+		cancel:   cancel,
+	}, nil
+}
+
+// tunnel relays the 101 response of the backend to the client and then
+// copies data both ways until either side closes its connection or the
+// tunnel has been idle for the idle timeout of the route.
+func (p *ProxyHandler) tunnel(w http.ResponseWriter, span trace.Span, route *Route, result *attemptResult) {
+	backendConn := result.response.Body.(io.ReadWriteCloser)
+
+	header := w.Header().Clone()
+	for key, values := range result.response.Header {
+		header[key] = values
+	}
+	removeHopByHopHeaders(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", result.response.Header.Get("Upgrade"))
+
+	clientConn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		p.Telemetry.LogErrorln("failed to take over the client connection:", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	switching := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if err := switching.Write(buffered); err != nil {
+		result.span.RecordError(err)
+		return
+	}
+	if err := buffered.Flush(); err != nil {
+		result.span.RecordError(err)
+		return
+	}
+
+	span.SetAttributes(semconv.HTTPResponseStatusCode(http.StatusSwitchingProtocols))
+
+	attributes := metric.WithAttributes(attribute.String("route", route.Prefix))
+	p.metrics.activeTunnels.Add(context.Background(), 1, attributes)
+	defer p.metrics.activeTunnels.Add(context.Background(), -1, attributes)
+
+	idleTimeout := defaultWebSocketIdleTimeout
+	if route.routeConfig.WebSocket != nil && route.routeConfig.WebSocket.IdleTimeout > 0 {
+		idleTimeout = route.routeConfig.WebSocket.IdleTimeout
+	}
+
+	stats := pipe(clientConn, buffered.Reader, backendConn, idleTimeout)
+	result.span.SetAttributes(
+		attribute.String("gateway.websocket.close_reason", stats.closeReason),
+		attribute.Int64("gateway.websocket.bytes_sent", stats.toBackend),
+		attribute.Int64("gateway.websocket.bytes_received", stats.toClient),
+	)
+}
+
+// tunnelStats describes a finished tunnel.
+type tunnelStats struct {
+	closeReason string
+	toBackend   int64
+	toClient    int64
+}
+
+// pipe copies data between the client and the backend until one of them
+// closes its connection or no data passed for idleTimeout. Both
+// connections are closed when pipe returns.
+func pipe(clientConn net.Conn, clientReader io.Reader, backendConn io.ReadWriteCloser, idleTimeout time.Duration) tunnelStats {
+	var stats tunnelStats
+	var lastActivity atomic.Int64
+	lastActivity.Store(time.Now().UnixNano())
+	touch := func() { lastActivity.Store(time.Now().UnixNano()) }
+
+	var closeOnce sync.Once
+	closeBoth := func(reason string) {
+		closeOnce.Do(func() {
+			stats.closeReason = reason
+			clientConn.Close()
+			backendConn.Close()
+		})
+	}
+
+	done := make(chan struct{}, 2)
+	stopped := make(chan struct{})
+	defer close(stopped)
+
+	go func() {
+		stats.toBackend, _ = io.Copy(backendConn, &activityReader{Reader: clientReader, touch: touch})
+		closeBoth(tunnelClientClosed)
+		done <- struct{}{}
+	}()
+	go func() {
+		stats.toClient, _ = io.Copy(clientConn, &activityReader{Reader: backendConn, touch: touch})
+		closeBoth(tunnelBackendClosed)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		timer := time.NewTimer(idleTimeout)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-stopped:
+				return
+			case <-timer.C:
+				idle := time.Since(time.Unix(0, lastActivity.Load()))
+				if idle >= idleTimeout {
+					closeBoth(tunnelIdleTimeout)
+					return
+				}
+				timer.Reset(idleTimeout - idle)
+			}
+		}
+	}()
+
+	<-done
+	<-done
+
+	return stats
+}
+
+// activityReader calls touch whenever data is read.
+type activityReader struct {
+	io.Reader
+	touch func()
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.touch()
+	}
+
+	return n, err
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brandoyts/api-gateway/api-gateway/config"
+	"github.com/stretchr/testify/assert"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// newEchoUpgradeServer accepts upgrades and echoes everything it receives afterwards.
+func newEchoUpgradeServer(t *testing.T, received chan<- http.Header) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if received != nil {
+			received <- r.Header.Clone()
+		}
+		if !isWebSocketRequest(r) {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+
+		conn, buffered, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Accept: accepted\r\nKeep-Alive: timeout=5\r\n\r\n")
+		_ = buffered.Flush()
+		_, _ = io.Copy(conn, buffered)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// dialUpgrade sends a WebSocket handshake to the gateway and returns the connection and the response.
+func dialUpgrade(t *testing.T, gatewayUrl, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gatewayUrl, "http://"))
+	if err != nil {
+		t.Fatalf("failed to dial the gateway: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	_, err = conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: gateway\r\nConnection: keep-alive, Upgrade, X-Hop\r\nUpgrade: websocket\r\nX-Hop: 1\r\nSec-WebSocket-Key: key\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("failed to send the handshake: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("failed to read the handshake response: %v", err)
+	}
+
+	return conn, reader, response
+}
+
+func activeTunnels(t *testing.T, reader *sdkmetric.ManualReader) int64 {
+	t.Helper()
+
+	var data metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(t.Context(), &data))
+
+	total := int64(0)
+	for _, scope := range data.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			for _, point := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				total += point.Value
+			}
+		}
+	}
+
+	return total
+}
+
+func TestServeHTTP_WebSocket(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := newEchoUpgradeServer(t, received)
+
+	reader := sdkmetric.NewManualReader()
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	proxyHandler.metrics.activeTunnels, _ = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test").Int64UpDownCounter("websocket_tunnels_active")
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/chat", backend.URL)))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	conn, connReader, response := dialUpgrade(t, gateway.URL, "/chat/room")
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	assert.Equal(t, "websocket", response.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", response.Header.Get("Connection"))
+	assert.Equal(t, "accepted", response.Header.Get("Sec-WebSocket-Accept"))
+	assert.NotEmpty(t, response.Header.Get(RequestIDHeader))
+	assert.Empty(t, response.Header.Get("Keep-Alive"))
+
+	header := <-received
+	assert.Equal(t, "Upgrade", header.Get("Connection"))
+	assert.Equal(t, "websocket", header.Get("Upgrade"))
+	assert.Equal(t, "key", header.Get("Sec-WebSocket-Key"))
+	assert.Empty(t, header.Get("X-Hop"))
+
+	for _, message := range []string{"hello", "world"} {
+		_, err := conn.Write([]byte(message))
+		assert.NoError(t, err)
+
+		echo := make([]byte, len(message))
+		_, err = io.ReadFull(connReader, echo)
+		assert.NoError(t, err)
+		assert.Equal(t, message, string(echo))
+	}
+
+	assert.Equal(t, int64(1), activeTunnels(t, reader))
+
+	conn.Close()
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_websocket") != nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), activeTunnels(t, reader))
+
+	attributes := spanAttributeMap(telem.endedSpan("api_gateway_websocket"))
+	assert.Equal(t, tunnelClientClosed, attributes["gateway.websocket.close_reason"].AsString())
+	assert.Equal(t, int64(10), attributes["gateway.websocket.bytes_sent"].AsInt64())
+	assert.Equal(t, int64(10), attributes["gateway.websocket.bytes_received"].AsInt64())
+}
+
+func TestServeHTTP_WebSocketIdleTimeout(t *testing.T) {
+	backend := newEchoUpgradeServer(t, nil)
+
+	telem := newRecordingTelemetry(t)
+	proxyHandler := NewProxyHandler(telem, 5*time.Second)
+	routeConfig := newTestRouteConfig("/chat", backend.URL)
+	routeConfig.WebSocket = &config.WebSocket{IdleTimeout: 100 * time.Millisecond}
+	assert.NoError(t, proxyHandler.AddRoute(routeConfig))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	conn, connReader, response := dialUpgrade(t, gateway.URL, "/chat")
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	// traffic keeps the tunnel open past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, err := conn.Write([]byte("ping"))
+		assert.NoError(t, err)
+		echo := make([]byte, 4)
+		_, err = io.ReadFull(connReader, echo)
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := connReader.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+
+	assert.Eventually(t, func() bool { return telem.endedSpan("api_gateway_websocket") != nil }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, tunnelIdleTimeout, spanAttributeMap(telem.endedSpan("api_gateway_websocket"))["gateway.websocket.close_reason"].AsString())
+}
+
+func TestServeHTTP_WebSocketRejected(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no upgrades here", http.StatusBadRequest)
+	}))
+	defer backend.Close()
+
+	proxyHandler := newTestProxyHandler(t, 5*time.Second)
+	assert.NoError(t, proxyHandler.AddRoute(newTestRouteConfig("/chat", backend.URL)))
+
+	gateway := httptest.NewServer(proxyHandler)
+	defer gateway.Close()
+
+	_, _, response := dialUpgrade(t, gateway.URL, "/chat")
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
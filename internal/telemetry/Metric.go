@@ -20,3 +20,66 @@ var MetricRequestsInFlight = Metric{
 	Unit:        "{count}",
 	Description: "Measures the number of requests currently being processed by the server.",
 }
+
+// MetricHealthyBackends is a metric that measures the number of backends currently passing their health checks.
+var MetricHealthyBackends = Metric{
+	Name:        "backends_healthy",
+	Unit:        "{backend}",
+	Description: "Measures the number of backends currently passing their health checks.",
+}
+
+// MetricCircuitBreakerState is a metric that reports the circuit breaker state of a backend: 0 closed, 1 half-open, 2 open.
+var MetricCircuitBreakerState = Metric{
+	Name:        "circuit_breaker_state",
+	Unit:        "{state}",
+	Description: "Reports the circuit breaker state of a backend: 0 closed, 1 half-open, 2 open.",
+}
+
+// MetricConfigReloads is a metric that counts gateway configuration reloads by result.
+var MetricConfigReloads = Metric{
+	Name:        "config_reloads",
+	Unit:        "{reload}",
+	Description: "Counts gateway configuration reloads by result.",
+}
+
+// MetricVariantRequests is a metric that counts the requests of split routes by variant.
+var MetricVariantRequests = Metric{
+	Name:        "variant_requests",
+	Unit:        "{request}",
+	Description: "Counts the requests of split routes by variant.",
+}
+
+// MetricVariantErrors is a metric that counts the failed requests of split routes by variant.
+var MetricVariantErrors = Metric{
+	Name:        "variant_errors",
+	Unit:        "{request}",
+	Description: "Counts the failed requests of split routes by variant.",
+}
+
+// MetricMirrorRequests is a metric that counts the copies of requests sent to shadow backends by result: sent, failed or dropped.
+var MetricMirrorRequests = Metric{
+	Name:        "mirror_requests",
+	Unit:        "{request}",
+	Description: "Counts the copies of requests sent to shadow backends by result: sent, failed or dropped.",
+}
+
+// MetricShadowMismatches is a metric that counts the shadow responses that differ from the primary response, by differing part: status, headers or body.
+var MetricShadowMismatches = Metric{
+	Name:        "shadow_mismatches",
+	Unit:        "{response}",
+	Description: "Counts the shadow responses that differ from the primary response, by differing part: status, headers or body.",
+}
+
+// MetricShadowComparisons is a metric that counts the comparisons of shadow responses with primary responses by result: match, mismatch or skipped.
+var MetricShadowComparisons = Metric{
+	Name:        "shadow_comparisons",
+	Unit:        "{comparison}",
+	Description: "Counts the comparisons of shadow responses with primary responses by result: match, mismatch or skipped.",
+}
+
+// MetricWebSocketTunnels is a metric that measures the number of open WebSocket tunnels.
+var MetricWebSocketTunnels = Metric{
+	Name:        "websocket_tunnels_active",
+	Unit:        "{tunnel}",
+	Description: "Measures the number of open WebSocket tunnels.",
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 
 	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
 )
@@ -67,18 +68,28 @@ func (t *NoopTelemetry) MeterRequestsInFlight(next http.Handler) http.Handler {
 }
 
 // TraceStart returns the context and span unchanged.
-func (t *NoopTelemetry) TraceStart(ctx context.Context, name string) (context.Context, trace.Span) {
+func (t *NoopTelemetry) TraceStart(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
 	return ctx, trace.SpanFromContext(ctx)
 }
 
-// MeterInt64Histogram returns nil.
+// MeterInt64Counter returns a counter that records nothing.
+func (t *NoopTelemetry) MeterInt64Counter(metric Metric) (metric.Int64Counter, error) {
+	return noop.Int64Counter{}, nil
+}
+
+// MeterInt64Histogram returns a histogram that records nothing.
 func (t *NoopTelemetry) MeterInt64Histogram(metric Metric) (metric.Int64Histogram, error) {
-	return nil, nil
+	return noop.Int64Histogram{}, nil
 }
 
-// MeterInt64UpDownCounter returns nil.
+// MeterInt64UpDownCounter returns a counter that records nothing.
 func (t *NoopTelemetry) MeterInt64UpDownCounter(metric Metric) (metric.Int64UpDownCounter, error) {
-	return nil, nil
+	return noop.Int64UpDownCounter{}, nil
+}
+
+// MeterInt64Gauge returns a gauge that records nothing.
+func (t *NoopTelemetry) MeterInt64Gauge(metric Metric) (metric.Int64Gauge, error) {
+	return noop.Int64Gauge{}, nil
 }
 
 // Propagator returns a no-op propagator.
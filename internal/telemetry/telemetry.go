@@ -27,9 +27,11 @@ type TelemetryProvider interface {
 	LogErrorln(args ...interface{})
 	LogErrorf(template string, args ...interface{})
 	LogFatalln(args ...interface{})
+	MeterInt64Counter(metric Metric) (otelmetric.Int64Counter, error)
 	MeterInt64Histogram(metric Metric) (otelmetric.Int64Histogram, error)
 	MeterInt64UpDownCounter(metric Metric) (otelmetric.Int64UpDownCounter, error)
-	TraceStart(ctx context.Context, name string) (context.Context, oteltrace.Span)
+	MeterInt64Gauge(metric Metric) (otelmetric.Int64Gauge, error)
+	TraceStart(ctx context.Context, name string, opts ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span)
 	// Middleware factories for net/http
 	LogRequest(next http.Handler) http.Handler
 	MeterRequestDuration(next http.Handler) http.Handler
@@ -127,6 +129,21 @@ func (t *Telemetry) LogFatalln(args ...interface{}) {
 	t.log.Fatalln(args...)
 }
 
+// MeterInt64Counter creates a new int64 counter metric.
+func (t *Telemetry) MeterInt64Counter(metric Metric) (otelmetric.Int64Counter, error) { //nolint:ireturn
+	counter, err := t.meter.Int64Counter(
+		metric.Name,
+		otelmetric.WithDescription(metric.Description),
+		otelmetric.WithUnit(metric.Unit),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create counter: %w", err)
+	}
+
+	return counter, nil
+}
+
 // MeterInt64Histogram creates a new int64 histogram metric.
 func (t *Telemetry) MeterInt64Histogram(metric Metric) (otelmetric.Int64Histogram, error) { //nolint:ireturn
 	histogram, err := t.meter.Int64Histogram(
@@ -157,10 +174,25 @@ func (t *Telemetry) MeterInt64UpDownCounter(metric Metric) (otelmetric.Int64UpDo
 	return counter, nil
 }
 
-// TraceStart starts a new span with the given name. The span must be ended by calling End.
-func (t *Telemetry) TraceStart(ctx context.Context, name string) (context.Context, oteltrace.Span) { //nolint:ireturn
+// MeterInt64Gauge creates a new int64 gauge metric.
+func (t *Telemetry) MeterInt64Gauge(metric Metric) (otelmetric.Int64Gauge, error) { //nolint:ireturn
+	gauge, err := t.meter.Int64Gauge(
+		metric.Name,
+		otelmetric.WithDescription(metric.Description),
+		otelmetric.WithUnit(metric.Unit),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gauge: %w", err)
+	}
+
+	return gauge, nil
+}
+
+// TraceStart starts a new span with the given name and options, such as the span kind. The span must be ended by calling End.
+func (t *Telemetry) TraceStart(ctx context.Context, name string, opts ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span) { //nolint:ireturn
 	//nolint: spancheck
-	return t.tracer.Start(ctx, name)
+	return t.tracer.Start(ctx, name, opts...)
 }
 
 // Propagator getter